@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+// multipart framing allowed on top of the file itself
+const uploadOverhead = 1 << 20
+
+type AttachmentController interface {
+	Upload(c *gin.Context)
+	Download(c *gin.Context)
+	DownloadThumbnail(c *gin.Context)
+}
+
+type attachmentController struct {
+	attachmentUseCase usecases.AttachmentUseCase
+	maxSize           int64
+}
+
+func NewAttachmentController(attachmentUseCase usecases.AttachmentUseCase, maxSize int64) AttachmentController {
+	return &attachmentController{
+		attachmentUseCase: attachmentUseCase,
+		maxSize:           maxSize,
+	}
+}
+
+func (a *attachmentController) Upload(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, a.maxSize+uploadOverhead)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondError(c, usecases.ErrAttachmentTooLarge, "Failed to upload attachment")
+			return
+		}
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "A 'file' form field is required")
+		return
+	}
+	if fileHeader.Size > a.maxSize {
+		respondError(c, usecases.ErrAttachmentTooLarge, "Failed to upload attachment")
+		return
+	}
+
+	conversation := c.PostForm("conversation")
+	if conversation == "" {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "A 'conversation' form field is required")
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid file")
+		return
+	}
+	defer file.Close()
+
+	attachment, err := a.attachmentUseCase.Upload(c.Request.Context(), c.GetString("user"), conversation, fileHeader.Filename, file)
+	if err != nil {
+		respondError(c, err, "Failed to upload attachment")
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+func (a *attachmentController) Download(c *gin.Context) {
+	a.serve(c, false)
+}
+
+func (a *attachmentController) DownloadThumbnail(c *gin.Context) {
+	a.serve(c, true)
+}
+
+func (a *attachmentController) serve(c *gin.Context, thumbnail bool) {
+	attachment, blob, err := a.attachmentUseCase.Open(c.Request.Context(), c.GetString("user"), c.Param("id"), thumbnail)
+	if err != nil {
+		respondError(c, err, "Failed to retrieve attachment")
+		return
+	}
+	defer blob.Close()
+
+	contentType, size := attachment.MIMEType, attachment.Size
+	if thumbnail {
+		contentType, size = "image/jpeg", -1
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})
+	c.DataFromReader(http.StatusOK, size, contentType, blob, map[string]string{
+		"Content-Disposition":    disposition,
+		"X-Content-Type-Options": "nosniff",
+	})
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// A DM sent through one node reaches the recipient's socket on another,
+// through the connection registry and the node channels in Redis.
+func TestDMReachesSocketOnAnotherNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	nodeA := newTestNode(t, mr, "node-a")
+	nodeB := newTestNode(t, mr, "node-b")
+
+	senderToken := nodeA.login(t, "alice")
+	conn := nodeB.dial(t, nodeB.login(t, "bob"))
+
+	// The unread counts come once the connection is registered
+	var frame models.WSMessage
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "unread" {
+		t.Fatalf("first frame = %+v, %v; want unread", frame, err)
+	}
+
+	status, body := nodeA.post(t, "/dm/send", senderToken, map[string]string{
+		"from":      "alice",
+		"to":        "bob",
+		"content":   "hello from node A",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	if status != http.StatusOK {
+		t.Fatalf("send DM: %d %s", status, body)
+	}
+
+	for {
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("DM never reached node B: %v", err)
+		}
+		if frame.Type == "dm" {
+			break
+		}
+	}
+	if frame.From != "alice" || frame.Content != "hello from node A" {
+		t.Errorf("received %+v", frame)
+	}
+}
+
+// A connection is registered on the node holding it only, so events for its
+// user are published to that node's channel alone.
+func TestConnectionIsRegisteredOnItsNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	nodeA := newTestNode(t, mr, "node-a")
+	newTestNode(t, mr, "node-b")
+
+	conn := nodeA.dial(t, nodeA.login(t, "bob"))
+	var frame models.WSMessage
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := nodeA.hub.(*webSocketController).registry.Nodes(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0] != "node-a" {
+		t.Errorf("bob is registered on %v, want [node-a]", nodes)
+	}
+}
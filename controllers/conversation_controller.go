@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+type ConversationController interface {
+	MarkRead(c *gin.Context)
+	GetUnreadCounts(c *gin.Context)
+	ListConversations(c *gin.Context)
+	SetTyping(c *gin.Context)
+}
+
+type conversationController struct {
+	messageUseCase usecases.MessageUseCase
+	typingUseCase  usecases.TypingUseCase
+}
+
+func NewConversationController(messageUseCase usecases.MessageUseCase, typingUseCase usecases.TypingUseCase) ConversationController {
+	return &conversationController{
+		messageUseCase: messageUseCase,
+		typingUseCase:  typingUseCase,
+	}
+}
+
+func (cc *conversationController) MarkRead(c *gin.Context) {
+	type Req struct {
+		MessageID string `json:"message_id"`
+	}
+
+	// The body is optional: without a message ID everything is marked read
+	var req Req
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid data")
+			return
+		}
+	}
+
+	err := cc.messageUseCase.MarkRead(c.Request.Context(), c.GetString("user"), c.Param("id"), req.MessageID)
+	if err != nil {
+		respondError(c, err, "Failed to mark conversation as read")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation marked as read"})
+}
+
+func (cc *conversationController) GetUnreadCounts(c *gin.Context) {
+	counts, err := cc.messageUseCase.GetUnreadCounts(c.Request.Context(), c.GetString("user"))
+	if err != nil {
+		respondError(c, err, "Failed to retrieve unread counts")
+		return
+	}
+
+	c.JSON(http.StatusOK, counts)
+}
+
+func (cc *conversationController) ListConversations(c *gin.Context) {
+	offset, limit, ok := parsePagination(c)
+	if !ok {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid pagination parameters")
+		return
+	}
+
+	list, err := cc.messageUseCase.ListConversations(c.Request.Context(), c.GetString("user"), offset, limit)
+	if err != nil {
+		respondError(c, err, "Failed to retrieve conversations")
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// SetTyping shows or clears the caller's typing indicator in a conversation,
+// for clients that are not on the WebSocket. Clients refresh it at most every
+// TYPING_INTERVAL while the user types.
+func (cc *conversationController) SetTyping(c *gin.Context) {
+	type Req struct {
+		Typing *bool `json:"typing" binding:"required"`
+	}
+
+	var req Req
+	if err := c.ShouldBindJSON(&req); err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid data")
+		return
+	}
+
+	var err error
+	if *req.Typing {
+		err = cc.typingUseCase.StartTyping(c.Request.Context(), c.GetString("user"), c.Param("id"))
+	} else {
+		err = cc.typingUseCase.StopTyping(c.Request.Context(), c.GetString("user"), c.Param("id"))
+	}
+	if err != nil {
+		respondError(c, err, "Failed to update typing indicator")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Typing indicator updated"})
+}
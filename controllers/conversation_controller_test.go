@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// Typing over REST is limited like typing over the WebSocket: a refresh
+// within the interval is dropped, and a stop lets the next start through.
+func TestSetTypingIsRateLimited(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	token := node.login(t, "alice")
+	conn := node.dial(t, node.login(t, "bob"))
+
+	var frame models.WSMessage
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "unread" {
+		t.Fatalf("first frame = %+v, %v; want unread", frame, err)
+	}
+
+	for _, typing := range []bool{true, true, false, true} {
+		status, body := node.post(t, "/conversations/dm:alice:bob/typing", token, map[string]bool{"typing": typing})
+		if status != http.StatusOK {
+			t.Fatalf("set typing %v: %d %s", typing, status, body)
+		}
+	}
+
+	// The second start was within the interval
+	for _, want := range []bool{true, false, true} {
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for typing %v: %v", want, err)
+		}
+		var indicator models.TypingIndicator
+		if err := json.Unmarshal(frame.Data, &indicator); err != nil || frame.Type != "typing" {
+			t.Fatalf("frame = %+v, %v; want typing", frame, err)
+		}
+		if indicator.Typing != want || indicator.User != "alice" {
+			t.Errorf("indicator = %+v, want typing %v from alice", indicator, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/usecases"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorStatus maps a use case error to an HTTP status. It is the one mapping
+// of errors: the codes of problems, error frames, GraphQL errors and gRPC
+// errors all follow from it.
+func errorStatus(err error) int {
+	switch usecases.KindOf(err) {
+	case usecases.KindValidation:
+		return http.StatusBadRequest
+	case usecases.KindUnauthorized:
+		return http.StatusUnauthorized
+	case usecases.KindForbidden:
+		return http.StatusForbidden
+	case usecases.KindNotFound:
+		return http.StatusNotFound
+	case usecases.KindConflict:
+		return http.StatusConflict
+	case usecases.KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case usecases.KindRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorCode is the stable code of a use case error.
+func errorCode(err error) string {
+	return models.ErrorCode(errorStatus(err))
+}
+
+// errorText exposes the use case error to the client unless it is an
+// unexpected failure, in which case the generic fallback is returned.
+func errorText(err error, fallback string) string {
+	if errorStatus(err) == http.StatusInternalServerError {
+		return fallback
+	}
+	return err.Error()
+}
+
+// respondError answers a request whose use case failed with a problem. The
+// cause of an unexpected failure is not shown to the client, so it is logged
+// with the request ID instead.
+func respondError(c *gin.Context, err error, fallback string) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Request %s: %s: %v", infrastructure.RequestIDFromContext(c.Request.Context()), fallback, err)
+	}
+	infrastructure.AbortWithProblem(c, status, errorText(err, fallback))
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sendQueueSize is how many live events may wait for a slow client before it
+// is disconnected.
+const sendQueueSize = 256
+
+// client is a connection on this node that receives its user's live events:
+// a WebSocket, an SSE stream or a waiting long poll.
+type client interface {
+	info() *clientInfo
+	// deliver hands over a live event without blocking on the network. The
+	// event is shared with the user's other clients.
+	deliver(ev *outboundEvent)
+	// goAway asks the client to reconnect after the given delay and closes it.
+	goAway(reconnectAfter time.Duration)
+	// shutdown closes the client and returns the reason it was closed for.
+	shutdown(reason string) string
+}
+
+// clientInfo says who is connected. It is set before the client is
+// registered.
+type clientInfo struct {
+	username string
+	device   string
+	session  string // presence session
+}
+
+func (i *clientInfo) info() *clientInfo {
+	return i
+}
+
+// eventQueue buffers the live events of a client for its writer, so that a
+// slow client never holds up delivery to others. Until resume is called they
+// are held back so that the events sent on connect arrive first.
+type eventQueue struct {
+	stateMu   sync.Mutex // guards live and pending
+	live      bool
+	pending   []*outboundEvent
+	queue     chan *outboundEvent
+	goingAway atomic.Bool
+
+	overflow func() // called when the queue is full
+}
+
+func newEventQueue(overflow func()) *eventQueue {
+	return &eventQueue{queue: make(chan *outboundEvent, sendQueueSize), overflow: overflow}
+}
+
+// deliver queues a live event for the writer, or holds it back while the
+// client is still being set up. It never blocks.
+func (q *eventQueue) deliver(ev *outboundEvent) {
+	q.stateMu.Lock()
+	defer q.stateMu.Unlock()
+	if q.goingAway.Load() {
+		return
+	}
+	if !q.live {
+		q.pending = append(q.pending, ev)
+		return
+	}
+	q.enqueue(ev)
+}
+
+// enqueue hands an event to the writer. The caller holds stateMu.
+func (q *eventQueue) enqueue(ev *outboundEvent) {
+	select {
+	case q.queue <- ev:
+	default:
+		go q.overflow()
+	}
+}
+
+// resume queues the events held back during set-up, skipping those a replay
+// up to replayedSeq already sent, and switches to live delivery.
+func (q *eventQueue) resume(replayedSeq int64) {
+	q.stateMu.Lock()
+	defer q.stateMu.Unlock()
+	for _, ev := range q.pending {
+		if ev.msg.Seq != 0 && ev.msg.Seq <= replayedSeq {
+			continue
+		}
+		q.enqueue(ev)
+	}
+	q.pending, q.live = nil, true
+}
+
+// stopDelivery drops the events still to come once the client is told to go
+// away; it replays them after reconnecting.
+func (q *eventQueue) stopDelivery() {
+	q.stateMu.Lock()
+	q.goingAway.Store(true)
+	q.stateMu.Unlock()
+}
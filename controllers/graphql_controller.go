@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/protocol"
+	"github.com/haileamlak/chat-system/usecases"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlMaxDepth bounds how deeply a query may nest, so that one request
+// cannot walk the whole graph.
+const graphqlMaxDepth = 10
+
+// GraphQLController serves the GraphQL API of protocol/schema.graphql at
+// /graphql: queries as POSTs, subscriptions over a WebSocket.
+type GraphQLController interface {
+	Query(c *gin.Context)
+	Subscribe(c *gin.Context)
+}
+
+type graphqlController struct {
+	schema          *graphql.Schema
+	hub             clientHub
+	config          WebSocketConfig
+	messageUseCase  usecases.MessageUseCase
+	presenceUseCase usecases.PresenceUseCase
+	authMiddleware  infrastructure.AuthMiddleware
+	upgrader        websocket.Upgrader
+}
+
+// NewGraphQLController runs the GraphQL API on the same use cases as the
+// REST endpoints. Subscriptions are clients of the WebSocket controller's
+// hub, and authenticate with the same tokens through the auth middleware.
+func NewGraphQLController(userUseCase usecases.UserUseCase, messageUseCase usecases.MessageUseCase, presenceUseCase usecases.PresenceUseCase, hub WebSocketController, authMiddleware infrastructure.AuthMiddleware) GraphQLController {
+	config := hub.connectionConfig()
+	resolver := &graphqlResolver{userUseCase: userUseCase, messageUseCase: messageUseCase, presenceUseCase: presenceUseCase, hub: hub}
+	return &graphqlController{
+		schema: graphql.MustParseSchema(protocol.GraphQLSchema, resolver,
+			graphql.UseStringDescriptions(),
+			graphql.MaxDepth(graphqlMaxDepth),
+			// Lets the fields of a whole page resolve at once, so that their
+			// loads land in one batch
+			graphql.MaxParallelism(loaderMaxBatch),
+		),
+		hub:             hub,
+		config:          config,
+		messageUseCase:  messageUseCase,
+		presenceUseCase: presenceUseCase,
+		authMiddleware:  authMiddleware,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       func(r *http.Request) bool { return true },
+			Subprotocols:      []string{graphqlTransportWS},
+			EnableCompression: config.CompressionLevel != 0,
+		},
+	}
+}
+
+// graphqlRequest is a GraphQL operation, as POSTed or sent in a subscribe
+// message.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Query serves POST /graphql. Errors in resolving fields are reported in the
+// response's errors, with a code and the request ID in their extensions, next
+// to the data that could be resolved.
+func (g *graphqlController) Query(c *gin.Context) {
+	var req graphqlRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Query == "" {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid GraphQL request")
+		return
+	}
+
+	ctx := g.operationContext(infrastructure.ContextWithUser(c.Request.Context(), c.GetString("user")))
+	resp := g.schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	c.JSON(http.StatusOK, withErrorExtensions(resp, infrastructure.RequestIDFromContext(c.Request.Context())))
+}
+
+// withErrorExtensions gives every error of a response a code, if its resolver
+// did not, and the request ID. Errors outside resolvers are those of parsing
+// and validating the operation.
+func withErrorExtensions(resp *graphql.Response, requestID string) *graphql.Response {
+	for _, err := range resp.Errors {
+		if err.Extensions == nil {
+			err.Extensions = make(map[string]interface{})
+		}
+		if _, ok := err.Extensions["code"]; !ok {
+			err.Extensions["code"] = models.ErrCodeInvalidRequest
+			if len(err.Path) > 0 {
+				err.Extensions["code"] = models.ErrCodeInternal
+			}
+		}
+		err.Extensions["request_id"] = requestID
+	}
+	return resp
+}
+
+// operationContext gives an operation of the user in ctx its own loaders,
+// which fetch with ctx.
+func (g *graphqlController) operationContext(ctx context.Context) context.Context {
+	loaders := newGraphQLLoaders(ctx, infrastructure.UserFromContext(ctx), g.messageUseCase, g.presenceUseCase)
+	return context.WithValue(ctx, graphqlLoadersKey{}, loaders)
+}
@@ -0,0 +1,355 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+// queryError is an error of a GraphQL response, as clients see it.
+type queryError struct {
+	Message    string `json:"message"`
+	Extensions struct {
+		Code      string `json:"code"`
+		RequestID string `json:"request_id"`
+	} `json:"extensions"`
+}
+
+type queryResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []queryError    `json:"errors"`
+}
+
+// query runs an operation as the token's user, decodes its data into data and
+// returns its errors.
+func (n *testNode) query(t *testing.T, token, query string, variables map[string]interface{}, data interface{}) []queryError {
+	t.Helper()
+	status, body := n.post(t, "/graphql", token, map[string]interface{}{"query": query, "variables": variables})
+	if status != http.StatusOK {
+		t.Fatalf("POST /graphql: %d %s", status, body)
+	}
+	var resp queryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if data != nil && len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.Errors
+}
+
+// sendDM sends a DM over REST and returns its ID.
+func (n *testNode) sendDM(t *testing.T, token, from, to, content string) string {
+	t.Helper()
+	return n.mustPost(t, "/dm/send", token, map[string]string{"from": from, "to": to, "content": content, "timestamp": time.Now().UTC().Format(time.RFC3339)})
+}
+
+// mustPost posts as the token's user, fails unless the response is 200 and
+// returns the ID in it, if any.
+func (n *testNode) mustPost(t *testing.T, path, token string, body interface{}) string {
+	t.Helper()
+	status, resp := n.post(t, path, token, body)
+	if status != http.StatusOK {
+		t.Fatalf("POST %s: %d %s", path, status, resp)
+	}
+	var ack struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(resp, &ack)
+	return ack.ID
+}
+
+type conversationsData struct {
+	Me struct {
+		Username string `json:"username"`
+	} `json:"me"`
+	Conversations struct {
+		Total         int `json:"total"`
+		Conversations []struct {
+			ID           string `json:"id"`
+			Kind         string `json:"kind"`
+			Participants []struct {
+				Username string `json:"username"`
+			} `json:"participants"`
+			LastMessage struct {
+				ID   string `json:"id"`
+				From struct {
+					Username string `json:"username"`
+				} `json:"from"`
+			} `json:"lastMessage"`
+			Messages struct {
+				Total    int `json:"total"`
+				Messages []struct {
+					ID string `json:"id"`
+				} `json:"messages"`
+			} `json:"messages"`
+		} `json:"conversations"`
+	} `json:"conversations"`
+}
+
+const conversationsQuery = `{
+  me { username presence { state } }
+  conversations(limit: 10) {
+    total
+    conversations {
+      id kind
+      participants { username presence { state } }
+      lastMessage { id content from { username presence { state } } }
+      messages(limit: 2) { total messages { id from { username presence { state } } } }
+    }
+  }
+}`
+
+func TestGraphQLQueriesNeedValidToken(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	for _, token := range []string{"", "not-a-token"} {
+		if status, body := node.post(t, "/graphql", token, map[string]string{"query": "{ me { username } }"}); status != http.StatusUnauthorized {
+			t.Errorf("token %q: got %d %s, want 401", token, status, body)
+		}
+	}
+}
+
+// A page of conversations resolves in one request, and every presence on it,
+// the caller's included, in one fetch.
+func TestGraphQLConversationPage(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	bobToken := node.login(t, "bob")
+	id := node.sendDM(t, node.login(t, "alice"), "alice", "bob", "hello over GraphQL")
+
+	before := graphqlBatchCount("presence")
+	var data conversationsData
+	if errs := node.query(t, bobToken, conversationsQuery, nil, &data); len(errs) > 0 {
+		t.Fatalf("query failed: %+v", errs)
+	}
+	if n := graphqlBatchCount("presence") - before; n != 1 {
+		t.Errorf("presence was fetched %d times, want once", n)
+	}
+
+	if data.Me.Username != "bob" || data.Conversations.Total != 1 {
+		t.Fatalf("unexpected data %+v", data)
+	}
+	dm := data.Conversations.Conversations[0]
+	if dm.ID != "dm:alice:bob" || dm.Kind != "dm" || len(dm.Participants) != 2 || dm.LastMessage.ID != id || dm.LastMessage.From.Username != "alice" {
+		t.Errorf("unexpected conversation %+v", dm)
+	}
+	if dm.Messages.Total != 1 || dm.Messages.Messages[0].ID != id {
+		t.Errorf("unexpected history %+v", dm.Messages)
+	}
+}
+
+func graphqlBatchCount(loader string) int64 {
+	if v := graphqlBatches.Get(loader); v != nil {
+		var n int64
+		json.Unmarshal([]byte(v.String()), &n)
+		return n
+	}
+	return 0
+}
+
+func TestGraphQLGroupsAreVisibleToMembersOnly(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	aliceToken, bobToken := node.login(t, "alice"), node.login(t, "bob")
+	node.mustPost(t, "/group/create", aliceToken, map[string]string{"group": "team"})
+	id := node.mustPost(t, "/group/send", aliceToken, map[string]string{"from": "alice", "group": "team", "content": "members only", "timestamp": time.Now().UTC().Format(time.RFC3339)})
+
+	var data struct {
+		Group *struct {
+			Name        string `json:"name"`
+			MemberCount int    `json:"memberCount"`
+			Messages    struct {
+				Total    int `json:"total"`
+				Messages []struct {
+					Group struct {
+						Name string `json:"name"`
+					} `json:"group"`
+				} `json:"messages"`
+			} `json:"messages"`
+		} `json:"group"`
+		Message *struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}
+	query := `query($name: String!, $id: ID!) {
+  group(name: $name) { name memberCount messages { total messages { group { name } } } }
+  message(id: $id) { content }
+}`
+	vars := map[string]interface{}{"name": "team", "id": id}
+
+	if errs := node.query(t, bobToken, query, vars, &data); len(errs) > 0 || data.Group != nil || data.Message != nil {
+		t.Errorf("non-member got %+v, %+v: %+v", data.Group, data.Message, errs)
+	}
+
+	node.mustPost(t, "/group/join", bobToken, map[string]string{"group": "team", "user": "bob"})
+	if errs := node.query(t, bobToken, query, vars, &data); len(errs) > 0 || data.Group == nil || data.Message == nil {
+		t.Fatalf("member got %+v, %+v: %+v", data.Group, data.Message, errs)
+	}
+	if data.Group.MemberCount != 2 || data.Group.Messages.Total != 1 || data.Group.Messages.Messages[0].Group.Name != "team" || data.Message.Content != "members only" {
+		t.Errorf("unexpected group %+v, message %+v", data.Group, data.Message)
+	}
+}
+
+func TestGraphQLErrorsAreCoded(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	token := node.login(t, "alice")
+
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{`{ conversations(limit: 0) { total } }`, "invalid_request"},
+		{`{ messages(conversation: "nowhere") { total } }`, "invalid_request"},
+		{`{ messages(conversation: "dm:someone:else") { total } }`, "forbidden"},
+		// Validation errors, which fail the whole operation, are invalid requests
+		{`{ me { nickname } }`, "invalid_request"},
+	}
+	for _, tt := range tests {
+		errs := node.query(t, token, tt.query, nil, nil)
+		if len(errs) != 1 || errs[0].Extensions.Code != tt.code || errs[0].Extensions.RequestID == "" {
+			t.Errorf("%s: got %+v, want a %s error with a request ID", tt.query, errs, tt.code)
+		}
+	}
+}
+
+// eventsSubscription is a graphql-transport-ws connection running one events
+// subscription.
+type eventsSubscription struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// eventData is the data of a next message of the events subscription.
+type eventData struct {
+	Events struct {
+		Type    string `json:"type"`
+		Seq     *int64 `json:"seq"`
+		Message *struct {
+			ID   string `json:"id"`
+			From struct {
+				Username string `json:"username"`
+			} `json:"from"`
+		} `json:"message"`
+	} `json:"events"`
+}
+
+// dialGraphQL opens a graphql-transport-ws connection and initialises it with
+// the token.
+func (n *testNode) dialGraphQL(t *testing.T, token string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}, HandshakeTimeout: time.Second}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(n.server.URL, "http")+"/graphql", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	payload, _ := json.Marshal(map[string]string{"authorization": "Bearer " + token})
+	if err := conn.WriteJSON(graphqlMessage{Type: "connection_init", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func (n *testNode) subscribeEvents(t *testing.T, token string, cursor *int64) *eventsSubscription {
+	t.Helper()
+	conn := n.dialGraphQL(t, token)
+	var msg graphqlMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, got %+v: %v", msg, err)
+	}
+
+	variables := map[string]interface{}{}
+	if cursor != nil {
+		variables["cursor"] = *cursor
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"query":     `subscription($cursor: Int64) { events(cursor: $cursor) { type seq message { id from { username } } } }`,
+		"variables": variables,
+	})
+	if err := conn.WriteJSON(graphqlMessage{ID: "events", Type: "subscribe", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	sub := &eventsSubscription{t: t, conn: conn}
+	if data := sub.next(); data.Events.Type != "unread" {
+		t.Fatalf("expected the unread counts first, got %+v", data)
+	}
+	return sub
+}
+
+func (s *eventsSubscription) next() eventData {
+	s.t.Helper()
+	var msg graphqlMessage
+	if err := s.conn.ReadJSON(&msg); err != nil {
+		s.t.Fatal(err)
+	}
+	if msg.Type != "next" || msg.ID != "events" {
+		s.t.Fatalf("expected a next message, got %s %s", msg.Type, msg.Payload)
+	}
+	var resp queryResponse
+	json.Unmarshal(msg.Payload, &resp)
+	if len(resp.Errors) > 0 {
+		s.t.Fatalf("event failed to resolve: %+v", resp.Errors)
+	}
+	var data eventData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		s.t.Fatal(err)
+	}
+	return data
+}
+
+// nextMessage skips to the next message.new event.
+func (s *eventsSubscription) nextMessage() eventData {
+	s.t.Helper()
+	for {
+		if data := s.next(); data.Events.Type == "message.new" {
+			return data
+		}
+	}
+}
+
+// close completes the subscription and closes the connection.
+func (s *eventsSubscription) close() {
+	s.conn.WriteJSON(graphqlMessage{ID: "events", Type: "complete"})
+	s.conn.Close()
+}
+
+func TestGraphQLSubscriptionsNeedValidToken(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	conn := node.dialGraphQL(t, "not-a-token")
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, closeCodeForbidden) {
+		t.Errorf("expected close %d, got %v", closeCodeForbidden, err)
+	}
+}
+
+func TestGraphQLSubscriptionDeliversEvents(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	sub := node.subscribeEvents(t, node.login(t, "bob"), nil)
+
+	id := node.sendDM(t, node.login(t, "alice"), "alice", "bob", "hello, subscriber")
+	data := sub.nextMessage()
+	if msg := data.Events.Message; msg == nil || msg.ID != id || msg.From.Username != "alice" || data.Events.Seq == nil {
+		t.Errorf("unexpected event %+v", data.Events)
+	}
+}
+
+func TestGraphQLCursorReplaysMissedEvents(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	aliceToken, bobToken := node.login(t, "alice"), node.login(t, "bob")
+
+	sub := node.subscribeEvents(t, bobToken, nil)
+	node.sendDM(t, aliceToken, "alice", "bob", "before")
+	cursor := *sub.nextMessage().Events.Seq
+	sub.close()
+
+	missed := node.sendDM(t, aliceToken, "alice", "bob", "missed")
+	data := node.subscribeEvents(t, bobToken, &cursor).nextMessage()
+	if data.Events.Message == nil || data.Events.Message.ID != missed || *data.Events.Seq <= cursor {
+		t.Errorf("replayed %+v after cursor %d, want message %s", data.Events, cursor, missed)
+	}
+}
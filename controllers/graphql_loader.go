@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+const (
+	// loaderWait is how long the first load of a batch waits for the
+	// resolvers running alongside it to add their keys.
+	loaderWait = 2 * time.Millisecond
+	// loaderMaxBatch dispatches a batch early once it holds this many keys.
+	loaderMaxBatch = maxPageLimit
+)
+
+// graphqlBatches counts the fetches of each loader, served at /debug/vars.
+var graphqlBatches = expvar.NewMap("graphql_batches")
+
+// loader collects the keys that the resolvers of a GraphQL operation load
+// concurrently and fetches them in one batch, dataloader style. Results are
+// cached for the rest of the operation, so a key is fetched at most once.
+// Batches are fetched with the operation's context: a batch serves every
+// resolver that added a key, so it must not end with the one that started it.
+type loader[K comparable, V any] struct {
+	ctx   context.Context
+	name  string
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	results map[K]*loaderResult[V]
+	batch   *loaderBatch[K, V] // collecting keys, nil between batches
+}
+
+type loaderResult[V any] struct {
+	done  chan struct{} // closed once value and err are set
+	value V
+	err   error
+}
+
+type loaderBatch[K comparable, V any] struct {
+	keys    []K
+	results []*loaderResult[V]
+	once    sync.Once
+}
+
+func newLoader[K comparable, V any](ctx context.Context, name string, fetch func(ctx context.Context, keys []K) (map[K]V, error)) *loader[K, V] {
+	return &loader[K, V]{ctx: ctx, name: name, fetch: fetch, results: make(map[K]*loaderResult[V])}
+}
+
+// load returns the value of a key, or the zero value if the fetch had none.
+// It stops waiting when ctx, the resolver's, is done.
+func (l *loader[K, V]) load(ctx context.Context, key K) (V, error) {
+	l.mu.Lock()
+	result, ok := l.results[key]
+	if !ok {
+		result = &loaderResult[V]{done: make(chan struct{})}
+		l.results[key] = result
+		if l.batch == nil {
+			batch := &loaderBatch[K, V]{}
+			l.batch = batch
+			time.AfterFunc(loaderWait, func() { l.dispatch(batch) })
+		}
+		l.batch.keys = append(l.batch.keys, key)
+		l.batch.results = append(l.batch.results, result)
+		if len(l.batch.keys) >= loaderMaxBatch {
+			go l.dispatch(l.batch)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-result.done:
+		return result.value, result.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// dispatch fetches a batch, once, and hands every waiting load its result.
+func (l *loader[K, V]) dispatch(batch *loaderBatch[K, V]) {
+	l.mu.Lock()
+	if l.batch == batch {
+		l.batch = nil
+	}
+	l.mu.Unlock()
+
+	batch.once.Do(func() {
+		graphqlBatches.Add(l.name, 1)
+		values, err := l.fetch(l.ctx, batch.keys)
+		for i, key := range batch.keys {
+			batch.results[i].value, batch.results[i].err = values[key], err
+			close(batch.results[i].done)
+		}
+	})
+}
+
+// graphqlLoaders are the loaders of one GraphQL operation, or of one event of
+// a subscription, so that nothing is cached for longer than that, along with
+// who they load for. They fetch with ctx, the operation's.
+type graphqlLoaders struct {
+	ctx            context.Context
+	viewer         string
+	messageUseCase usecases.MessageUseCase
+	presence       *loader[string, *models.Presence]
+	messages       *loader[string, *models.Message]
+	groups         *loader[string, []string] // members, of the viewer's groups only
+}
+
+func newGraphQLLoaders(ctx context.Context, viewer string, messageUseCase usecases.MessageUseCase, presenceUseCase usecases.PresenceUseCase) *graphqlLoaders {
+	return &graphqlLoaders{
+		ctx:            ctx,
+		viewer:         viewer,
+		messageUseCase: messageUseCase,
+		presence: newLoader(ctx, "presence", func(ctx context.Context, users []string) (map[string]*models.Presence, error) {
+			presence, err := presenceUseCase.GetPresence(ctx, users)
+			if err != nil {
+				return nil, err
+			}
+			byUser := make(map[string]*models.Presence, len(presence))
+			for _, entry := range presence {
+				byUser[entry.User] = entry
+			}
+			return byUser, nil
+		}),
+		messages: newLoader(ctx, "messages", func(ctx context.Context, ids []string) (map[string]*models.Message, error) {
+			return messageUseCase.GetMessagesByID(ctx, viewer, ids)
+		}),
+		groups: newLoader(ctx, "groups", func(ctx context.Context, groups []string) (map[string][]string, error) {
+			return messageUseCase.GetGroupsMembers(ctx, viewer, groups)
+		}),
+	}
+}
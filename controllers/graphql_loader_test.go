@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// A batch is fetched with the operation's context, so it still serves the
+// other resolvers when the one that started it is cancelled.
+func TestLoaderBatchOutlivesFirstResolver(t *testing.T) {
+	var mu sync.Mutex
+	var fetched [][]string
+	l := newLoader(context.Background(), "test", func(ctx context.Context, keys []string) (map[string]string, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		fetched = append(fetched, keys)
+		mu.Unlock()
+		values := make(map[string]string, len(keys))
+		for _, key := range keys {
+			values[key] = "value of " + key
+		}
+		return values, nil
+	})
+
+	first, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.load(first, "a"); err != context.Canceled {
+		t.Fatalf("cancelled load returned %v", err)
+	}
+	value, err := l.load(context.Background(), "b")
+	if err != nil || value != "value of b" {
+		t.Fatalf("load = %q, %v", value, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetched) != 1 || len(fetched[0]) != 2 {
+		t.Errorf("fetched %v, want a and b in one batch", fetched)
+	}
+}
@@ -0,0 +1,508 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/usecases"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlResolver resolves the root fields of protocol/schema.graphql. The
+// types below it load what they link to through the operation's loaders.
+type graphqlResolver struct {
+	userUseCase     usecases.UserUseCase
+	messageUseCase  usecases.MessageUseCase
+	presenceUseCase usecases.PresenceUseCase
+	hub             clientHub
+}
+
+type graphqlLoadersKey struct{}
+
+// loaders returns the loaders of the operation being resolved.
+func (r *graphqlResolver) loaders(ctx context.Context) *graphqlLoaders {
+	return ctx.Value(graphqlLoadersKey{}).(*graphqlLoaders)
+}
+
+type pageArgs struct {
+	Offset *int32
+	Limit  *int32
+}
+
+func (r *graphqlResolver) Me(ctx context.Context) *userResolver {
+	l := r.loaders(ctx)
+	return &userResolver{username: l.viewer, l: l}
+}
+
+func (r *graphqlResolver) User(ctx context.Context, args struct{ Username string }) (*userResolver, error) {
+	exists, err := r.userUseCase.UserExists(ctx, args.Username)
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to look up user")
+	}
+	if !exists {
+		return nil, nil
+	}
+	return &userResolver{username: args.Username, l: r.loaders(ctx)}, nil
+}
+
+func (r *graphqlResolver) Group(ctx context.Context, args struct{ Name string }) (*groupResolver, error) {
+	return loadGroup(ctx, r.loaders(ctx), args.Name)
+}
+
+func (r *graphqlResolver) Conversations(ctx context.Context, args pageArgs) (*conversationPageResolver, error) {
+	offset, limit, err := graphqlPage(args)
+	if err != nil {
+		return nil, err
+	}
+	l := r.loaders(ctx)
+	list, err := r.messageUseCase.ListConversations(ctx, l.viewer, offset, limit)
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to list conversations")
+	}
+	return &conversationPageResolver{list: list, l: l}, nil
+}
+
+func (r *graphqlResolver) Messages(ctx context.Context, args struct {
+	Conversation graphql.ID
+	pageArgs
+}) (*messagePageResolver, error) {
+	return conversationHistory(ctx, r.loaders(ctx), string(args.Conversation), args.pageArgs)
+}
+
+func (r *graphqlResolver) Message(ctx context.Context, args struct{ ID graphql.ID }) (*messageResolver, error) {
+	l := r.loaders(ctx)
+	msg, err := l.messages.load(ctx, string(args.ID))
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to load message")
+	}
+	if msg == nil {
+		return nil, nil
+	}
+	return &messageResolver{msg: msg, l: l}, nil
+}
+
+// graphqlPage turns page arguments into an offset and limit, capping the
+// limit like the REST endpoints do.
+func graphqlPage(args pageArgs) (int64, int64, error) {
+	var offset, limit int64 = 0, defaultPageLimit
+	if args.Offset != nil {
+		offset = int64(*args.Offset)
+	}
+	if args.Limit != nil {
+		limit = int64(*args.Limit)
+	}
+	if offset < 0 || limit <= 0 {
+		return 0, 0, &graphqlError{code: models.ErrCodeInvalidRequest, message: "offset must not be negative and limit must be positive"}
+	}
+	return offset, min(limit, maxPageLimit), nil
+}
+
+func loadGroup(ctx context.Context, l *graphqlLoaders, name string) (*groupResolver, error) {
+	members, err := l.groups.load(ctx, name)
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to load group")
+	}
+	if members == nil {
+		return nil, nil
+	}
+	return &groupResolver{name: name, members: members, l: l}, nil
+}
+
+func conversationHistory(ctx context.Context, l *graphqlLoaders, conversationID string, args pageArgs) (*messagePageResolver, error) {
+	offset, limit, err := graphqlPage(args)
+	if err != nil {
+		return nil, err
+	}
+	msgs, total, err := l.messageUseCase.GetConversationHistory(ctx, l.viewer, conversationID, offset, limit)
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to retrieve messages")
+	}
+	return &messagePageResolver{msgs: msgs, total: total, l: l}, nil
+}
+
+// graphqlError is a resolver error carrying one of the shared error codes
+// (models.ErrCode*) in its extensions.
+type graphqlError struct {
+	code    string
+	message string
+}
+
+func (e *graphqlError) Error() string {
+	return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func graphqlUseCaseError(err error, fallback string) error {
+	return &graphqlError{code: errorCode(err), message: errorText(err, fallback)}
+}
+
+type userResolver struct {
+	username string
+	l        *graphqlLoaders
+}
+
+func newUserResolvers(usernames []string, l *graphqlLoaders) []*userResolver {
+	users := make([]*userResolver, len(usernames))
+	for i, username := range usernames {
+		users[i] = &userResolver{username: username, l: l}
+	}
+	return users
+}
+
+func (u *userResolver) Username() string {
+	return u.username
+}
+
+func (u *userResolver) Presence(ctx context.Context) (*presenceResolver, error) {
+	presence, err := u.l.presence.load(ctx, u.username)
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to load presence")
+	}
+	if presence == nil {
+		presence = &models.Presence{User: u.username, State: models.PresenceOffline}
+	}
+	return &presenceResolver{presence: presence}, nil
+}
+
+type presenceResolver struct {
+	presence *models.Presence
+}
+
+func (p *presenceResolver) State() string {
+	return p.presence.State
+}
+
+func (p *presenceResolver) LastSeen() *string {
+	return optionalString(p.presence.LastSeen)
+}
+
+type groupResolver struct {
+	name    string
+	members []string
+	l       *graphqlLoaders
+}
+
+func (g *groupResolver) Name() string {
+	return g.name
+}
+
+func (g *groupResolver) Members() []*userResolver {
+	return newUserResolvers(g.members, g.l)
+}
+
+func (g *groupResolver) MemberCount() int32 {
+	return int32(len(g.members))
+}
+
+func (g *groupResolver) Messages(ctx context.Context, args pageArgs) (*messagePageResolver, error) {
+	return conversationHistory(ctx, g.l, usecases.GroupConversationID(g.name), args)
+}
+
+type conversationPageResolver struct {
+	list *models.ConversationList
+	l    *graphqlLoaders
+}
+
+func (p *conversationPageResolver) Conversations() []*conversationResolver {
+	conversations := make([]*conversationResolver, len(p.list.Conversations))
+	for i, summary := range p.list.Conversations {
+		conversations[i] = &conversationResolver{summary: summary, l: p.l}
+	}
+	return conversations
+}
+
+func (p *conversationPageResolver) Total() int32 {
+	return int32(p.list.Total)
+}
+
+type conversationResolver struct {
+	summary *models.ConversationSummary
+	l       *graphqlLoaders
+}
+
+func (c *conversationResolver) ID() graphql.ID {
+	return graphql.ID(c.summary.ID)
+}
+
+func (c *conversationResolver) Kind() string {
+	return c.summary.Kind
+}
+
+func (c *conversationResolver) Name() string {
+	return c.summary.Name
+}
+
+func (c *conversationResolver) Participants() []*userResolver {
+	return newUserResolvers(c.summary.Participants, c.l)
+}
+
+func (c *conversationResolver) MemberCount() int32 {
+	return int32(c.summary.MemberCount)
+}
+
+func (c *conversationResolver) LastActivityAt() string {
+	return c.summary.LastActivityAt
+}
+
+func (c *conversationResolver) LastMessage() *messageResolver {
+	if c.summary.LastMessage == nil {
+		return nil
+	}
+	return &messageResolver{msg: c.summary.LastMessage, l: c.l}
+}
+
+func (c *conversationResolver) UnreadCount() int32 {
+	return int32(c.summary.UnreadCount)
+}
+
+func (c *conversationResolver) Messages(ctx context.Context, args pageArgs) (*messagePageResolver, error) {
+	return conversationHistory(ctx, c.l, c.summary.ID, args)
+}
+
+type messagePageResolver struct {
+	msgs  []*models.Message
+	total int64
+	l     *graphqlLoaders
+}
+
+func (p *messagePageResolver) Messages() []*messageResolver {
+	msgs := make([]*messageResolver, len(p.msgs))
+	for i, msg := range p.msgs {
+		msgs[i] = &messageResolver{msg: msg, l: p.l}
+	}
+	return msgs
+}
+
+func (p *messagePageResolver) Total() int32 {
+	return int32(p.total)
+}
+
+type messageResolver struct {
+	msg *models.Message
+	l   *graphqlLoaders
+}
+
+func (m *messageResolver) ID() graphql.ID {
+	return graphql.ID(m.msg.ID)
+}
+
+func (m *messageResolver) ClientID() *string {
+	return optionalString(m.msg.ClientID)
+}
+
+func (m *messageResolver) From() *userResolver {
+	return &userResolver{username: m.msg.From, l: m.l}
+}
+
+func (m *messageResolver) To() *userResolver {
+	if m.msg.To == "" || m.msg.Group != "" {
+		return nil
+	}
+	return &userResolver{username: m.msg.To, l: m.l}
+}
+
+func (m *messageResolver) Group(ctx context.Context) (*groupResolver, error) {
+	if m.msg.Group == "" {
+		return nil, nil
+	}
+	return loadGroup(ctx, m.l, m.msg.Group)
+}
+
+func (m *messageResolver) Content() string {
+	return m.msg.Content
+}
+
+func (m *messageResolver) Timestamp() string {
+	return m.msg.Timestamp
+}
+
+func (m *messageResolver) EditedAt() *string {
+	return optionalString(m.msg.EditedAt)
+}
+
+func (m *messageResolver) Deleted() bool {
+	return m.msg.Deleted
+}
+
+func (m *messageResolver) Parent(ctx context.Context) (*messageResolver, error) {
+	if m.msg.ParentID == "" {
+		return nil, nil
+	}
+	parent, err := m.l.messages.load(ctx, m.msg.ParentID)
+	if err != nil {
+		return nil, graphqlUseCaseError(err, "Failed to load message")
+	}
+	if parent == nil {
+		return nil, nil
+	}
+	return &messageResolver{msg: parent, l: m.l}, nil
+}
+
+func (m *messageResolver) ReplyCount() int32 {
+	return int32(m.msg.ReplyCount)
+}
+
+func (m *messageResolver) LastReplyAt() *string {
+	return optionalString(m.msg.LastReplyAt)
+}
+
+func (m *messageResolver) Attachments() []*attachmentResolver {
+	attachments := make([]*attachmentResolver, len(m.msg.Attachments))
+	for i := range m.msg.Attachments {
+		attachments[i] = &attachmentResolver{attachment: &m.msg.Attachments[i]}
+	}
+	return attachments
+}
+
+func (m *messageResolver) Reactions() []*reactionResolver {
+	reactions := make([]*reactionResolver, len(m.msg.Reactions))
+	for i := range m.msg.Reactions {
+		reactions[i] = &reactionResolver{reaction: &m.msg.Reactions[i]}
+	}
+	return reactions
+}
+
+type attachmentResolver struct {
+	attachment *models.Attachment
+}
+
+func (a *attachmentResolver) ID() graphql.ID {
+	return graphql.ID(a.attachment.ID)
+}
+
+func (a *attachmentResolver) Name() string {
+	return a.attachment.Name
+}
+
+func (a *attachmentResolver) MIMEType() string {
+	return a.attachment.MIMEType
+}
+
+func (a *attachmentResolver) Size() int32 {
+	return int32(a.attachment.Size)
+}
+
+func (a *attachmentResolver) URL() string {
+	return a.attachment.URL
+}
+
+func (a *attachmentResolver) ThumbnailURL() *string {
+	return optionalString(a.attachment.ThumbnailURL)
+}
+
+type reactionResolver struct {
+	reaction *models.Reaction
+}
+
+func (r *reactionResolver) Emoji() string {
+	return r.reaction.Emoji
+}
+
+func (r *reactionResolver) Count() int32 {
+	return int32(r.reaction.Count)
+}
+
+func (r *reactionResolver) ReactedByMe() bool {
+	return r.reaction.ReactedByMe
+}
+
+// eventResolver is an event of the events subscription, as its chat.v1
+// frame. Every event has its own loaders.
+type eventResolver struct {
+	frame serverFrame
+	l     *graphqlLoaders
+}
+
+func (e *eventResolver) Type() string {
+	return e.frame.Type
+}
+
+func (e *eventResolver) Seq() *graphqlInt64 {
+	if e.frame.Seq == 0 {
+		return nil
+	}
+	seq := graphqlInt64(e.frame.Seq)
+	return &seq
+}
+
+func (e *eventResolver) Message() *messageResolver {
+	switch data := e.frame.Data.(type) {
+	case *models.MessageEvent:
+		return &messageResolver{msg: &data.Message, l: e.l}
+	case *models.Message:
+		return &messageResolver{msg: data, l: e.l}
+	default:
+		return nil
+	}
+}
+
+func (e *eventResolver) Data() *graphqlJSON {
+	if e.frame.Data == nil {
+		return nil
+	}
+	return &graphqlJSON{value: e.frame.Data}
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// graphqlInt64 is the Int64 scalar, for seqs, which outgrow GraphQL's 32-bit
+// Int. As input it may also be a string, for clients whose numbers are
+// doubles.
+type graphqlInt64 int64
+
+func (graphqlInt64) ImplementsGraphQLType(name string) bool {
+	return name == "Int64"
+}
+
+func (i *graphqlInt64) UnmarshalGraphQL(input interface{}) error {
+	switch v := input.(type) {
+	case int32:
+		*i = graphqlInt64(v)
+	case int64:
+		*i = graphqlInt64(v)
+	case float64:
+		if v != float64(int64(v)) {
+			return fmt.Errorf("%v is not an integer", v)
+		}
+		*i = graphqlInt64(v)
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*i = graphqlInt64(n)
+	default:
+		return fmt.Errorf("wrong type for Int64: %T", input)
+	}
+	return nil
+}
+
+// graphqlJSON is the JSON scalar, for the data of events.
+type graphqlJSON struct {
+	value interface{}
+}
+
+func (graphqlJSON) ImplementsGraphQLType(name string) bool {
+	return name == "JSON"
+}
+
+func (j *graphqlJSON) UnmarshalGraphQL(input interface{}) error {
+	j.value = input
+	return nil
+}
+
+func (j graphqlJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.value)
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+
+	uuid "github.com/google/uuid"
+)
+
+// graphqlOpenSubscriptions counts the events subscriptions held by this node,
+// served at /debug/vars.
+var graphqlOpenSubscriptions = expvar.NewInt("graphql_subscriptions_open")
+
+var errSubscriptionClosed = errors.New("subscription closed")
+
+// Events resolves the events subscription. Each subscription is a client of
+// the hub, like an SSE stream, fed by the same pub/sub events; it ends when
+// the operation's context is cancelled.
+func (r *graphqlResolver) Events(ctx context.Context, args struct {
+	Cursor       *graphqlInt64
+	Capabilities *[]string
+}) (<-chan *eventResolver, error) {
+	username := infrastructure.UserFromContext(ctx)
+
+	var cursor int64
+	if args.Cursor != nil {
+		cursor = int64(*args.Cursor)
+	}
+	if cursor < 0 {
+		return nil, &graphqlError{code: models.ErrCodeInvalidRequest, message: "cursor must not be negative"}
+	}
+	var capabilities []string
+	if args.Capabilities != nil {
+		capabilities = *args.Capabilities
+	}
+
+	sub := newGraphQLSubscription(ctx, func() *graphqlLoaders {
+		return newGraphQLLoaders(ctx, username, r.messageUseCase, r.presenceUseCase)
+	})
+	sub.username, sub.device = username, uuid.New().String()
+	sub.capabilities = agreeCapabilities(capabilities)
+	if !r.hub.connectClient(sub) {
+		return nil, &graphqlError{code: models.ErrCodeUnavailable, message: "Server is shutting down"}
+	}
+	graphqlOpenSubscriptions.Add(1)
+	log.Println(username, "subscribed via GraphQL")
+
+	go func() {
+		defer close(sub.events)
+		sub.resume(r.hub.sendInitialEvents(sub.send, username, args.Cursor != nil, cursor))
+		reason := sub.pump(ctx)
+
+		r.hub.removeClient(sub)
+		graphqlOpenSubscriptions.Add(-1)
+		log.Println(username, "GraphQL subscription closed:", reason)
+	}()
+	return sub.events, nil
+}
+
+// graphqlSubscription hands a user's events to an events subscription, which
+// resolves each one against its own loaders. All sends happen on the
+// subscription's goroutine, in pump.
+type graphqlSubscription struct {
+	clientInfo
+	*eventQueue
+	ctx          context.Context
+	events       chan *eventResolver
+	loaders      func() *graphqlLoaders
+	capabilities map[string]bool
+
+	leaving     chan time.Duration // receives the reconnect delay on shutdown
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closeReason string
+}
+
+func newGraphQLSubscription(ctx context.Context, loaders func() *graphqlLoaders) *graphqlSubscription {
+	s := &graphqlSubscription{
+		ctx:     ctx,
+		events:  make(chan *eventResolver),
+		loaders: loaders,
+		leaving: make(chan time.Duration, 1),
+		closed:  make(chan struct{}),
+	}
+	s.eventQueue = newEventQueue(func() { s.shutdown(closeReasonSlowConsumer) })
+	return s
+}
+
+// send hands one event to the subscription, unless it is of a capability the
+// subscriber did not ask for. It blocks until the event is taken.
+func (s *graphqlSubscription) send(msg models.WSMessage) error {
+	if !wantsEvent(msg.Type, s.capabilities) {
+		return nil
+	}
+	select {
+	case s.events <- &eventResolver{frame: eventFrame(msg), l: s.loaders()}:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-s.closed:
+		return errSubscriptionClosed
+	}
+}
+
+// pump sends queued events until the subscription ends and returns the
+// reason it ended for.
+func (s *graphqlSubscription) pump(ctx context.Context) string {
+	for {
+		select {
+		case <-ctx.Done():
+			return s.shutdown(closeReasonClient)
+		case <-s.closed:
+			return s.shutdown(closeReasonLost)
+		case reconnectAfter := <-s.leaving:
+			data, _ := json.Marshal(models.GoingAwayEvent{ReconnectAfter: reconnectAfter.Milliseconds()})
+			s.send(models.WSMessage{Type: "going_away", Data: data})
+			return s.shutdown(closeReasonShutdown)
+		case ev := <-s.queue:
+			if s.goingAway.Load() {
+				continue
+			}
+			if err := s.send(ev.msg); err != nil {
+				return s.shutdown(closeReasonClient)
+			}
+		}
+	}
+}
+
+// goAway tells the subscriber when to resubscribe and ends the subscription.
+// Events still queued are dropped, as the subscriber replays them with its
+// cursor.
+func (s *graphqlSubscription) goAway(reconnectAfter time.Duration) {
+	s.stopDelivery()
+	select {
+	case s.leaving <- reconnectAfter:
+	default:
+	}
+}
+
+// shutdown ends the subscription once and returns the reason it ended for,
+// which is the reason given by the first caller.
+func (s *graphqlSubscription) shutdown(reason string) string {
+	s.closeOnce.Do(func() {
+		if s.goingAway.Load() {
+			reason = closeReasonShutdown
+		}
+		s.closeReason = reason
+		close(s.closed)
+	})
+	return s.closeReason
+}
@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlTransportWS is the subprotocol of GraphQL over WebSocket spoken at
+// /graphql, as specified by the graphql-ws library:
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphqlTransportWS = "graphql-transport-ws"
+
+// graphqlInitTimeout is how long a client has to send connection_init.
+const graphqlInitTimeout = 10 * time.Second
+
+// Close codes of graphql-transport-ws.
+const (
+	closeCodeInvalidMessage     = 4400
+	closeCodeUnauthorized       = 4401
+	closeCodeForbidden          = 4403
+	closeCodeBadSubprotocol     = 4406
+	closeCodeInitTimeout        = 4408
+	closeCodeSubscriberExists   = 4409
+	closeCodeTooManyInitRequest = 4429
+)
+
+// graphqlMessage is a message of graphql-transport-ws, in either direction.
+type graphqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Subscribe serves GET /graphql, a graphql-transport-ws WebSocket. The client
+// authenticates in connection_init, with its token as "authorization" in the
+// payload or, if it can set headers, in the Authorization header. Operations
+// of any kind may then run over it, each answered with next messages and a
+// complete.
+func (g *graphqlController) Subscribe(c *gin.Context) {
+	if g.hub.isDraining() {
+		c.Header("Retry-After", "1")
+		infrastructure.AbortWithProblem(c, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+
+	upgraded, err := g.upgrader.Upgrade(c.Writer, c.Request, c.Writer.Header())
+	if err != nil {
+		log.Println("GraphQL WebSocket upgrade failed:", err)
+		return
+	}
+	conn := newGraphQLConn(upgraded, g.config)
+	conn.requestID = infrastructure.RequestIDFromContext(c.Request.Context())
+	defer conn.Close()
+	if upgraded.Subprotocol() != graphqlTransportWS {
+		conn.closeWith(closeCodeBadSubprotocol, "Subprotocol not acceptable")
+		return
+	}
+
+	username, ok := g.connectionInit(conn, c.GetHeader("Authorization"))
+	if !ok {
+		return
+	}
+	log.Println(username, "connected via GraphQL")
+
+	ctx, cancel := context.WithCancel(infrastructure.ContextWithUser(context.Background(), username))
+	go conn.keepAlive(ctx, g.config.PingInterval)
+	g.serve(ctx, conn)
+	cancel()
+	conn.operations.Wait()
+	log.Println(username, "GraphQL connection closed")
+}
+
+// connectionInit waits for connection_init and acknowledges it once the
+// client is authenticated. It returns the client's user.
+func (g *graphqlController) connectionInit(conn *graphqlConn, header string) (string, bool) {
+	conn.SetReadDeadline(time.Now().Add(graphqlInitTimeout))
+	msg, err := conn.read()
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		conn.closeWith(closeCodeInitTimeout, "Connection initialisation timeout")
+		return "", false
+	case errors.Is(err, errInvalidGraphQLMessage):
+		conn.closeWith(closeCodeInvalidMessage, "Invalid message")
+		return "", false
+	case err != nil:
+		return "", false
+	case msg.Type != "connection_init":
+		conn.closeWith(closeCodeUnauthorized, "Unauthorized")
+		return "", false
+	}
+
+	var payload struct {
+		Authorization string `json:"authorization"`
+	}
+	if len(msg.Payload) > 0 {
+		json.Unmarshal(msg.Payload, &payload)
+	}
+	if payload.Authorization == "" {
+		payload.Authorization = header
+	}
+	username, err := g.authMiddleware.AuthenticateToken(payload.Authorization)
+	if err != nil {
+		conn.closeWith(closeCodeForbidden, "Forbidden: "+err.Error())
+		return "", false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(conn.pongTimeout))
+	if err := conn.write(graphqlMessage{Type: "connection_ack"}); err != nil {
+		return "", false
+	}
+	return username, true
+}
+
+// serve reads the client's messages until the connection closes, starting
+// and stopping operations.
+func (g *graphqlController) serve(ctx context.Context, conn *graphqlConn) {
+	for {
+		msg, err := conn.read()
+		if errors.Is(err, errInvalidGraphQLMessage) {
+			conn.closeWith(closeCodeInvalidMessage, "Invalid message")
+			return
+		}
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(conn.pongTimeout))
+
+		switch msg.Type {
+		case "ping":
+			conn.write(graphqlMessage{Type: "pong"})
+		case "pong":
+		case "connection_init":
+			conn.closeWith(closeCodeTooManyInitRequest, "Too many initialisation requests")
+			return
+		case "subscribe":
+			var req graphqlRequest
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil || req.Query == "" {
+				conn.closeWith(closeCodeInvalidMessage, "Invalid message")
+				return
+			}
+			opCtx, ok := conn.start(g.operationContext(ctx), msg.ID)
+			if !ok {
+				conn.closeWith(closeCodeSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+				return
+			}
+			responses, err := g.schema.Subscribe(opCtx, req.Query, req.OperationName, req.Variables)
+			if err != nil {
+				conn.stop(msg.ID)
+				conn.operations.Done()
+				conn.closeWith(closeCodeInvalidMessage, err.Error())
+				return
+			}
+			go g.run(conn, msg.ID, responses)
+		case "complete":
+			conn.stop(msg.ID)
+		default:
+			conn.closeWith(closeCodeInvalidMessage, "Invalid message")
+			return
+		}
+	}
+}
+
+// run sends the responses of an operation. An operation rejected before it
+// ran, e.g. by validation, gets an error message; any other ends with
+// complete, unless the client completed it.
+func (g *graphqlController) run(conn *graphqlConn, id string, responses <-chan interface{}) {
+	defer conn.operations.Done()
+
+	first := true
+	for r := range responses {
+		resp := withErrorExtensions(r.(*graphql.Response), conn.requestID)
+		if first && resp.Data == nil && len(resp.Errors) > 0 {
+			payload, _ := json.Marshal(resp.Errors)
+			if conn.stop(id) {
+				conn.write(graphqlMessage{ID: id, Type: "error", Payload: payload})
+			}
+			return
+		}
+		first = false
+
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			continue
+		}
+		conn.write(graphqlMessage{ID: id, Type: "next", Payload: payload})
+	}
+
+	if conn.stop(id) {
+		conn.write(graphqlMessage{ID: id, Type: "complete"})
+	}
+	// Subscriptions complete when the node drains; the client reconnects
+	// elsewhere
+	if g.hub.isDraining() {
+		conn.closeWith(websocket.CloseGoingAway, "Server is shutting down")
+	}
+}
+
+var errInvalidGraphQLMessage = errors.New("invalid graphql-transport-ws message")
+
+// graphqlConn is a graphql-transport-ws connection. It serializes writes and
+// keeps track of the operations running on it, by ID.
+type graphqlConn struct {
+	*websocket.Conn
+	writeTimeout time.Duration
+	pongTimeout  time.Duration
+	writeMu      sync.Mutex
+	// requestID is the ID of the upgrade request, put in the errors of the
+	// operations run over the connection
+	requestID string
+
+	mu         sync.Mutex
+	active     map[string]context.CancelFunc
+	operations sync.WaitGroup
+}
+
+func newGraphQLConn(conn *websocket.Conn, config WebSocketConfig) *graphqlConn {
+	conn.SetReadLimit(config.MaxFrameSize)
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	})
+	if config.CompressionLevel != 0 {
+		conn.SetCompressionLevel(config.CompressionLevel)
+	}
+	return &graphqlConn{
+		Conn:         conn,
+		writeTimeout: config.WriteTimeout,
+		pongTimeout:  config.PongTimeout,
+		active:       make(map[string]context.CancelFunc),
+	}
+}
+
+// read returns the next message, or errInvalidGraphQLMessage if it is not one
+// of the protocol.
+func (c *graphqlConn) read() (graphqlMessage, error) {
+	var msg graphqlMessage
+	messageType, payload, err := c.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+	if messageType != websocket.TextMessage || json.Unmarshal(payload, &msg) != nil || msg.Type == "" {
+		return msg, errInvalidGraphQLMessage
+	}
+	return msg, nil
+}
+
+func (c *graphqlConn) write(msg graphqlMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return c.WriteJSON(msg)
+}
+
+// closeWith sends a close frame, which ends the client's read loop and so
+// the connection.
+func (c *graphqlConn) closeWith(code int, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.writeTimeout))
+	c.Conn.Close()
+}
+
+// keepAlive pings the client until ctx is done; a client that misses the
+// pong timeout is disconnected by its read deadline.
+func (c *graphqlConn) keepAlive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout)); err != nil {
+				c.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// start registers an operation, unless one with the same ID is running, and
+// returns its context.
+func (c *graphqlConn) start(ctx context.Context, id string) (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.active[id]; ok {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.active[id] = cancel
+	c.operations.Add(1)
+	return ctx, true
+}
+
+// stop cancels an operation and reports whether it was still running.
+func (c *graphqlConn) stop(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancel, ok := c.active[id]
+	if ok {
+		cancel()
+		delete(c.active, id)
+	}
+	return ok
+}
@@ -0,0 +1,373 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	chatv1 "github.com/haileamlak/chat-system/protocol/v1"
+	"github.com/haileamlak/chat-system/usecases"
+
+	uuid "github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// grpcOpenStreams counts the Subscribe streams held by this node, served at
+// /debug/vars.
+var grpcOpenStreams = expvar.NewInt("grpc_streams_open")
+
+// chatService implements the gRPC ChatService on top of the same use cases
+// as the HTTP controllers.
+type chatService struct {
+	chatv1.UnimplementedChatServiceServer
+	userUseCase    usecases.UserUseCase
+	messageUseCase usecases.MessageUseCase
+	hub            clientHub
+}
+
+// NewGRPCServer returns a gRPC server for the ChatService of
+// protocol/v1/chat_service.proto. Calls are authenticated by the auth
+// middleware with the same tokens as the HTTP API, and Subscribe streams are
+// clients of the WebSocket controller's hub, like SSE streams. Every error
+// carries an ErrorInfo with its error code and the call's request ID.
+func NewGRPCServer(userUseCase usecases.UserUseCase, messageUseCase usecases.MessageUseCase, hub WebSocketController, authMiddleware infrastructure.AuthMiddleware) *grpc.Server {
+	public := []string{chatv1.ChatService_SignUp_FullMethodName, chatv1.ChatService_Login_FullMethodName}
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(infrastructure.RequestIDUnaryInterceptor(), authMiddleware.UnaryInterceptor(public...)),
+		grpc.ChainStreamInterceptor(infrastructure.RequestIDStreamInterceptor(), authMiddleware.StreamInterceptor(public...)),
+	)
+	chatv1.RegisterChatServiceServer(server, &chatService{
+		userUseCase:    userUseCase,
+		messageUseCase: messageUseCase,
+		hub:            hub,
+	})
+	// Lets tools such as grpcurl list and call the service
+	reflection.Register(server)
+	return server
+}
+
+func (s *chatService) SignUp(ctx context.Context, req *chatv1.SignUpRequest) (*chatv1.SignUpResponse, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "Username and password are required")
+	}
+	if err := s.userUseCase.Register(ctx, req.Username, req.Password); err != nil {
+		return nil, grpcError(err, "Failed to sign up")
+	}
+	return &chatv1.SignUpResponse{}, nil
+}
+
+func (s *chatService) Login(ctx context.Context, req *chatv1.LoginRequest) (*chatv1.LoginResponse, error) {
+	token, err := s.userUseCase.Login(ctx, req.Username, req.Password)
+	if err != nil {
+		return nil, grpcError(err, "Failed to log in")
+	}
+	return &chatv1.LoginResponse{Token: token}, nil
+}
+
+func (s *chatService) SendDirectMessage(ctx context.Context, req *chatv1.SendDirectMessageRequest) (*chatv1.Ack, error) {
+	if req.To == "" || req.Content == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid message")
+	}
+	from := infrastructure.UserFromContext(ctx)
+	msg := models.DirectMessage{
+		MessageMeta: messageMeta(req.ClientId, req.ParentId, req.AttachmentIds),
+		From:        from,
+		To:          req.To,
+		Content:     req.Content,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := s.messageUseCase.SaveDirectMessage(ctx, from, req.To, &msg); err != nil {
+		return nil, grpcError(err, "Failed to send message")
+	}
+	return &chatv1.Ack{Id: msg.ID, ClientId: msg.ClientID, Timestamp: msg.Timestamp}, nil
+}
+
+func (s *chatService) SendGroupMessage(ctx context.Context, req *chatv1.SendGroupMessageRequest) (*chatv1.Ack, error) {
+	if req.Group == "" || req.Content == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid message")
+	}
+	msg := models.GroupMessage{
+		MessageMeta: messageMeta(req.ClientId, req.ParentId, req.AttachmentIds),
+		From:        infrastructure.UserFromContext(ctx),
+		Group:       req.Group,
+		Content:     req.Content,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := s.messageUseCase.SendGroupMessage(ctx, req.Group, &msg); err != nil {
+		return nil, grpcError(err, "Failed to send group message")
+	}
+	return &chatv1.Ack{Id: msg.ID, ClientId: msg.ClientID, Timestamp: msg.Timestamp}, nil
+}
+
+func (s *chatService) SendBroadcast(ctx context.Context, req *chatv1.SendBroadcastRequest) (*chatv1.Ack, error) {
+	if req.Content == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid message")
+	}
+	msg := models.BroadcastMessage{
+		MessageMeta: models.MessageMeta{ClientID: req.ClientId},
+		From:        infrastructure.UserFromContext(ctx),
+		Content:     req.Content,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := s.messageUseCase.SendBroadcastMessage(ctx, &msg); err != nil {
+		return nil, grpcError(err, "Failed to send broadcast message")
+	}
+	return &chatv1.Ack{Id: msg.ID, ClientId: msg.ClientID, Timestamp: msg.Timestamp}, nil
+}
+
+func (s *chatService) GetDirectHistory(ctx context.Context, req *chatv1.GetDirectHistoryRequest) (*chatv1.History, error) {
+	if req.With == "" {
+		return nil, status.Error(codes.InvalidArgument, "'with' is required")
+	}
+	return s.history(ctx, usecases.DMConversationID(infrastructure.UserFromContext(ctx), req.With), req.Offset, req.Limit)
+}
+
+func (s *chatService) GetGroupHistory(ctx context.Context, req *chatv1.GetGroupHistoryRequest) (*chatv1.History, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group name is required")
+	}
+	return s.history(ctx, usecases.GroupConversationID(req.Group), req.Offset, req.Limit)
+}
+
+func (s *chatService) GetBroadcastHistory(ctx context.Context, req *chatv1.GetBroadcastHistoryRequest) (*chatv1.History, error) {
+	return s.history(ctx, usecases.BroadcastConversationID, req.Offset, req.Limit)
+}
+
+// history reads one page of a conversation from Redis, as the caller sees it.
+func (s *chatService) history(ctx context.Context, conversationID string, offset, limit int64) (*chatv1.History, error) {
+	offset, limit, err := page(offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	msgs, total, err := s.messageUseCase.GetConversationHistory(ctx, infrastructure.UserFromContext(ctx), conversationID, offset, limit)
+	if err != nil {
+		return nil, grpcError(err, "Failed to retrieve messages")
+	}
+
+	history := &chatv1.History{Total: total}
+	for _, msg := range msgs {
+		history.Messages = append(history.Messages, messageToProto(msg))
+	}
+	return history, nil
+}
+
+func (s *chatService) CreateGroup(ctx context.Context, req *chatv1.CreateGroupRequest) (*chatv1.CreateGroupResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid group data")
+	}
+	if err := s.messageUseCase.CreateGroup(ctx, req.Group, infrastructure.UserFromContext(ctx), req.Members); err != nil {
+		return nil, grpcError(err, "Failed to create group")
+	}
+	return &chatv1.CreateGroupResponse{}, nil
+}
+
+func (s *chatService) JoinGroup(ctx context.Context, req *chatv1.JoinGroupRequest) (*chatv1.JoinGroupResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group name is required")
+	}
+	if err := s.messageUseCase.AddMemberToGroup(ctx, req.Group, infrastructure.UserFromContext(ctx)); err != nil {
+		return nil, grpcError(err, "Failed to join group")
+	}
+	return &chatv1.JoinGroupResponse{}, nil
+}
+
+func (s *chatService) SetGroupRole(ctx context.Context, req *chatv1.SetGroupRoleRequest) (*chatv1.SetGroupRoleResponse, error) {
+	if req.Group == "" || req.Member == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group and member are required")
+	}
+	if err := s.messageUseCase.SetGroupRole(ctx, req.Group, infrastructure.UserFromContext(ctx), req.Member, req.Role); err != nil {
+		return nil, grpcError(err, "Failed to set role")
+	}
+	return &chatv1.SetGroupRoleResponse{}, nil
+}
+
+// Subscribe streams the caller's events until the client cancels the call or
+// the node shuts down. A subscriber counts as connected for presence, like
+// the other clients.
+func (s *chatService) Subscribe(req *chatv1.SubscribeRequest, stream chatv1.ChatService_SubscribeServer) error {
+	username := infrastructure.UserFromContext(stream.Context())
+
+	if req.Cursor != nil && req.GetCursor() < 0 {
+		return status.Error(codes.InvalidArgument, "cursor must not be negative")
+	}
+	device := req.Device
+	if device == "" {
+		device = uuid.New().String()
+	}
+
+	sub := newGRPCStream(stream)
+	sub.username, sub.device = username, device
+	sub.capabilities = agreeCapabilities(req.Capabilities)
+	if !s.hub.connectClient(sub) {
+		return status.Error(codes.Unavailable, "Server is shutting down")
+	}
+	grpcOpenStreams.Add(1)
+	log.Println(username, "subscribed via gRPC from device", device)
+
+	sub.resume(s.hub.sendInitialEvents(sub.send, username, req.Cursor != nil, req.GetCursor()))
+	reason := sub.pump(stream.Context())
+
+	s.hub.removeClient(sub)
+	grpcOpenStreams.Add(-1)
+	log.Println(username, "gRPC stream closed:", reason)
+	if reason == closeReasonSlowConsumer {
+		return status.Error(codes.ResourceExhausted, "Events piled up faster than they were read; subscribe again with your cursor")
+	}
+	return nil
+}
+
+// grpcStream delivers a user's events on a Subscribe call, as the frames of
+// the chat.v1.protobuf protocol. All sends happen on the call's goroutine, in
+// pump.
+type grpcStream struct {
+	clientInfo
+	*eventQueue
+	stream       chatv1.ChatService_SubscribeServer
+	capabilities map[string]bool
+
+	leaving     chan time.Duration // receives the reconnect delay on shutdown
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closeReason string
+}
+
+func newGRPCStream(stream chatv1.ChatService_SubscribeServer) *grpcStream {
+	s := &grpcStream{
+		stream:  stream,
+		leaving: make(chan time.Duration, 1),
+		closed:  make(chan struct{}),
+	}
+	s.eventQueue = newEventQueue(func() { s.shutdown(closeReasonSlowConsumer) })
+	return s
+}
+
+// send sends one event, unless it is of a capability the subscriber did not
+// ask for.
+func (s *grpcStream) send(msg models.WSMessage) error {
+	if !wantsEvent(msg.Type, s.capabilities) {
+		return nil
+	}
+	frame, err := frameToProto(eventFrame(msg))
+	if err != nil {
+		return nil // an event the protocol cannot carry is skipped
+	}
+	if err := s.stream.Send(frame); err != nil {
+		s.shutdown(closeReasonWriteFailed)
+		return err
+	}
+	return nil
+}
+
+// pump sends queued events until the stream is closed and returns the reason
+// it was closed for. HTTP/2 keeps the connection alive, so no pings are
+// sent.
+func (s *grpcStream) pump(ctx context.Context) string {
+	for {
+		select {
+		case <-ctx.Done():
+			return s.shutdown(closeReasonClient)
+		case <-s.closed:
+			return s.shutdown(closeReasonLost)
+		case reconnectAfter := <-s.leaving:
+			data, _ := json.Marshal(models.GoingAwayEvent{ReconnectAfter: reconnectAfter.Milliseconds()})
+			s.send(models.WSMessage{Type: "going_away", Data: data})
+			return s.shutdown(closeReasonShutdown)
+		case ev := <-s.queue:
+			if s.goingAway.Load() {
+				continue
+			}
+			if err := s.send(ev.msg); err != nil {
+				return s.shutdown(closeReasonWriteFailed)
+			}
+		}
+	}
+}
+
+// goAway tells the subscriber when to resubscribe and ends the stream. Events
+// still queued are dropped, as the subscriber replays them with its cursor.
+func (s *grpcStream) goAway(reconnectAfter time.Duration) {
+	s.stopDelivery()
+	select {
+	case s.leaving <- reconnectAfter:
+	default:
+	}
+}
+
+// shutdown ends the stream once and returns the reason it was closed for,
+// which is the reason given by the first caller.
+func (s *grpcStream) shutdown(reason string) string {
+	s.closeOnce.Do(func() {
+		if s.goingAway.Load() {
+			reason = closeReasonShutdown
+		}
+		s.closeReason = reason
+		close(s.closed)
+	})
+	return s.closeReason
+}
+
+// messageMeta is the metadata a sender may set on a new message. Attachments
+// are referenced by ID.
+func messageMeta(clientID, parentID string, attachmentIDs []string) models.MessageMeta {
+	meta := models.MessageMeta{ClientID: clientID, ParentID: parentID}
+	for _, id := range attachmentIDs {
+		meta.Attachments = append(meta.Attachments, models.Attachment{ID: id})
+	}
+	return meta
+}
+
+// page checks an offset and limit, applying the default and maximum page size
+// of the HTTP API.
+func page(offset, limit int64) (int64, int64, error) {
+	if offset < 0 || limit < 0 {
+		return 0, 0, status.Error(codes.InvalidArgument, "offset and limit must not be negative")
+	}
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return offset, limit, nil
+}
+
+// grpcError turns a use case error into the gRPC status matching its HTTP
+// status, with its error code as the reason of an ErrorInfo.
+func grpcError(err error, fallback string) error {
+	code := codes.Internal
+	switch errorStatus(err) {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+		if errors.Is(err, usecases.ErrUsernameTaken) || errors.Is(err, usecases.ErrGroupExists) {
+			code = codes.AlreadyExists
+		}
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	default:
+		log.Println(fallback+":", err)
+	}
+	st, detailErr := status.New(code, errorText(err, fallback)).WithDetails(&errdetails.ErrorInfo{Reason: errorCode(err), Domain: infrastructure.ErrorDomain})
+	if detailErr != nil {
+		return status.Error(code, errorText(err, fallback))
+	}
+	return st.Err()
+}
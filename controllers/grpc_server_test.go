@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	chatv1 "github.com/haileamlak/chat-system/protocol/v1"
+)
+
+// grpcClient serves the node's gRPC API on an in-memory listener and returns
+// a client of it.
+func (n *testNode) grpcClient(t *testing.T) chatv1.ChatServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(n.users, n.messages, n.hub, n.auth)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return chatv1.NewChatServiceClient(conn)
+}
+
+// asUser returns a context authenticated with the token.
+func asUser(t *testing.T, token string) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+// expectCode fails unless err has the gRPC code, and an ErrorInfo with an
+// error code and the call's request ID.
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("expected %s, got %v", code, err)
+	}
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason != "" && info.Metadata["request_id"] != "" {
+			return
+		}
+	}
+	t.Errorf("expected %v to carry an ErrorInfo with a request ID", err)
+}
+
+// subscription is a Subscribe stream whose frames are read in the
+// background.
+type subscription struct {
+	t      *testing.T
+	frames chan *chatv1.Frame
+	cancel context.CancelFunc
+}
+
+func subscribe(t *testing.T, client chatv1.ChatServiceClient, token string, req *chatv1.SubscribeRequest) *subscription {
+	t.Helper()
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token))
+	t.Cleanup(cancel)
+	stream, err := client.Subscribe(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &subscription{t: t, frames: make(chan *chatv1.Frame, 64), cancel: cancel}
+	go func() {
+		defer close(sub.frames)
+		for {
+			frame, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			sub.frames <- frame
+		}
+	}()
+	if frame := sub.next(); frame.GetUnread() == nil {
+		t.Fatalf("expected the unread counts first, got %v", frame)
+	}
+	return sub
+}
+
+func (s *subscription) next() *chatv1.Frame {
+	s.t.Helper()
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			s.t.Fatal("stream ended")
+		}
+		return frame
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no frame within 5s")
+		return nil
+	}
+}
+
+// nextMessage skips to the next message_new frame.
+func (s *subscription) nextMessage() *chatv1.Frame {
+	s.t.Helper()
+	for {
+		if frame := s.next(); frame.GetMessageNew() != nil {
+			return frame
+		}
+	}
+}
+
+func TestGRPCCallsNeedValidToken(t *testing.T) {
+	client := newTestNode(t, miniredis.RunT(t), "node-a").grpcClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.GetBroadcastHistory(ctx, &chatv1.GetBroadcastHistoryRequest{})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = client.GetBroadcastHistory(asUser(t, "not-a-token"), &chatv1.GetBroadcastHistoryRequest{})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestGRPCSignUpAndLogin(t *testing.T) {
+	client := newTestNode(t, miniredis.RunT(t), "node-a").grpcClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.SignUp(ctx, &chatv1.SignUpRequest{Username: "alice", Password: "password"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.SignUp(ctx, &chatv1.SignUpRequest{Username: "alice", Password: "other"})
+	expectCode(t, err, codes.AlreadyExists)
+
+	resp, err := client.Login(ctx, &chatv1.LoginRequest{Username: "alice", Password: "password"})
+	if err != nil || resp.Token == "" {
+		t.Fatalf("log in: %v, %v", resp, err)
+	}
+	if _, err := client.GetBroadcastHistory(asUser(t, resp.Token), &chatv1.GetBroadcastHistoryRequest{}); err != nil {
+		t.Errorf("call with the token: %v", err)
+	}
+}
+
+func TestGRPCMessagesAreAckedAndStreamed(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	client := node.grpcClient(t)
+	sub := subscribe(t, client, node.login(t, "bob"), &chatv1.SubscribeRequest{Device: "server"})
+
+	ack, err := client.SendDirectMessage(asUser(t, node.login(t, "alice")), &chatv1.SendDirectMessageRequest{To: "bob", Content: "hello over gRPC", ClientId: "g1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Id == "" || ack.ClientId != "g1" || ack.Timestamp == "" {
+		t.Errorf("unexpected ack %v", ack)
+	}
+
+	frame := sub.nextMessage()
+	msg := frame.GetMessageNew()
+	if msg.Kind != "dm" || msg.Message.GetId() != ack.Id || msg.Message.GetFrom() != "alice" || frame.Seq == 0 {
+		t.Errorf("unexpected message_new %v", frame)
+	}
+}
+
+func TestGRPCHistoriesArePaged(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	client := node.grpcClient(t)
+	node.login(t, "bob")
+	ctx := asUser(t, node.login(t, "alice"))
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ack, err := client.SendDirectMessage(ctx, &chatv1.SendDirectMessageRequest{To: "bob", Content: fmt.Sprintf("page %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ack.Id)
+	}
+
+	tests := []struct {
+		name    string
+		req     *chatv1.GetDirectHistoryRequest
+		wantIDs []string
+	}{
+		{"default page", &chatv1.GetDirectHistoryRequest{With: "bob"}, ids},
+		{"middle page", &chatv1.GetDirectHistoryRequest{With: "bob", Offset: 1, Limit: 2}, ids[1:3]},
+		{"last page", &chatv1.GetDirectHistoryRequest{With: "bob", Offset: 3, Limit: 10}, ids[3:]},
+		{"past the end", &chatv1.GetDirectHistoryRequest{With: "bob", Offset: 10}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history, err := client.GetDirectHistory(ctx, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, msg := range history.Messages {
+				got = append(got, msg.Id)
+			}
+			if history.Total != int64(len(ids)) || fmt.Sprint(got) != fmt.Sprint(tt.wantIDs) {
+				t.Errorf("got %v of %d, want %v of %d", got, history.Total, tt.wantIDs, len(ids))
+			}
+		})
+	}
+
+	_, err := client.GetDirectHistory(ctx, &chatv1.GetDirectHistoryRequest{With: "bob", Limit: -1})
+	expectCode(t, err, codes.InvalidArgument)
+
+	if _, err := client.SendBroadcast(ctx, &chatv1.SendBroadcastRequest{Content: "to everyone"}); err != nil {
+		t.Fatal(err)
+	}
+	broadcasts, err := client.GetBroadcastHistory(asUser(t, node.login(t, "carol")), &chatv1.GetBroadcastHistoryRequest{Limit: 1})
+	if err != nil || broadcasts.Total != 1 || broadcasts.Messages[0].Content != "to everyone" {
+		t.Errorf("broadcast history = %v, %v", broadcasts, err)
+	}
+}
+
+func TestGRPCGroupsAreCreatedJoinedAndAdministered(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	client := node.grpcClient(t)
+	aliceCtx := asUser(t, node.login(t, "alice"))
+	bobCtx := asUser(t, node.login(t, "bob"))
+
+	if _, err := client.CreateGroup(aliceCtx, &chatv1.CreateGroupRequest{Group: "team"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.CreateGroup(bobCtx, &chatv1.CreateGroupRequest{Group: "team"})
+	expectCode(t, err, codes.AlreadyExists)
+	_, err = client.GetGroupHistory(bobCtx, &chatv1.GetGroupHistoryRequest{Group: "team"})
+	expectCode(t, err, codes.PermissionDenied)
+
+	if _, err := client.JoinGroup(bobCtx, &chatv1.JoinGroupRequest{Group: "team"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SendGroupMessage(bobCtx, &chatv1.SendGroupMessageRequest{Group: "team", Content: "hi group"}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := client.GetGroupHistory(aliceCtx, &chatv1.GetGroupHistoryRequest{Group: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Total != 1 || history.Messages[0].From != "bob" || history.Messages[0].Group != "team" {
+		t.Errorf("unexpected group history %v", history)
+	}
+
+	_, err = client.SetGroupRole(bobCtx, &chatv1.SetGroupRoleRequest{Group: "team", Member: "alice", Role: "member"})
+	expectCode(t, err, codes.PermissionDenied)
+	if _, err := client.SetGroupRole(aliceCtx, &chatv1.SetGroupRoleRequest{Group: "team", Member: "bob", Role: "moderator"}); err != nil {
+		t.Error(err)
+	}
+
+	_, err = client.GetGroupHistory(aliceCtx, &chatv1.GetGroupHistoryRequest{Group: "missing"})
+	expectCode(t, err, codes.NotFound)
+	_, err = client.JoinGroup(aliceCtx, &chatv1.JoinGroupRequest{Group: "missing"})
+	expectCode(t, err, codes.NotFound)
+}
+
+func TestGRPCCursorReplaysMissedEvents(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	client := node.grpcClient(t)
+	bobToken := node.login(t, "bob")
+	ctx := asUser(t, node.login(t, "alice"))
+
+	sub := subscribe(t, client, bobToken, &chatv1.SubscribeRequest{})
+	if _, err := client.SendDirectMessage(ctx, &chatv1.SendDirectMessageRequest{To: "bob", Content: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	cursor := sub.nextMessage().Seq
+	sub.cancel()
+
+	missed, err := client.SendDirectMessage(ctx, &chatv1.SendDirectMessageRequest{To: "bob", Content: "missed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := subscribe(t, client, bobToken, &chatv1.SubscribeRequest{Cursor: &cursor}).nextMessage()
+	if frame.GetMessageNew().GetMessage().GetId() != missed.Id || frame.Seq <= cursor {
+		t.Errorf("replayed %v after cursor %d, want message %s", frame, cursor, missed.Id)
+	}
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"github.com/haileamlak/chat-system/infrastructure"
 	"github.com/haileamlak/chat-system/models"
 	"github.com/haileamlak/chat-system/usecases"
 	"net/http"
@@ -18,6 +19,13 @@ type MessageController interface {
 	GetGroupHistory(c *gin.Context)
 	SendBroadcast(c *gin.Context)
 	GetBroadcastHistory(c *gin.Context)
+	EditMessage(c *gin.Context)
+	GetMessageRevisions(c *gin.Context)
+	DeleteMessage(c *gin.Context)
+	SetGroupRole(c *gin.Context)
+	GetThread(c *gin.Context)
+	AddReaction(c *gin.Context)
+	RemoveReaction(c *gin.Context)
 }
 
 type messageController struct{
@@ -34,22 +42,22 @@ func NewMessageController(messageUseCase usecases.MessageUseCase) MessageControl
 func (m *messageController) SendDM(c *gin.Context) {
 	var msg models.DirectMessage
 	if err := c.ShouldBindJSON(&msg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid message")
 		return
 	}
 
 	if msg.From != c.GetString("user") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot send messages as another user"})
+		infrastructure.AbortWithProblem(c, http.StatusForbidden, "You cannot send messages as another user")
 		return
 	}
 
 	msg.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	err := m.messageUseCase.SaveDirectMessage(c.Request.Context(), msg.From, msg.To, &msg)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		respondError(c, err, "Failed to send message")
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Message sent"})
+	c.JSON(http.StatusOK, gin.H{"message": "Message sent", "id": msg.ID, "timestamp": msg.Timestamp})
 }
 
 func (m *messageController) GetDMHistory(c *gin.Context) {
@@ -57,17 +65,17 @@ func (m *messageController) GetDMHistory(c *gin.Context) {
 	fromUser := c.Query("from")
 
 	if otherUser == "" || fromUser == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Both 'user' and 'from' parameters are required"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Both 'user' and 'from' parameters are required")
 		return
 	}
 	if fromUser != c.GetString("user") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot access messages as another user"})
+		infrastructure.AbortWithProblem(c, http.StatusForbidden, "You cannot access messages as another user")
 		return
 	}
 
 	messages, err := m.messageUseCase.GetDMHistory(c.Request.Context(), fromUser, otherUser)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+		respondError(c, err, "Failed to retrieve messages")
 		return
 	}
 
@@ -77,18 +85,18 @@ func (m *messageController) GetDMHistory(c *gin.Context) {
 func (m *messageController) CreateGroup(c *gin.Context) {
 	type Req struct {
 		GroupName string `json:"group" binding:"required"`
-		Creator   string `json:"creator" binding:"required"`
 	}
 
 	var req Req
 	if err := c.ShouldBindJSON(&req); err != nil || req.GroupName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group data"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid group data")
 		return
 	}
 
-	err := m.messageUseCase.CreateGroup(c.Request.Context(), req.GroupName, []string{req.Creator})
+	// The caller creates the group, and becomes its admin
+	err := m.messageUseCase.CreateGroup(c.Request.Context(), req.GroupName, c.GetString("user"), nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		respondError(c, err, "Failed to create group")
 		return
 	}
 
@@ -103,18 +111,18 @@ func (m *messageController) JoinGroup(c *gin.Context) {
 
 	var req Req
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid data")
 		return
 	}
 
 	if req.GroupName == "" || req.User == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Group name and user are required"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Group name and user are required")
 		return	
 	}
 
 	err := m.messageUseCase.AddMemberToGroup(c.Request.Context(), req.GroupName, req.User)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join group"})
+		respondError(c, err, "Failed to join group")
 		return
 	}
 
@@ -124,40 +132,35 @@ func (m *messageController) JoinGroup(c *gin.Context) {
 func (m *messageController) SendGroupMessage(c *gin.Context) {
 	var msg models.GroupMessage
 	if err := c.ShouldBindJSON(&msg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid message")
 		return
 	}
 
 	if msg.From != c.GetString("user") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot send messages as another user"})
+		infrastructure.AbortWithProblem(c, http.StatusForbidden, "You cannot send messages as another user")
 		return		
 	}
 
 	msg.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	err := m.messageUseCase.SendGroupMessage(c.Request.Context(), msg.Group, &msg)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send group message"})
+		respondError(c, err, "Failed to send group message")
 		return
 	}
 	
-	c.JSON(http.StatusOK, gin.H{"message": "Message sent"})
+	c.JSON(http.StatusOK, gin.H{"message": "Message sent", "id": msg.ID, "timestamp": msg.Timestamp})
 }
 
 func (m *messageController) GetGroupHistory(c *gin.Context) {
 	group := c.Param("name")
 	if group == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Group name is required"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Group name is required")
 		return
 	}
 
-	if exists, err := m.messageUseCase.GroupExists(c.Request.Context(), group); err != nil || !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
-
-	msgs, err := m.messageUseCase.GetGroupHistory(c.Request.Context(), group)
+	msgs, err := m.messageUseCase.GetGroupHistory(c.Request.Context(), group, c.GetString("user"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve group messages"})
+		respondError(c, err, "Failed to retrieve group messages")
 		return
 	}
 
@@ -167,7 +170,7 @@ func (m *messageController) GetGroupHistory(c *gin.Context) {
 func (m *messageController) SendBroadcast(c *gin.Context) {
 	var msg models.BroadcastMessage
 	if err := c.ShouldBindJSON(&msg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid message")
 		return
 	}
 
@@ -175,19 +178,133 @@ func (m *messageController) SendBroadcast(c *gin.Context) {
 	
 	err := m.messageUseCase.SendBroadcastMessage(c.Request.Context(), &msg)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast message"})
+		respondError(c, err, "Failed to send broadcast message")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Broadcast sent"})
+	c.JSON(http.StatusOK, gin.H{"message": "Broadcast sent", "id": msg.ID, "timestamp": msg.Timestamp})
 }
 
 func (m *messageController) GetBroadcastHistory(c *gin.Context) {
-	msgs, err := m.messageUseCase.GetBroadcastHistory(c.Request.Context())
+	msgs, err := m.messageUseCase.GetBroadcastHistory(c.Request.Context(), c.GetString("user"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve broadcast messages"})
+		respondError(c, err, "Failed to retrieve broadcast messages")
 		return
 	}
 
 	c.JSON(http.StatusOK, msgs)
 }
+
+func (m *messageController) EditMessage(c *gin.Context) {
+	type Req struct {
+		Content string `json:"content" binding:"required"`
+	}
+
+	var req Req
+	if err := c.ShouldBindJSON(&req); err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid message")
+		return
+	}
+
+	msg, err := m.messageUseCase.EditMessage(c.Request.Context(), c.Param("id"), c.GetString("user"), req.Content)
+	if err != nil {
+		respondError(c, err, "Failed to edit message")
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+func (m *messageController) GetMessageRevisions(c *gin.Context) {
+	revisions, err := m.messageUseCase.GetMessageRevisions(c.Request.Context(), c.Param("id"), c.GetString("user"))
+	if err != nil {
+		respondError(c, err, "Failed to retrieve message revisions")
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+func (m *messageController) DeleteMessage(c *gin.Context) {
+	scope := c.DefaultQuery("scope", "me")
+	if scope != "me" && scope != "everyone" {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "scope must be 'me' or 'everyone'")
+		return
+	}
+
+	err := m.messageUseCase.DeleteMessage(c.Request.Context(), c.Param("id"), c.GetString("user"), scope == "everyone")
+	if err != nil {
+		respondError(c, err, "Failed to delete message")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted"})
+}
+
+func (m *messageController) SetGroupRole(c *gin.Context) {
+	type Req struct {
+		GroupName string `json:"group" binding:"required"`
+		User      string `json:"user" binding:"required"`
+		Role      string `json:"role" binding:"required"`
+	}
+
+	var req Req
+	if err := c.ShouldBindJSON(&req); err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid data")
+		return
+	}
+
+	err := m.messageUseCase.SetGroupRole(c.Request.Context(), req.GroupName, c.GetString("user"), req.User, req.Role)
+	if err != nil {
+		respondError(c, err, "Failed to update group role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group role updated"})
+}
+
+func (m *messageController) GetThread(c *gin.Context) {
+	offset, limit, ok := parsePagination(c)
+	if !ok {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid pagination parameters")
+		return
+	}
+
+	thread, err := m.messageUseCase.GetThread(c.Request.Context(), c.Param("id"), c.GetString("user"), offset, limit)
+	if err != nil {
+		respondError(c, err, "Failed to retrieve thread")
+		return
+	}
+
+	c.JSON(http.StatusOK, thread)
+}
+
+func (m *messageController) AddReaction(c *gin.Context) {
+	type Req struct {
+		Emoji string `json:"emoji" binding:"required"`
+	}
+
+	var req Req
+	if err := c.ShouldBindJSON(&req); err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid reaction")
+		return
+	}
+
+	err := m.messageUseCase.AddReaction(c.Request.Context(), c.Param("id"), c.GetString("user"), req.Emoji)
+	if err != nil {
+		respondError(c, err, "Failed to add reaction")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction added"})
+}
+
+func (m *messageController) RemoveReaction(c *gin.Context) {
+	err := m.messageUseCase.RemoveReaction(c.Request.Context(), c.Param("id"), c.GetString("user"), c.Param("emoji"))
+	if err != nil {
+		respondError(c, err, "Failed to remove reaction")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction removed"})
+}
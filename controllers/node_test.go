@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/repositories"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+// testNode is one chat node wired as in main.go, over a Redis shared with
+// any other node of the same test. It serves the routes the tests use.
+type testNode struct {
+	server   *httptest.Server
+	users    usecases.UserUseCase
+	messages usecases.MessageUseCase
+	hub      WebSocketController
+	auth     infrastructure.AuthMiddleware
+}
+
+func newTestNode(t *testing.T, mr *miniredis.Miniredis, nodeID string) *testNode {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	redisService := infrastructure.NewRedisService(mr.Addr())
+	tokenService := infrastructure.NewTokenService(redisService)
+	presenceConfig := usecases.PresenceConfig{SessionTTL: time.Minute}
+	registry := infrastructure.NewConnectionRegistry(redisService, nodeID, presenceConfig.SessionTTL)
+	pubSubService := infrastructure.NewPubSubService(redisService, registry)
+	subscriberService := infrastructure.NewSubscriberService(redisService, "channel:broadcast", infrastructure.NodeChannel(nodeID))
+	authMiddleware := infrastructure.NewAuthMiddleware(tokenService)
+
+	messageRepo := repositories.NewMessageRepository(redisService)
+	searchRepo := repositories.NewSearchRepository(redisService)
+	attachmentRepo := repositories.NewAttachmentRepository(redisService)
+	conversationRepo := repositories.NewConversationRepository(redisService)
+	eventRepo := repositories.NewEventRepository(redisService)
+	blobStore, err := infrastructure.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userUseCase := usecases.NewUserUseCase(repositories.NewUserRepository(redisService), infrastructure.NewPasswordService(), tokenService)
+	messageUseCase := usecases.NewMessageUseCase(messageRepo, searchRepo, attachmentRepo, blobStore, conversationRepo, eventRepo, pubSubService, usecases.MessageConfig{
+		EditWindow:              15 * time.Minute,
+		MaxReactions:            20,
+		ReadReceiptMaxGroupSize: 20,
+		DedupeWindow:            24 * time.Hour,
+		EventLogSize:            1000,
+	})
+	presenceUseCase := usecases.NewPresenceUseCase(repositories.NewPresenceRepository(redisService), conversationRepo, messageRepo, pubSubService, presenceConfig)
+	eventUseCase := usecases.NewEventUseCase(eventRepo, usecases.EventConfig{ReplayLimit: 500})
+	typingConfig := usecases.TypingConfig{TTL: 6 * time.Second, Interval: 2 * time.Second}
+	typingUseCase := usecases.NewTypingUseCase(messageRepo, repositories.NewTypingRepository(redisService), pubSubService, typingConfig)
+
+	hub := NewWebSocketController(messageUseCase, presenceUseCase, typingUseCase, eventUseCase, subscriberService, registry, authMiddleware, WebSocketConfig{
+		HeartbeatInterval: presenceConfig.SessionTTL / 3,
+		TypingTTL:         typingConfig.TTL,
+		PingInterval:      30 * time.Second,
+		PongTimeout:       time.Minute,
+		WriteTimeout:      10 * time.Second,
+		MaxFrameSize:      64 << 10,
+		ReconnectWindow:   0,
+	})
+	userController := NewUserController(userUseCase)
+	messageController := NewMessageController(messageUseCase)
+	conversationController := NewConversationController(messageUseCase, typingUseCase)
+	graphqlController := NewGraphQLController(userUseCase, messageUseCase, presenceUseCase, hub, authMiddleware)
+
+	router := gin.New()
+	router.Use(infrastructure.RequestID())
+	router.POST("/signup", userController.SignUp)
+	router.POST("/login", userController.Login)
+	auth := router.Group("/")
+	auth.Use(authMiddleware.Authenticate())
+	auth.POST("/dm/send", messageController.SendDM)
+	auth.POST("/group/create", messageController.CreateGroup)
+	auth.POST("/group/join", messageController.JoinGroup)
+	auth.POST("/group/send", messageController.SendGroupMessage)
+	auth.POST("/conversations/:id/typing", conversationController.SetTyping)
+	auth.POST("/graphql", graphqlController.Query)
+	router.GET("/ws", hub.WebSocketHandler)
+	router.GET("/graphql", graphqlController.Subscribe)
+
+	node := &testNode{
+		server:   httptest.NewServer(router),
+		users:    userUseCase,
+		messages: messageUseCase,
+		hub:      hub,
+		auth:     authMiddleware,
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+		node.server.Close()
+		redisService.Close()
+	})
+	return node
+}
+
+// login registers the user if needed and returns a session token.
+func (n *testNode) login(t *testing.T, username string) string {
+	t.Helper()
+	if err := n.users.Register(context.Background(), username, "password"); err != nil && err != usecases.ErrUsernameTaken {
+		t.Fatalf("register %s: %v", username, err)
+	}
+	token, err := n.users.Login(context.Background(), username, "password")
+	if err != nil {
+		t.Fatalf("log in %s: %v", username, err)
+	}
+	return token
+}
+
+// post sends a JSON request as the token's user and returns the status and
+// body of the response.
+func (n *testNode) post(t *testing.T, path, token string, body interface{}) (int, []byte) {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, n.server.URL+path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+// dial opens a WebSocket as the token's user, speaking the given
+// subprotocols, if any.
+func (n *testNode) dial(t *testing.T, token string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	conn, _ := n.upgrade(t, token, subprotocols...)
+	return conn
+}
+
+// upgrade is dial, also returning the response to the upgrade request.
+func (n *testNode) upgrade(t *testing.T, token string, subprotocols ...string) (*websocket.Conn, *http.Response) {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols, HandshakeTimeout: time.Second}
+	url := "ws" + strings.TrimPrefix(n.server.URL, "http") + "/ws"
+	conn, resp, err := dialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn, resp
+}
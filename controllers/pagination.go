@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+// parsePagination reads the offset and limit query parameters, applying the
+// default and maximum page size. It reports false if either is malformed.
+func parsePagination(c *gin.Context) (int64, int64, bool) {
+	offset, err := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, false
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)), 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, 0, false
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	return offset, limit, true
+}
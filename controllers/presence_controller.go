@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+const maxPresenceUsers = 100
+
+type PresenceController interface {
+	GetPresence(c *gin.Context)
+	SetPresence(c *gin.Context)
+}
+
+type presenceController struct {
+	presenceUseCase usecases.PresenceUseCase
+}
+
+func NewPresenceController(presenceUseCase usecases.PresenceUseCase) PresenceController {
+	return &presenceController{
+		presenceUseCase: presenceUseCase,
+	}
+}
+
+func (p *presenceController) GetPresence(c *gin.Context) {
+	var users []string
+	for _, user := range strings.Split(c.Query("users"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+
+	if len(users) == 0 || len(users) > maxPresenceUsers {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "'users' must list between 1 and 100 comma-separated usernames")
+		return
+	}
+
+	presence, err := p.presenceUseCase.GetPresence(c.Request.Context(), users)
+	if err != nil {
+		respondError(c, err, "Failed to retrieve presence")
+		return
+	}
+
+	c.JSON(http.StatusOK, presence)
+}
+
+// SetPresence switches the caller between online and away, for clients that
+// are not on the WebSocket.
+func (p *presenceController) SetPresence(c *gin.Context) {
+	type Req struct {
+		State string `json:"state" binding:"required"`
+	}
+
+	var req Req
+	if err := c.ShouldBindJSON(&req); err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid data")
+		return
+	}
+
+	if err := p.presenceUseCase.SetState(c.Request.Context(), c.GetString("user"), req.State); err != nil {
+		respondError(c, err, "Failed to update presence")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Presence updated"})
+}
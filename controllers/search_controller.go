@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+type SearchController interface {
+	Search(c *gin.Context)
+}
+
+type searchController struct {
+	searchUseCase usecases.SearchUseCase
+}
+
+func NewSearchController(searchUseCase usecases.SearchUseCase) SearchController {
+	return &searchController{
+		searchUseCase: searchUseCase,
+	}
+}
+
+func (s *searchController) Search(c *gin.Context) {
+	offset, limit, ok := parsePagination(c)
+	if !ok {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid pagination parameters")
+		return
+	}
+
+	query := models.SearchQuery{
+		Text:         c.Query("q"),
+		Conversation: c.Query("conversation"),
+		From:         c.Query("from"),
+		Offset:       offset,
+		Limit:        limit,
+	}
+
+	var err error
+	if after := c.Query("after"); after != "" {
+		if query.After, err = time.Parse(time.RFC3339, after); err != nil {
+			infrastructure.AbortWithProblem(c, http.StatusBadRequest, "'after' must be an RFC3339 timestamp")
+			return
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		if query.Before, err = time.Parse(time.RFC3339, before); err != nil {
+			infrastructure.AbortWithProblem(c, http.StatusBadRequest, "'before' must be an RFC3339 timestamp")
+			return
+		}
+	}
+
+	results, err := s.searchUseCase.Search(c.Request.Context(), c.GetString("user"), &query)
+	if err != nil {
+		respondError(c, err, "Failed to search messages")
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/google/uuid"
+)
+
+// sseOpenStreams counts the SSE streams held by this node, served at
+// /debug/vars.
+var sseOpenStreams = expvar.NewInt("sse_streams_open")
+
+// sseStream delivers a user's events as Server-Sent Events. Every event is one
+// `data:` line holding the same JSON as the WebSocket frame, and events with a
+// seq carry it as their `id`, so a reconnecting EventSource resumes through
+// Last-Event-ID. All writes happen on the request goroutine, in pump.
+type sseStream struct {
+	clientInfo
+	*eventQueue
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+
+	leaving     chan time.Duration // receives the reconnect delay on shutdown
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closeReason string
+}
+
+func newSSEStream(w http.ResponseWriter, config WebSocketConfig) *sseStream {
+	s := &sseStream{
+		w:            w,
+		rc:           http.NewResponseController(w),
+		writeTimeout: config.WriteTimeout,
+		leaving:      make(chan time.Duration, 1),
+		closed:       make(chan struct{}),
+	}
+	s.eventQueue = newEventQueue(func() { s.shutdown(closeReasonSlowConsumer) })
+	return s
+}
+
+// EventStreamHandler serves GET /events, the stream of the caller's events
+// for clients that cannot open a WebSocket. They send through the REST
+// endpoints instead.
+func (wsc *webSocketController) EventStreamHandler(c *gin.Context) {
+	username := c.GetString("user")
+
+	if wsc.isDraining() {
+		c.Header("Retry-After", "1")
+		infrastructure.AbortWithProblem(c, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+
+	// EventSource sends Last-Event-ID when it reconnects; a client opening
+	// the stream for the first time may pass its cursor instead
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("cursor")
+	}
+	cursor, resuming, err := parseCursor(lastEventID)
+	if err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid Last-Event-ID")
+		return
+	}
+
+	device := c.Query("device")
+	if device == "" {
+		device = uuid.New().String()
+	}
+
+	stream := newSSEStream(c.Writer, wsc.config)
+	stream.username, stream.device = username, device
+	stream.session, err = wsc.presenceUseCase.Connect(context.Background(), username)
+	if err != nil {
+		log.Println("Failed to record presence of", username, ":", err)
+	}
+
+	if !wsc.addClient(stream) {
+		wsc.disconnectPresence(stream)
+		c.Header("Retry-After", "1")
+		infrastructure.AbortWithProblem(c, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+	sseOpenStreams.Add(1)
+	log.Println(username, "connected via SSE from device", device)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	c.Status(http.StatusOK)
+
+	stream.resume(wsc.sendInitialEvents(stream.write, username, resuming, cursor))
+	reason := stream.pump(c.Request.Context(), wsc.config.PingInterval)
+
+	wsc.removeClient(stream)
+	sseOpenStreams.Add(-1)
+	log.Println(username, "SSE stream closed:", reason)
+}
+
+// write sends one event within the write timeout.
+func (s *sseStream) write(msg models.WSMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.writeData(msg.Seq, data)
+}
+
+// writeData sends an event already encoded as JSON.
+func (s *sseStream) writeData(seq int64, data []byte) error {
+	s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	if seq != 0 {
+		fmt.Fprintf(s.w, "id: %d\n", seq)
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	if err := s.rc.Flush(); err != nil {
+		s.shutdown(closeReasonWriteFailed)
+		return err
+	}
+	return nil
+}
+
+// pump writes queued events, and a comment every interval so that proxies
+// keep the stream open, until the stream is closed. It returns the reason the
+// stream was closed for.
+func (s *sseStream) pump(ctx context.Context, keepAliveInterval time.Duration) string {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return s.shutdown(closeReasonClient)
+		case <-s.closed:
+			return s.shutdown(closeReasonLost)
+		case reconnectAfter := <-s.leaving:
+			// retry makes EventSource wait this long before reconnecting
+			data, _ := json.Marshal(models.GoingAwayEvent{ReconnectAfter: reconnectAfter.Milliseconds()})
+			fmt.Fprintf(s.w, "retry: %d\n", reconnectAfter.Milliseconds())
+			s.write(models.WSMessage{Type: "going_away", Data: data})
+			return s.shutdown(closeReasonShutdown)
+		case ev := <-s.queue:
+			if s.goingAway.Load() {
+				continue
+			}
+			if err := s.writeData(ev.msg.Seq, ev.encoded(formatLegacy)); err != nil {
+				return s.shutdown(closeReasonWriteFailed)
+			}
+		case <-ticker.C:
+			s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+			fmt.Fprint(s.w, ": ping\n\n")
+			if err := s.rc.Flush(); err != nil {
+				return s.shutdown(closeReasonPingFailed)
+			}
+		}
+	}
+}
+
+// goAway tells the client when to reconnect and ends the stream. Events still
+// queued are dropped, as the client replays them after reconnecting.
+func (s *sseStream) goAway(reconnectAfter time.Duration) {
+	s.stopDelivery()
+	select {
+	case s.leaving <- reconnectAfter:
+	default:
+	}
+}
+
+// shutdown ends the stream once and returns the reason it was closed for,
+// which is the reason given by the first caller.
+func (s *sseStream) shutdown(reason string) string {
+	s.closeOnce.Do(func() {
+		if s.goingAway.Load() {
+			reason = closeReasonShutdown
+		}
+		s.closeReason = reason
+		close(s.closed)
+	})
+	return s.closeReason
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	defaultSyncTimeout = 30 * time.Second
+	maxSyncTimeout     = 2 * time.Minute
+)
+
+// syncPoll is a long poll waiting on GET /sync. It registers with the hub
+// like a connection so that the user's events are routed to this node, but
+// only uses them as a signal to read the event log again.
+type syncPoll struct {
+	clientInfo
+	wake      chan struct{} // signalled when an event with a seq arrives
+	done      chan struct{} // closed when the node asks the poll to return
+	closeOnce sync.Once
+}
+
+func newSyncPoll() *syncPoll {
+	return &syncPoll{wake: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// deliver wakes the poll. Events without a seq, such as typing and presence,
+// are not in the log and are not returned by /sync.
+func (p *syncPoll) deliver(ev *outboundEvent) {
+	if ev.msg.Seq == 0 {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// goAway makes the poll return what it has; the client polls again on
+// another node.
+func (p *syncPoll) goAway(time.Duration) {
+	p.shutdown(closeReasonShutdown)
+}
+
+func (p *syncPoll) shutdown(reason string) string {
+	p.closeOnce.Do(func() { close(p.done) })
+	return reason
+}
+
+// SyncHandler serves GET /sync?since=<seq>&timeout=30s. It returns the
+// caller's events after since as soon as there are any, or an empty batch when
+// the timeout passes, along with the cursor to pass next. Without since it
+// returns no events and the current cursor to start from.
+func (wsc *webSocketController) SyncHandler(c *gin.Context) {
+	username := c.GetString("user")
+
+	timeout := defaultSyncTimeout
+	if value := c.Query("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout < 0 || timeout > maxSyncTimeout {
+			infrastructure.AbortWithProblem(c, http.StatusBadRequest, "'timeout' must be a duration of at most 2m, such as 30s")
+			return
+		}
+	}
+
+	since, resuming, err := parseCursor(c.Query("since"))
+	if err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid since")
+		return
+	}
+	if !resuming {
+		latest, err := wsc.eventUseCase.LatestSeq(c.Request.Context())
+		if err != nil {
+			respondError(c, err, "Failed to load events")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"events": []*models.WSMessage{}, "next": latest})
+		return
+	}
+
+	device := c.Query("device")
+	if device == "" {
+		device = uuid.New().String()
+	}
+
+	// Register before reading the log, so that an event appended in between
+	// still wakes the poll
+	poll := newSyncPoll()
+	poll.username, poll.device = username, device
+	if !wsc.addClient(poll) {
+		c.Header("Retry-After", "1")
+		infrastructure.AbortWithProblem(c, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+	defer wsc.removeClient(poll)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	for {
+		events, next, err := wsc.eventsAfter(c.Request.Context(), username, since)
+		if err != nil {
+			respondError(c, err, "Failed to load events")
+			return
+		}
+		if len(events) > 0 {
+			c.JSON(http.StatusOK, gin.H{"events": events, "next": next})
+			return
+		}
+
+		select {
+		case <-poll.wake:
+			continue
+		case <-ctx.Done():
+		case <-poll.done:
+		}
+		c.JSON(http.StatusOK, gin.H{"events": []*models.WSMessage{}, "next": next})
+		return
+	}
+}
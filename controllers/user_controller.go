@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/haileamlak/chat-system/infrastructure"
 	"github.com/haileamlak/chat-system/models"
 	"github.com/haileamlak/chat-system/usecases"
 )
@@ -26,12 +27,12 @@ func NewUserController(userUseCase usecases.UserUseCase) UserController {
 func (ctrl *userController) SignUp(c *gin.Context) {
 	var user models.User
 	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid input")
 		return
 	}
 
 	if err := ctrl.userUseCase.Register(c.Request.Context(), user.Username, user.Password); err != nil {
-		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		respondError(c, err, "Failed to sign up")
 		return
 	}
 
@@ -41,13 +42,13 @@ func (ctrl *userController) SignUp(c *gin.Context) {
 func (ctrl *userController) Login(c *gin.Context) {
 	var user models.User
 	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid input")
 		return
 	}
 	
 	token, err := ctrl.userUseCase.Login(c.Request.Context(), user.Username, user.Password)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		respondError(c, err, "Failed to log in")
 		return
 	}
 
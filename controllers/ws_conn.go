@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket connection metrics, served at /debug/vars
+var (
+	wsOpenConnections   = expvar.NewInt("ws_connections_open")
+	wsClosedConnections = expvar.NewMap("ws_connections_closed") // count per close reason
+)
+
+// Reasons a connection was closed, as counted in ws_connections_closed.
+const (
+	closeReasonClient       = "client_closed"    // the client sent a close frame
+	closeReasonLost         = "connection_lost"  // the connection dropped without a close frame
+	closeReasonPongTimeout  = "pong_timeout"     // nothing, not even a pong, arrived within the pong timeout
+	closeReasonFrameTooBig  = "frame_too_large"  // a frame exceeded the maximum frame size
+	closeReasonInvalidFrame = "invalid_frame"    // a frame was not a valid JSON message
+	closeReasonPingFailed   = "ping_failed"      // a ping could not be written within the write timeout
+	closeReasonWriteFailed  = "write_failed"     // a message could not be written within the write timeout
+	closeReasonShutdown     = "server_shutdown"  // the node was draining its connections
+	closeReasonSlowConsumer = "slow_consumer"    // live events piled up faster than the client read them
+	closeReasonHandshake    = "handshake_failed" // a v1 client did not open with a valid hello
+)
+
+// wsConn serializes the writes to a connection, as gorilla/websocket allows
+// only one concurrent writer, and applies the read and write deadlines. Live
+// events are queued and written by the connection's own pump.
+type wsConn struct {
+	*websocket.Conn
+	clientInfo
+	*eventQueue
+	writeTimeout time.Duration
+	writeMu      sync.Mutex
+
+	// format follows the subprotocol the client negotiated; capabilities
+	// are those agreed on in a v1 handshake
+	format       wireFormat
+	capabilities map[string]bool
+	// requestID is the ID of the upgrade request, sent in error frames
+	requestID string
+
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closeReason string
+}
+
+func newWSConn(conn *websocket.Conn, config WebSocketConfig) *wsConn {
+	conn.SetReadLimit(config.MaxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	})
+	if config.CompressionLevel != 0 {
+		if err := conn.SetCompressionLevel(config.CompressionLevel); err != nil {
+			log.Println("Invalid WebSocket compression level, using the default:", err)
+		}
+	}
+
+	wsOpenConnections.Add(1)
+	c := &wsConn{
+		Conn:         conn,
+		writeTimeout: config.WriteTimeout,
+		format:       formatOf(conn.Subprotocol()),
+		closed:       make(chan struct{}),
+	}
+	c.eventQueue = newEventQueue(func() { c.shutdown(closeReasonSlowConsumer) })
+	return c
+}
+
+func (c *wsConn) WriteJSON(v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writePayload(payload)
+}
+
+// writeEvent encodes an event for this connection alone and sends it. Live
+// events, shared by many clients, go through the queue instead.
+func (c *wsConn) writeEvent(msg models.WSMessage) error {
+	if !c.wants(msg) {
+		return nil
+	}
+	payload, err := c.format.encodeEvent(msg)
+	if err != nil {
+		return nil // an event the format cannot carry is skipped
+	}
+	return c.writePayload(payload)
+}
+
+// writeFrame sends a v1 frame.
+func (c *wsConn) writeFrame(frame serverFrame) error {
+	if e, ok := frame.Data.(*models.ErrorEvent); ok {
+		e.RequestID = c.requestID
+	}
+	payload, err := c.format.encodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	return c.writePayload(payload)
+}
+
+// wants reports whether the client asked for an event; v1 clients only get
+// the optional families they asked for.
+func (c *wsConn) wants(msg models.WSMessage) bool {
+	return c.format == formatLegacy || wantsEvent(msg.Type, c.capabilities)
+}
+
+func (c *wsConn) writePayload(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.write(payload)
+}
+
+// write sends an encoded frame within the write timeout. A client that cannot
+// keep up is disconnected. The caller holds writeMu.
+func (c *wsConn) write(payload []byte) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if err := c.Conn.WriteMessage(c.format.messageType(), payload); err != nil {
+		c.shutdown(closeReasonWriteFailed)
+		return err
+	}
+	return nil
+}
+
+// writePrepared sends a frame shared with other connections. It is framed,
+// and compressed, once for all connections that negotiated the same
+// compression.
+func (c *wsConn) writePrepared(msg *websocket.PreparedMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if err := c.Conn.WritePreparedMessage(msg); err != nil {
+		c.shutdown(closeReasonWriteFailed)
+		return err
+	}
+	return nil
+}
+
+// pump writes queued events and pings the client every interval until the
+// connection is closed. Pongs push the read deadline back; a client that
+// stops answering is reaped by it.
+func (c *wsConn) pump(pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case ev := <-c.queue:
+			if c.goingAway.Load() || !c.wants(ev.msg) {
+				continue
+			}
+			prepared := ev.prepared(c.format)
+			if prepared == nil {
+				continue
+			}
+			if err := c.writePrepared(prepared); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if c.goingAway.Load() {
+				continue
+			}
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout)); err != nil {
+				c.shutdown(closeReasonPingFailed)
+				return
+			}
+		}
+	}
+}
+
+// goAway tells the client the server is shutting down and when to reconnect,
+// then starts the close handshake with the going-away code. It waits for a
+// write in flight to finish first; events still queued are dropped, as the
+// client replays them after reconnecting.
+func (c *wsConn) goAway(reconnectAfter time.Duration) {
+	c.stopDelivery()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	data, _ := json.Marshal(models.GoingAwayEvent{ReconnectAfter: reconnectAfter.Milliseconds()})
+	payload, _ := c.format.encodeEvent(models.WSMessage{Type: "going_away", Data: data})
+	if err := c.write(payload); err != nil {
+		return
+	}
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down, reconnect")
+	if err := c.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(c.writeTimeout)); err != nil {
+		c.shutdown(closeReasonShutdown)
+	}
+}
+
+// shutdown closes the connection once and returns the reason it was closed
+// for, which is the reason given by the first caller.
+func (c *wsConn) shutdown(reason string) string {
+	c.closeOnce.Do(func() {
+		if c.goingAway.Load() {
+			reason = closeReasonShutdown
+		}
+		c.closeReason = reason
+		close(c.closed)
+		c.Conn.Close()
+		wsOpenConnections.Add(-1)
+		wsClosedConnections.Add(reason, 1)
+	})
+	return c.closeReason
+}
+
+// readErrorReason classifies the error that ended a connection's read loop.
+func readErrorReason(err error) string {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		return closeReasonClient
+	case errors.Is(err, websocket.ErrReadLimit):
+		return closeReasonFrameTooBig
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return closeReasonPongTimeout
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return closeReasonInvalidFrame
+	default:
+		return closeReasonLost
+	}
+}
@@ -3,37 +3,92 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/haileamlak/chat-system/infrastructure"
 	"github.com/haileamlak/chat-system/models"
 	"github.com/haileamlak/chat-system/usecases"
 
 	"github.com/gin-gonic/gin"
+	uuid "github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+var errUnknownFrame = &usecases.Error{Kind: usecases.KindValidation, Message: "unknown message type"}
+
 type WebSocketController interface {
+	clientHub
 	WebSocketHandler(c *gin.Context)
-	handleConnection(conn *websocket.Conn, username string)
-	handleMessage(msg models.WSMessage)
-	StartSubscriber()
-	SubscribeUser(username string)
-	SubscribeGroup(group string)
-	subscribeChannel(channel string)
+	EventStreamHandler(c *gin.Context)
+	SyncHandler(c *gin.Context)
+	handleConnection(conn *wsConn)
+	handleMessage(msg models.WSMessage) (*models.WSMessage, error)
+	StartPresence()
+	route(channel string, payload []byte)
 	deliverToClient(msg models.WSMessage)
+	Shutdown(ctx context.Context) error
+}
+
+// clientHub is what the other transports need of the hub to serve their
+// streams as its clients.
+type clientHub interface {
+	connectClient(c client) bool
+	removeClient(c client)
+	sendInitialEvents(send func(models.WSMessage) error, username string, resuming bool, cursor int64) int64
+	isDraining() bool
+	connectionConfig() WebSocketConfig
+}
+
+// WebSocketConfig holds the timings of WebSocket connections.
+type WebSocketConfig struct {
+	// HeartbeatInterval is how often presence sessions are refreshed.
+	HeartbeatInterval time.Duration
+	// TypingTTL is how long a typing indicator shows without a refresh.
+	TypingTTL time.Duration
+	// PingInterval is how often clients are pinged. It must be shorter than
+	// PongTimeout.
+	PingInterval time.Duration
+	// PongTimeout is how long a connection may stay silent, pongs included,
+	// before it is considered dead and closed.
+	PongTimeout time.Duration
+	// WriteTimeout bounds every write; slower clients are disconnected.
+	WriteTimeout time.Duration
+	// MaxFrameSize is the largest frame accepted from a client, in bytes.
+	MaxFrameSize int64
+	// ReconnectWindow spreads the reconnects of clients told to go away on
+	// shutdown over this long.
+	ReconnectWindow time.Duration
+	// CompressionLevel is the flate level, from 1 (fastest) to 9 (smallest),
+	// of permessage-deflate with clients that offer it; 0 turns it off.
+	CompressionLevel int
 }
 
 type webSocketController struct {
-	msgUseCase   usecases.MessageUseCase
-	redisService infrastructure.RedisService
-	upgrader     websocket.Upgrader
-	Clients      map[string]*websocket.Conn
+	msgUseCase      usecases.MessageUseCase
+	presenceUseCase usecases.PresenceUseCase
+	typingUseCase   usecases.TypingUseCase
+	eventUseCase    usecases.EventUseCase
+	subscriber      infrastructure.SubscriberService
+	registry        infrastructure.ConnectionRegistry
+	authMiddleware  infrastructure.AuthMiddleware
+	upgrader        websocket.Upgrader
+	config          WebSocketConfig
+
+	mu       sync.RWMutex                    // guards the fields below
+	Clients  map[string]map[client]struct{} // username -> their connections on this node
+	draining bool
+
+	connections sync.WaitGroup // registered clients
+	stop        chan struct{}  // closed on shutdown
 }
 
-func NewWebSocketController(messageUseCase usecases.MessageUseCase, redisService infrastructure.RedisService) WebSocketController {
-	controller := &webSocketController{msgUseCase: messageUseCase, redisService: redisService, upgrader: websocket.Upgrader{
+func NewWebSocketController(messageUseCase usecases.MessageUseCase, presenceUseCase usecases.PresenceUseCase, typingUseCase usecases.TypingUseCase, eventUseCase usecases.EventUseCase, subscriber infrastructure.SubscriberService, registry infrastructure.ConnectionRegistry, authMiddleware infrastructure.AuthMiddleware, config WebSocketConfig) WebSocketController {
+	controller := &webSocketController{msgUseCase: messageUseCase, presenceUseCase: presenceUseCase, typingUseCase: typingUseCase, eventUseCase: eventUseCase, subscriber: subscriber, registry: registry, authMiddleware: authMiddleware, config: config, upgrader: websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			// origin := r.Header.Get("Origin")
 			// if origin == "ws://localhost:8080" {
@@ -41,141 +96,457 @@ func NewWebSocketController(messageUseCase usecases.MessageUseCase, redisService
 			// }
 			return true
 		},
+		Subprotocols:      []string{models.ProtocolV1, models.ProtocolV1Proto},
+		EnableCompression: config.CompressionLevel != 0,
 	},
-		Clients: make(map[string]*websocket.Conn),
+		Clients: make(map[string]map[client]struct{}),
+		stop:    make(chan struct{}),
 	}
 
-	controller.StartSubscriber()
+	go subscriber.Run(controller.route)
+	controller.StartPresence()
 	return controller
 }
 
 func (wsc *webSocketController) WebSocketHandler(c *gin.Context) {
-	username := c.Query("user")
-	if username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing user param"})
+	// Browsers cannot set headers on a WebSocket handshake, so the token may
+	// also come as a query parameter
+	authorization := c.GetHeader("Authorization")
+	if authorization == "" && c.Query("token") != "" {
+		authorization = "Bearer " + c.Query("token")
+	}
+	username, err := wsc.authMiddleware.AuthenticateToken(authorization)
+	if err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if wsc.isDraining() {
+		c.Header("Retry-After", "1")
+		infrastructure.AbortWithProblem(c, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+
+	// Each device of a user may hold its own connection
+	device := c.Query("device")
+	if device == "" {
+		device = uuid.New().String()
+	}
+
+	// A reconnecting client passes the seq of the last event it saw
+	cursor, resuming, err := parseCursor(c.Query("cursor"))
+	if err != nil {
+		infrastructure.AbortWithProblem(c, http.StatusBadRequest, "Invalid cursor")
 		return
 	}
 
-	conn, err := wsc.upgrader.Upgrade(c.Writer, c.Request, nil)
+	upgraded, err := wsc.upgrader.Upgrade(c.Writer, c.Request, c.Writer.Header())
 	if err != nil {
 		log.Println("WebSocket upgrade failed:", err)
 		return
 	}
+	conn := newWSConn(upgraded, wsc.config)
+	conn.requestID = infrastructure.RequestIDFromContext(c.Request.Context())
+
+	// v1 clients open with a hello, which may carry the device and cursor
+	if conn.format != formatLegacy {
+		hello, ok := handshake(conn)
+		if !ok {
+			return
+		}
+		if hello.Device != "" {
+			device = hello.Device
+		}
+		if hello.Cursor != nil {
+			cursor, resuming = *hello.Cursor, true
+		}
+	}
+	conn.username, conn.device = username, device
 
-	// Subscribe user and groups via usecase
-	wsc.SubscribeUser(username)
-	groups, _ := wsc.redisService.GetClient().SMembers(context.Background(), "user:"+username+":groups").Result()
-	for _, g := range groups {
-		wsc.SubscribeGroup(g)
+	conn.session, err = wsc.presenceUseCase.Connect(context.Background(), username)
+	if err != nil {
+		log.Println("Failed to record presence of", username, ":", err)
+	}
+
+	// Live events are held back from here until the frames below are sent
+	if !wsc.addClient(conn) {
+		conn.shutdown(closeReasonShutdown)
+		wsc.disconnectPresence(conn)
+		return
 	}
+	log.Println(username, "connected via WebSocket from device", device)
 
-	wsc.Clients[username] = conn
-	log.Println(username, "connected via WebSocket")
+	if conn.format != formatLegacy {
+		conn.writeFrame(wsc.welcomeFrame(conn))
+	}
+	conn.resume(wsc.sendInitialEvents(conn.writeEvent, username, resuming, cursor))
 
-	go wsc.handleConnection(conn, username)
+	go wsc.handleConnection(conn)
 }
 
-func (wsc *webSocketController) handleConnection(conn *websocket.Conn, username string) {
+// parseCursor reads the seq of the last event a client saw. An empty value
+// means the client is not resuming.
+func parseCursor(value string) (int64, bool, error) {
+	if value == "" {
+		return 0, false, nil
+	}
+	cursor, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || cursor < 0 {
+		return 0, false, errors.New("invalid cursor")
+	}
+	return cursor, true, nil
+}
+
+// addClient routes the live events of the client's user to it and has them
+// published to this node. It returns false while the node is draining.
+func (wsc *webSocketController) addClient(c client) bool {
+	info := c.info()
+	wsc.mu.Lock()
+	if wsc.draining {
+		wsc.mu.Unlock()
+		return false
+	}
+	if wsc.Clients[info.username] == nil {
+		wsc.Clients[info.username] = make(map[client]struct{})
+	}
+	wsc.Clients[info.username][c] = struct{}{}
+	wsc.connections.Add(1)
+	wsc.mu.Unlock()
+
+	if err := wsc.registry.Register(context.Background(), info.username, info.device); err != nil {
+		log.Println("Failed to register the connection of", info.username, ":", err)
+	}
+	return true
+}
+
+// connectClient starts the presence session of a client whose info is set
+// and adds it. It returns false while the node is draining.
+func (wsc *webSocketController) connectClient(c client) bool {
+	info := c.info()
+	var err error
+	info.session, err = wsc.presenceUseCase.Connect(context.Background(), info.username)
+	if err != nil {
+		log.Println("Failed to record presence of", info.username, ":", err)
+	}
+
+	if !wsc.addClient(c) {
+		wsc.disconnectPresence(c)
+		return false
+	}
+	return true
+}
+
+// connectionConfig returns the settings the hub's connections run with.
+func (wsc *webSocketController) connectionConfig() WebSocketConfig {
+	return wsc.config
+}
+
+// removeClient undoes addClient for a closed client and ends its presence
+// session.
+func (wsc *webSocketController) removeClient(c client) {
+	info := c.info()
+	wsc.mu.Lock()
+	delete(wsc.Clients[info.username], c)
+	if len(wsc.Clients[info.username]) == 0 {
+		delete(wsc.Clients, info.username)
+	}
+	// The same device may already have reconnected to this node
+	deviceConnected := false
+	for other := range wsc.Clients[info.username] {
+		deviceConnected = deviceConnected || other.info().device == info.device
+	}
+	wsc.mu.Unlock()
+
+	if !deviceConnected {
+		if err := wsc.registry.Unregister(context.Background(), info.username, info.device); err != nil {
+			log.Println("Failed to unregister the connection of", info.username, ":", err)
+		}
+	}
+	wsc.disconnectPresence(c)
+	wsc.connections.Done()
+}
+
+// sendInitialEvents sends a newly connected client its unread counts and, if
+// it is resuming, the events it missed. It returns the seq the client is up to
+// date with, for resume.
+func (wsc *webSocketController) sendInitialEvents(send func(models.WSMessage) error, username string, resuming bool, cursor int64) int64 {
+	// Let the client render unread badges before any live message arrives
+	if counts, err := wsc.msgUseCase.GetUnreadCounts(context.Background(), username); err != nil {
+		log.Println("Failed to load unread counts for", username, ":", err)
+	} else {
+		data, _ := json.Marshal(counts)
+		send(models.WSMessage{Type: "unread", To: username, Data: data})
+	}
+
+	if !resuming {
+		return 0
+	}
+	return wsc.replay(send, username, cursor)
+}
+
+// replay sends a reconnecting client the events it missed since its cursor,
+// or a resync frame when it is too far behind. It returns the seq the client
+// is now up to date with.
+func (wsc *webSocketController) replay(send func(models.WSMessage) error, username string, cursor int64) int64 {
+	events, _, err := wsc.eventsAfter(context.Background(), username, cursor)
+	if err != nil {
+		log.Println("Failed to replay events for", username, ":", err)
+		return cursor
+	}
+
+	for _, event := range events {
+		if err := send(*event); err != nil {
+			log.Println("Error replaying events to", username, ":", err)
+			return cursor
+		}
+		cursor = event.Seq
+	}
+	return cursor
+}
+
+// eventsAfter reads the events of a user after a cursor and the cursor that
+// follows them. A cursor too far behind gets a resync event instead, with the
+// latest seq to continue from once the client has refetched its history.
+func (wsc *webSocketController) eventsAfter(ctx context.Context, username string, since int64) ([]*models.WSMessage, int64, error) {
+	events, err := wsc.eventUseCase.Replay(ctx, username, since)
+	if errors.Is(err, usecases.ErrCursorTooOld) {
+		latest, err := wsc.eventUseCase.LatestSeq(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		resync := &models.WSMessage{Type: "resync", To: username, Content: usecases.ErrCursorTooOld.Error(), Seq: latest}
+		return []*models.WSMessage{resync}, latest, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	next := since
+	if len(events) > 0 {
+		next = events[len(events)-1].Seq
+	}
+	return events, next, nil
+}
+
+func (wsc *webSocketController) handleConnection(conn *wsConn) {
+	username := conn.username
+	typing := newTypingState()
+	go conn.pump(wsc.config.PingInterval)
+
+	var readErr error
 	defer func() {
-		conn.Close()
-		delete(wsc.Clients, username)
-		log.Println(username, "disconnected")
+		reason := conn.shutdown(readErrorReason(readErr))
+		wsc.stopAllTyping(typing, username)
+		wsc.removeClient(conn)
+		log.Println(username, "disconnected:", reason)
 	}()
 
+	if conn.format != formatLegacy {
+		readErr = wsc.readCommands(conn, typing)
+	} else {
+		readErr = wsc.readMessages(conn, typing)
+	}
+}
+
+// readMessages runs the read loop of a connection on the original protocol,
+// where clients send WSMessage frames.
+func (wsc *webSocketController) readMessages(conn *wsConn, typing *typingState) error {
+	username := conn.username
 	for {
 		var msg models.WSMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Println("Error reading:", err)
-			return
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
 		}
 
-		wsc.handleMessage(msg)
-	}
+		// Any frame proves the client is alive, not only pongs
+		conn.SetReadDeadline(time.Now().Add(wsc.config.PongTimeout))
+
+		var err error
 
+		// Everything arriving on this connection is sent by its user
+		msg.From = username
+		var ack *models.WSMessage
+		if msg.Type == "typing" {
+			err = wsc.handleTyping(typing, username, msg)
+		} else {
+			ack, err = wsc.handleMessage(msg)
+			if conversationID := typingConversation(msg); conversationID != "" && err == nil {
+				wsc.stopTyping(typing, username, conversationID)
+			}
+		}
+
+		// Tell the client whether its frame landed; client_id lets it match
+		// the reply to what it sent
+		if err != nil {
+			ack = &models.WSMessage{Type: "error", To: username, ClientID: msg.ClientID, Content: wsErrorText(conn, err, msg.Type)}
+		}
+		if ack != nil {
+			if err := conn.WriteJSON(ack); err != nil {
+				log.Println("Error replying to", username, ":", err)
+			}
+		}
+	}
 }
 
-func (wsc *webSocketController) handleMessage(msg models.WSMessage) {
-	msgJSON, _ := json.Marshal(msg)
+// handleMessage stores a message sent over the WebSocket and returns the ack
+// for its sender. Delivery to the recipients happens in the use case.
+func (wsc *webSocketController) handleMessage(msg models.WSMessage) (*models.WSMessage, error) {
+	meta := models.MessageMeta{ClientID: msg.ClientID, ParentID: msg.ParentID, Attachments: msg.Attachments}
 
 	switch msg.Type {
 	case "dm":
 		directMessage := models.DirectMessage{
-			From:    msg.From,
-			To:      msg.To,
-			Content: msg.Content,
+			MessageMeta: meta,
+			From:        msg.From,
+			To:          msg.To,
+			Content:     msg.Content,
 		}
 
-		wsc.msgUseCase.SaveDirectMessage(context.Background(), msg.From, msg.To, &directMessage)
-		wsc.redisService.GetClient().Publish(context.Background(), "channel:user:"+msg.To, msgJSON)
+		if err := wsc.msgUseCase.SaveDirectMessage(context.Background(), msg.From, msg.To, &directMessage); err != nil {
+			return nil, err
+		}
+		return messageAck(msg, &directMessage.MessageMeta, directMessage.Timestamp), nil
 
 	case "group":
 		groupMessage := models.GroupMessage{
-			From:    msg.From,
-			Group:   msg.To,
-			Content: msg.Content,
+			MessageMeta: meta,
+			From:        msg.From,
+			Group:       msg.To,
+			Content:     msg.Content,
 		}
 
-		wsc.msgUseCase.SendGroupMessage(context.Background(), msg.To, &groupMessage)
-		wsc.redisService.GetClient().Publish(context.Background(), "channel:group:"+msg.To, msgJSON)
+		if err := wsc.msgUseCase.SendGroupMessage(context.Background(), msg.To, &groupMessage); err != nil {
+			return nil, err
+		}
+		return messageAck(msg, &groupMessage.MessageMeta, groupMessage.Timestamp), nil
 
 	case "broadcast":
 		broadcastMessage := models.BroadcastMessage{
-			From:    msg.From,
-			Content: msg.Content,
+			MessageMeta: meta,
+			From:        msg.From,
+			Content:     msg.Content,
+		}
+
+		if err := wsc.msgUseCase.SendBroadcastMessage(context.Background(), &broadcastMessage); err != nil {
+			return nil, err
 		}
-		wsc.msgUseCase.SendBroadcastMessage(context.Background(), &broadcastMessage)
-		wsc.redisService.GetClient().Publish(context.Background(), "channel:broadcast", msgJSON)
+		return messageAck(msg, &broadcastMessage.MessageMeta, broadcastMessage.Timestamp), nil
+
+	case "presence":
+		return nil, wsc.presenceUseCase.SetState(context.Background(), msg.From, msg.Content)
+
+	default:
+		return nil, errUnknownFrame
 	}
 }
 
-func (wsc *webSocketController) StartSubscriber() {
-	go wsc.subscribeChannel("channel:broadcast")
+// wsErrorText is the reason sent back in an error frame. The cause of an
+// unexpected failure is logged with the connection's request ID instead.
+func wsErrorText(conn *wsConn, err error, msgType string) string {
+	fallback := "Failed to handle " + msgType + " message"
+	if errorStatus(err) == http.StatusInternalServerError {
+		log.Printf("Request %s: %s: %v", conn.requestID, fallback, err)
+	}
+	return errorText(err, fallback)
 }
 
-func (wsc *webSocketController) SubscribeUser(username string) {
-	go wsc.subscribeChannel("channel:user:" + username)
+// messageAck confirms to the sender that its message was stored.
+func messageAck(msg models.WSMessage, meta *models.MessageMeta, timestamp string) *models.WSMessage {
+	return &models.WSMessage{Type: "ack", To: msg.From, ID: meta.ID, ClientID: meta.ClientID, Timestamp: timestamp}
 }
 
-func (wsc *webSocketController) SubscribeGroup(group string) {
-	go wsc.subscribeChannel("channel:group:" + group)
-}
+// StartPresence keeps the presence sessions and registry entries of local
+// connections alive and reaps sessions left behind by nodes that stopped
+// heartbeating.
+func (wsc *webSocketController) StartPresence() {
+	go func() {
+		ticker := time.NewTicker(wsc.config.HeartbeatInterval)
+		defer ticker.Stop()
 
-func (wsc *webSocketController) subscribeChannel(channel string) {
-	pubsub := wsc.redisService.GetClient().Subscribe(context.Background(), channel)
-	ch := pubsub.Channel()
+		for {
+			select {
+			case <-wsc.stop:
+				return
+			case <-ticker.C:
+			}
 
-	log.Println("Subscribed to", channel)
+			for _, c := range wsc.connectedClients() {
+				info := c.info()
+				if err := wsc.registry.Register(context.Background(), info.username, info.device); err != nil {
+					log.Println("Failed to refresh the connection of", info.username, ":", err)
+				}
+				if info.session == "" {
+					continue
+				}
+				if err := wsc.presenceUseCase.Heartbeat(context.Background(), info.username, info.session); err != nil {
+					log.Println("Failed to heartbeat presence of", info.username, ":", err)
+				}
+			}
 
-	for msg := range ch {
-		var wsMsg models.WSMessage
-		err := json.Unmarshal([]byte(msg.Payload), &wsMsg)
-		if err != nil {
-			log.Println("Failed to unmarshal pubsub msg:", err)
-			continue
+			if err := wsc.presenceUseCase.ReapExpiredSessions(context.Background()); err != nil {
+				log.Println("Failed to reap expired presence sessions:", err)
+			}
 		}
+	}()
+}
 
-		log.Println("Received message on", channel, ":", wsMsg)
-
-		wsc.deliverToClient(wsMsg)
+// route hands a message received on any subscribed channel to the local
+// clients it is meant for.
+func (wsc *webSocketController) route(channel string, payload []byte) {
+	var wsMsg models.WSMessage
+	if err := json.Unmarshal(payload, &wsMsg); err != nil {
+		log.Println("Failed to unmarshal pubsub msg on", channel, ":", err)
+		return
 	}
+	wsc.deliverToClient(wsMsg)
 }
 
+// deliverToClient hands an event to the local clients of its recipients. They
+// share one outboundEvent, so it is encoded once per wire format rather than
+// once per client.
 func (wsc *webSocketController) deliverToClient(msg models.WSMessage) {
-	// if broadcast message, send to all clients except the sender
-	if msg.Type == "broadcast" {
-		for username, conn := range wsc.Clients {
+	ev := newOutboundEvent(msg)
+
+	wsc.mu.RLock()
+	defer wsc.mu.RUnlock()
+
+	// if broadcast message or an event without a recipient, send to all clients except the sender
+	if msg.Type == "broadcast" || msg.To == "" {
+		for username, conns := range wsc.Clients {
 			if username != msg.From {
-				err := conn.WriteJSON(msg)
-				if err != nil {
-					log.Println("Error sending broadcast to", username, ":", err)
+				for conn := range conns {
+					conn.deliver(ev)
 				}
 			}
 		}
 		return
-	} else {
-		if conn, ok := wsc.Clients[msg.To]; ok {
-			conn.WriteJSON(msg)
+	}
+	for conn := range wsc.Clients[msg.To] {
+		conn.deliver(ev)
+	}
+}
+
+// connectedClients returns a snapshot of the connections on this node.
+func (wsc *webSocketController) connectedClients() []client {
+	wsc.mu.RLock()
+	defer wsc.mu.RUnlock()
+
+	conns := []client{}
+	for _, userConns := range wsc.Clients {
+		for conn := range userConns {
+			conns = append(conns, conn)
 		}
 	}
+	return conns
+}
+
+// disconnectPresence ends the presence session of a closed connection.
+func (wsc *webSocketController) disconnectPresence(c client) {
+	info := c.info()
+	if info.session == "" {
+		return
+	}
+	if err := wsc.presenceUseCase.Disconnect(context.Background(), info.username, info.session); err != nil {
+		log.Println("Failed to clear presence of", info.username, ":", err)
+	}
 }
@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/haileamlak/chat-system/models"
+	chatv1 "github.com/haileamlak/chat-system/protocol/v1"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// wireFormat is how frames are encoded on a connection, chosen by the
+// subprotocol it negotiated.
+type wireFormat int
+
+const (
+	formatLegacy wireFormat = iota // WSMessage JSON, for clients that negotiated no subprotocol
+	formatJSON                     // chat.v1
+	formatProto                    // chat.v1.protobuf
+	numFormats
+)
+
+func formatOf(subprotocol string) wireFormat {
+	switch subprotocol {
+	case models.ProtocolV1:
+		return formatJSON
+	case models.ProtocolV1Proto:
+		return formatProto
+	default:
+		return formatLegacy
+	}
+}
+
+// messageType is the WebSocket message type frames of the format are sent in.
+func (f wireFormat) messageType() int {
+	if f == formatProto {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// serverFrame is a v1 frame sent by the server, before it is encoded. Data
+// holds a pointer to the models type of the frame, or nil.
+type serverFrame struct {
+	Type string
+	Ref  string
+	Seq  int64
+	Data interface{}
+}
+
+// command is a v1 frame sent by a client. Data holds a pointer to the models
+// type of the command, or nil for unknown commands.
+type command struct {
+	Type string
+	Ref  string
+	Data interface{}
+}
+
+// encodeEvent encodes an event in the format. Events the format cannot carry
+// return an error.
+func (f wireFormat) encodeEvent(msg models.WSMessage) ([]byte, error) {
+	if f == formatLegacy {
+		return json.Marshal(msg)
+	}
+	return f.encodeFrame(eventFrame(msg))
+}
+
+// encodeFrame encodes a v1 frame in the format.
+func (f wireFormat) encodeFrame(frame serverFrame) ([]byte, error) {
+	if f == formatProto {
+		pb, err := frameToProto(frame)
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(pb)
+	}
+
+	out := models.Frame{Type: frame.Type, Ref: frame.Ref, Seq: frame.Seq}
+	if raw, ok := frame.Data.(json.RawMessage); ok {
+		out.Data = raw
+	} else if frame.Data != nil {
+		data, err := json.Marshal(frame.Data)
+		if err != nil {
+			return nil, err
+		}
+		out.Data = data
+	}
+	return json.Marshal(out)
+}
+
+// decodeCommand decodes a frame sent by a v1 client. The command's type is
+// empty when the frame could not be read at all; an error with a type means
+// the data did not match the command.
+func (f wireFormat) decodeCommand(payload []byte) (command, error) {
+	if f == formatProto {
+		return decodeProtoCommand(payload)
+	}
+
+	var frame models.Frame
+	if err := json.Unmarshal(payload, &frame); err != nil || frame.Type == "" {
+		return command{}, errors.New("frames must be JSON with a type")
+	}
+	cmd := command{Type: frame.Type, Ref: frame.Ref}
+	var data interface{}
+	switch frame.Type {
+	case "hello":
+		data = &models.HelloCommand{}
+	case "message.send":
+		data = &models.SendMessageCommand{}
+	case "presence.set":
+		data = &models.SetPresenceCommand{}
+	case "typing.start", "typing.stop":
+		data = &models.TypingCommand{}
+	default:
+		return cmd, nil
+	}
+	if err := decodeData(frame, data); err != nil {
+		return cmd, err
+	}
+	cmd.Data = data
+	return cmd, nil
+}
+
+// outboundEvent is an event on its way to the local clients of its
+// recipients. It is encoded at most once per wire format, by the first client
+// that needs the format, and the bytes are shared by the rest. WebSocket
+// clients share a prepared message too, so that the frame is also built and
+// compressed once.
+type outboundEvent struct {
+	msg      models.WSMessage
+	once     [numFormats]sync.Once
+	payload  [numFormats][]byte
+	messages [numFormats]*websocket.PreparedMessage
+}
+
+func newOutboundEvent(msg models.WSMessage) *outboundEvent {
+	return &outboundEvent{msg: msg}
+}
+
+// encoded returns the event in a wire format, or nil if the format cannot
+// carry it.
+func (e *outboundEvent) encoded(format wireFormat) []byte {
+	e.once[format].Do(func() {
+		payload, err := format.encodeEvent(e.msg)
+		if err == nil {
+			e.messages[format], err = websocket.NewPreparedMessage(format.messageType(), payload)
+		}
+		if err != nil {
+			log.Println("Failed to encode", e.msg.Type, "event:", err)
+			return
+		}
+		e.payload[format] = payload
+	})
+	return e.payload[format]
+}
+
+// prepared returns the event as a WebSocket message in a wire format, or nil
+// if the format cannot carry it.
+func (e *outboundEvent) prepared(format wireFormat) *websocket.PreparedMessage {
+	e.encoded(format)
+	return e.messages[format]
+}
+
+// decodeProtoCommand decodes a binary v1 frame.
+func decodeProtoCommand(payload []byte) (command, error) {
+	var frame chatv1.Frame
+	if err := proto.Unmarshal(payload, &frame); err != nil || frame.Body == nil {
+		return command{}, errors.New("frames must be a protobuf Frame with a body")
+	}
+
+	cmd := command{Ref: frame.Ref}
+	switch body := frame.Body.(type) {
+	case *chatv1.Frame_Hello:
+		cmd.Type = "hello"
+		hello := &models.HelloCommand{Version: int(body.Hello.GetVersion()), Capabilities: body.Hello.GetCapabilities(), Device: body.Hello.GetDevice()}
+		if body.Hello.Cursor != nil {
+			cursor := body.Hello.GetCursor()
+			hello.Cursor = &cursor
+		}
+		cmd.Data = hello
+	case *chatv1.Frame_MessageSend:
+		cmd.Type = "message.send"
+		send := body.MessageSend
+		attachments := make([]models.Attachment, 0, len(send.GetAttachments()))
+		for _, attachment := range send.GetAttachments() {
+			attachments = append(attachments, models.Attachment{ID: attachment.GetId()})
+		}
+		cmd.Data = &models.SendMessageCommand{Kind: send.GetKind(), To: send.GetTo(), Content: send.GetContent(), ClientID: send.GetClientId(), ParentID: send.GetParentId(), Attachments: attachments}
+	case *chatv1.Frame_PresenceSet:
+		cmd.Type = "presence.set"
+		cmd.Data = &models.SetPresenceCommand{State: body.PresenceSet.GetState()}
+	case *chatv1.Frame_TypingStart:
+		cmd.Type = "typing.start"
+		cmd.Data = &models.TypingCommand{Conversation: body.TypingStart.GetConversation()}
+	case *chatv1.Frame_TypingStop:
+		cmd.Type = "typing.stop"
+		cmd.Data = &models.TypingCommand{Conversation: body.TypingStop.GetConversation()}
+	default:
+		// A server frame sent by the client; named for the unknown_command error
+		oneof := frame.ProtoReflect().Descriptor().Oneofs().ByName("body")
+		cmd.Type = string(frame.ProtoReflect().WhichOneof(oneof).Name())
+	}
+	return cmd, nil
+}
+
+// frameToProto converts a v1 frame to its protobuf form.
+func frameToProto(frame serverFrame) (*chatv1.Frame, error) {
+	pb := &chatv1.Frame{Ref: frame.Ref, Seq: frame.Seq}
+	switch data := frame.Data.(type) {
+	case *models.WelcomeEvent:
+		pb.Body = &chatv1.Frame_Welcome{Welcome: &chatv1.Welcome{Version: int32(data.Version), Capabilities: data.Capabilities, Device: data.Device, PingIntervalMs: data.PingInterval, MaxFrameSize: data.MaxFrameSize}}
+	case *models.AckEvent:
+		pb.Body = &chatv1.Frame_Ack{Ack: &chatv1.Ack{Id: data.ID, ClientId: data.ClientID, Timestamp: data.Timestamp}}
+	case *models.ErrorEvent:
+		pb.Body = &chatv1.Frame_Error{Error: &chatv1.Error{Code: data.Code, Message: data.Message, RequestId: data.RequestID}}
+	case *models.MessageEvent:
+		pb.Body = &chatv1.Frame_MessageNew{MessageNew: &chatv1.MessageEvent{Kind: data.Kind, Message: messageToProto(&data.Message)}}
+	case *models.Message:
+		switch frame.Type {
+		case "message.edited":
+			pb.Body = &chatv1.Frame_MessageEdited{MessageEdited: messageToProto(data)}
+		case "message.deleted":
+			pb.Body = &chatv1.Frame_MessageDeleted{MessageDeleted: messageToProto(data)}
+		case "thread.reply":
+			pb.Body = &chatv1.Frame_ThreadReply{ThreadReply: messageToProto(data)}
+		}
+	case *models.ReactionEvent:
+		reaction := &chatv1.ReactionEvent{MessageId: data.MessageID, User: data.User, Emoji: data.Emoji, Count: data.Count}
+		if frame.Type == "reaction.removed" {
+			pb.Body = &chatv1.Frame_ReactionRemoved{ReactionRemoved: reaction}
+		} else {
+			pb.Body = &chatv1.Frame_ReactionAdded{ReactionAdded: reaction}
+		}
+	case *models.ReadReceipt:
+		pb.Body = &chatv1.Frame_ReadReceipt{ReadReceipt: &chatv1.ReadReceipt{Conversation: data.Conversation, User: data.User, MessageId: data.MessageID, ReadAt: data.ReadAt}}
+	case *models.Presence:
+		pb.Body = &chatv1.Frame_Presence{Presence: &chatv1.Presence{User: data.User, State: data.State, LastSeen: data.LastSeen}}
+	case *models.TypingIndicator:
+		pb.Body = &chatv1.Frame_Typing{Typing: &chatv1.TypingIndicator{Conversation: data.Conversation, User: data.User, Typing: data.Typing, TtlMs: data.TTL}}
+	case *models.UnreadCounts:
+		pb.Body = &chatv1.Frame_Unread{Unread: &chatv1.UnreadCounts{Total: data.Total, Conversations: data.Conversations}}
+	case *models.ResyncEvent:
+		pb.Body = &chatv1.Frame_Resync{Resync: &chatv1.Resync{Reason: data.Reason}}
+	case *models.GoingAwayEvent:
+		pb.Body = &chatv1.Frame_GoingAway{GoingAway: &chatv1.GoingAway{ReconnectAfterMs: data.ReconnectAfter}}
+	case nil:
+		if frame.Type == "ack" {
+			pb.Body = &chatv1.Frame_Ack{Ack: &chatv1.Ack{}}
+		}
+	}
+
+	if pb.Body == nil {
+		return nil, fmt.Errorf("%s frames have no protobuf encoding", frame.Type)
+	}
+	return pb, nil
+}
+
+func messageToProto(msg *models.Message) *chatv1.Message {
+	pb := &chatv1.Message{
+		Id:          msg.ID,
+		ClientId:    msg.ClientID,
+		EditedAt:    msg.EditedAt,
+		Deleted:     msg.Deleted,
+		DeletedAt:   msg.DeletedAt,
+		DeletedBy:   msg.DeletedBy,
+		ParentId:    msg.ParentID,
+		ReplyCount:  msg.ReplyCount,
+		LastReplyAt: msg.LastReplyAt,
+		From:        msg.From,
+		To:          msg.To,
+		Group:       msg.Group,
+		Content:     msg.Content,
+		Timestamp:   msg.Timestamp,
+	}
+	for _, a := range msg.Attachments {
+		pb.Attachments = append(pb.Attachments, &chatv1.Attachment{Id: a.ID, Name: a.Name, MimeType: a.MIMEType, Size: a.Size, Checksum: a.Checksum, Conversation: a.Conversation, Uploader: a.Uploader, Url: a.URL, ThumbnailUrl: a.ThumbnailURL, CreatedAt: a.CreatedAt})
+	}
+	for _, r := range msg.Reactions {
+		pb.Reactions = append(pb.Reactions, &chatv1.Reaction{Emoji: r.Emoji, Count: r.Count, ReactedByMe: r.ReactedByMe})
+	}
+	return pb
+}
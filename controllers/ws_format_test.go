@@ -0,0 +1,449 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/protocol"
+	chatv1 "github.com/haileamlak/chat-system/protocol/v1"
+)
+
+var (
+	frameSchemasOnce sync.Once
+	frameSchemas     map[string]*jsonschema.Schema // frame type -> schema
+	frameSchemasErr  error
+)
+
+// validateFrame checks a JSON frame against the schema of its type in
+// protocol/v1 and returns it.
+func validateFrame(t *testing.T, payload []byte) models.Frame {
+	t.Helper()
+	frameSchemasOnce.Do(func() { frameSchemas, frameSchemasErr = loadFrameSchemas() })
+	if frameSchemasErr != nil {
+		t.Fatalf("loading schemas: %v", frameSchemasErr)
+	}
+
+	var frame models.Frame
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		t.Fatalf("frame is not JSON: %s", payload)
+	}
+	schema, ok := frameSchemas[frame.Type]
+	if !ok {
+		t.Fatalf("no schema for frame type %q: %s", frame.Type, payload)
+	}
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate(inst); err != nil {
+		t.Fatalf("%s frame does not match its schema: %v\n%s", frame.Type, err, payload)
+	}
+	return frame
+}
+
+func loadFrameSchemas() (map[string]*jsonschema.Schema, error) {
+	const base = "file:///protocol/v1/"
+	compiler := jsonschema.NewCompiler()
+	paths, err := fs.Glob(protocol.Schemas, "v1/*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		file, err := protocol.Schemas.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := jsonschema.UnmarshalJSON(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := compiler.AddResource(base+strings.TrimPrefix(path, "v1/"), doc); err != nil {
+			return nil, err
+		}
+	}
+
+	schemas := make(map[string]*jsonschema.Schema)
+	for _, path := range paths {
+		name := strings.TrimPrefix(path, "v1/")
+		if name == "defs.json" {
+			continue
+		}
+		schema, err := compiler.Compile(base + name)
+		if err != nil {
+			return nil, err
+		}
+		schemas[strings.TrimSuffix(name, ".json")] = schema
+	}
+	return schemas, nil
+}
+
+// Every command decodes to the same command from its JSON and its protobuf
+// framing, and the JSON form is one its schema accepts.
+func TestDecodeCommand(t *testing.T) {
+	cursor := int64(41)
+	tests := []struct {
+		name  string
+		json  string
+		proto *chatv1.Frame
+		want  command
+	}{
+		{
+			name:  "hello",
+			json:  `{"type":"hello","ref":"h","data":{"version":1,"capabilities":["typing"],"device":"phone","cursor":41}}`,
+			proto: &chatv1.Frame{Ref: "h", Body: &chatv1.Frame_Hello{Hello: &chatv1.Hello{Version: 1, Capabilities: []string{"typing"}, Device: "phone", Cursor: &cursor}}},
+			want:  command{Type: "hello", Ref: "h", Data: &models.HelloCommand{Version: 1, Capabilities: []string{"typing"}, Device: "phone", Cursor: &cursor}},
+		},
+		{
+			name: "message.send",
+			json: `{"type":"message.send","ref":"m","data":{"kind":"dm","to":"bob","content":"hi","client_id":"c1","parent_id":"p1","attachments":[{"id":"a1"}]}}`,
+			proto: &chatv1.Frame{Ref: "m", Body: &chatv1.Frame_MessageSend{MessageSend: &chatv1.SendMessage{
+				Kind: "dm", To: "bob", Content: "hi", ClientId: "c1", ParentId: "p1", Attachments: []*chatv1.Attachment{{Id: "a1"}},
+			}}},
+			want: command{Type: "message.send", Ref: "m", Data: &models.SendMessageCommand{
+				Kind: "dm", To: "bob", Content: "hi", ClientID: "c1", ParentID: "p1", Attachments: []models.Attachment{{ID: "a1"}},
+			}},
+		},
+		{
+			name:  "presence.set",
+			json:  `{"type":"presence.set","ref":"p","data":{"state":"away"}}`,
+			proto: &chatv1.Frame{Ref: "p", Body: &chatv1.Frame_PresenceSet{PresenceSet: &chatv1.SetPresence{State: "away"}}},
+			want:  command{Type: "presence.set", Ref: "p", Data: &models.SetPresenceCommand{State: "away"}},
+		},
+		{
+			name:  "typing.start",
+			json:  `{"type":"typing.start","data":{"conversation":"dm:alice:bob"}}`,
+			proto: &chatv1.Frame{Body: &chatv1.Frame_TypingStart{TypingStart: &chatv1.TypingCommand{Conversation: "dm:alice:bob"}}},
+			want:  command{Type: "typing.start", Data: &models.TypingCommand{Conversation: "dm:alice:bob"}},
+		},
+		{
+			name:  "typing.stop",
+			json:  `{"type":"typing.stop","data":{"conversation":"group:team"}}`,
+			proto: &chatv1.Frame{Body: &chatv1.Frame_TypingStop{TypingStop: &chatv1.TypingCommand{Conversation: "group:team"}}},
+			want:  command{Type: "typing.stop", Data: &models.TypingCommand{Conversation: "group:team"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validateFrame(t, []byte(tt.json))
+			got, err := formatJSON.decodeCommand([]byte(tt.json))
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("JSON decoded to %+v, %v; want %+v", got, err, tt.want)
+			}
+
+			payload, err := proto.Marshal(tt.proto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = formatProto.decodeCommand(payload)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("protobuf decoded to %+v, %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCommandErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   wireFormat
+		payload  []byte
+		wantType string // "" when the frame cannot be read at all
+		wantErr  bool
+	}{
+		{"not JSON", formatJSON, []byte("not json"), "", true},
+		{"JSON without a type", formatJSON, []byte(`{"data":{}}`), "", true},
+		{"unknown field", formatJSON, []byte(`{"type":"message.send","data":{"kind":"dm","content":"hi","colour":"red"}}`), "message.send", true},
+		{"unknown command", formatJSON, []byte(`{"type":"message.delete","data":{}}`), "message.delete", false},
+		{"not protobuf", formatProto, []byte("not protobuf"), "", true},
+		{"server frame", formatProto, mustMarshal(t, &chatv1.Frame{Body: &chatv1.Frame_Welcome{Welcome: &chatv1.Welcome{}}}), "welcome", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := tt.format.decodeCommand(tt.payload)
+			if cmd.Type != tt.wantType || (err != nil) != tt.wantErr {
+				t.Errorf("decoded to %+v, %v; want type %q, error %v", cmd, err, tt.wantType, tt.wantErr)
+			}
+			if cmd.Data != nil && tt.wantErr {
+				t.Errorf("data %+v decoded from an invalid frame", cmd.Data)
+			}
+		})
+	}
+}
+
+// Every event encodes to a JSON frame its schema accepts and a protobuf frame
+// with the same seq and body, and to the original frame for legacy clients.
+func TestEncodeEvent(t *testing.T) {
+	raw := func(v interface{}) json.RawMessage {
+		data, _ := json.Marshal(v)
+		return data
+	}
+	message := models.Message{MessageMeta: models.MessageMeta{ID: "m1"}, From: "alice", To: "bob", Content: "edited", Timestamp: "2024-01-01T00:00:00Z"}
+
+	tests := []struct {
+		event     models.WSMessage
+		frameType string
+		data      interface{} // what the JSON data decodes to
+		proto     func(*chatv1.Frame) bool
+	}{
+		{
+			event:     models.WSMessage{Type: "dm", From: "alice", To: "bob", Content: "hi", ID: "m1", ClientID: "c1", Seq: 7, Timestamp: "2024-01-01T00:00:00Z"},
+			frameType: "message.new",
+			data: &models.MessageEvent{Kind: "dm", Message: models.Message{
+				MessageMeta: models.MessageMeta{ID: "m1", ClientID: "c1"}, From: "alice", To: "bob", Content: "hi", Timestamp: "2024-01-01T00:00:00Z",
+			}},
+			proto: func(f *chatv1.Frame) bool {
+				m := f.GetMessageNew()
+				return m.GetKind() == "dm" && m.GetMessage().GetId() == "m1" && m.GetMessage().GetContent() == "hi" && m.GetMessage().GetClientId() == "c1"
+			},
+		},
+		{
+			event:     models.WSMessage{Type: "message.edited", From: "alice", ID: "m1", Seq: 8, Data: raw(message)},
+			frameType: "message.edited",
+			data:      &message,
+			proto:     func(f *chatv1.Frame) bool { return f.GetMessageEdited().GetContent() == "edited" },
+		},
+		{
+			event:     models.WSMessage{Type: "reaction.added", From: "bob", ID: "m1", Seq: 9, Data: raw(models.Reaction{Emoji: "👍", Count: 2})},
+			frameType: "reaction.added",
+			data:      &models.ReactionEvent{MessageID: "m1", User: "bob", Emoji: "👍", Count: 2},
+			proto: func(f *chatv1.Frame) bool {
+				r := f.GetReactionAdded()
+				return r.GetMessageId() == "m1" && r.GetUser() == "bob" && r.GetEmoji() == "👍" && r.GetCount() == 2
+			},
+		},
+		{
+			event:     models.WSMessage{Type: "read.receipt", Seq: 10, Data: raw(models.ReadReceipt{Conversation: "dm:alice:bob", User: "bob", MessageID: "m1", ReadAt: "2024-01-01T00:00:00Z"})},
+			frameType: "read.receipt",
+			data:      &models.ReadReceipt{Conversation: "dm:alice:bob", User: "bob", MessageID: "m1", ReadAt: "2024-01-01T00:00:00Z"},
+			proto:     func(f *chatv1.Frame) bool { return f.GetReadReceipt().GetMessageId() == "m1" },
+		},
+		{
+			event:     models.WSMessage{Type: "presence", Data: raw(models.Presence{User: "bob", State: "away"})},
+			frameType: "presence",
+			data:      &models.Presence{User: "bob", State: "away"},
+			proto:     func(f *chatv1.Frame) bool { return f.GetPresence().GetState() == "away" },
+		},
+		{
+			event:     models.WSMessage{Type: "typing", Data: raw(models.TypingIndicator{Conversation: "dm:alice:bob", User: "alice", Typing: true, TTL: 6000})},
+			frameType: "typing",
+			data:      &models.TypingIndicator{Conversation: "dm:alice:bob", User: "alice", Typing: true, TTL: 6000},
+			proto:     func(f *chatv1.Frame) bool { return f.GetTyping().GetTyping() && f.GetTyping().GetTtlMs() == 6000 },
+		},
+		{
+			event:     models.WSMessage{Type: "unread", Data: raw(models.UnreadCounts{Total: 3, Conversations: map[string]int64{"dm:alice:bob": 3}})},
+			frameType: "unread",
+			data:      &models.UnreadCounts{Total: 3, Conversations: map[string]int64{"dm:alice:bob": 3}},
+			proto:     func(f *chatv1.Frame) bool { return f.GetUnread().GetConversations()["dm:alice:bob"] == 3 },
+		},
+		{
+			event:     models.WSMessage{Type: "resync", Content: "too far behind", Seq: 11},
+			frameType: "resync",
+			data:      &models.ResyncEvent{Reason: "too far behind"},
+			proto:     func(f *chatv1.Frame) bool { return f.GetResync().GetReason() == "too far behind" },
+		},
+		{
+			event:     models.WSMessage{Type: "going_away", Data: raw(models.GoingAwayEvent{ReconnectAfter: 1500})},
+			frameType: "going_away",
+			data:      &models.GoingAwayEvent{ReconnectAfter: 1500},
+			proto:     func(f *chatv1.Frame) bool { return f.GetGoingAway().GetReconnectAfterMs() == 1500 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event.Type, func(t *testing.T) {
+			payload, err := formatJSON.encodeEvent(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frame := validateFrame(t, payload)
+			if frame.Type != tt.frameType || frame.Seq != tt.event.Seq {
+				t.Errorf("JSON frame is %s with seq %d, want %s with seq %d", frame.Type, frame.Seq, tt.frameType, tt.event.Seq)
+			}
+			got := reflect.New(reflect.TypeOf(tt.data).Elem()).Interface()
+			if err := json.Unmarshal(frame.Data, got); err != nil || !reflect.DeepEqual(got, tt.data) {
+				t.Errorf("JSON data = %s, want %+v", frame.Data, tt.data)
+			}
+
+			payload, err = formatProto.encodeEvent(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pb chatv1.Frame
+			if err := proto.Unmarshal(payload, &pb); err != nil {
+				t.Fatal(err)
+			}
+			if pb.Seq != tt.event.Seq || !tt.proto(&pb) {
+				t.Errorf("protobuf frame = %v", &pb)
+			}
+
+			payload, err = formatLegacy.encodeEvent(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var legacy models.WSMessage
+			if err := json.Unmarshal(payload, &legacy); err != nil || !reflect.DeepEqual(legacy, tt.event) {
+				t.Errorf("legacy frame = %s, want %+v", payload, tt.event)
+			}
+		})
+	}
+}
+
+// Frames the server answers commands with encode in both v1 framings.
+func TestEncodeFrame(t *testing.T) {
+	tests := []struct {
+		frame serverFrame
+		proto func(*chatv1.Frame) bool
+	}{
+		{
+			frame: serverFrame{Type: "welcome", Data: &models.WelcomeEvent{Version: 1, Capabilities: []string{"typing"}, Device: "phone", PingInterval: 30000, MaxFrameSize: 65536}},
+			proto: func(f *chatv1.Frame) bool {
+				return f.GetWelcome().GetDevice() == "phone" && f.GetWelcome().GetMaxFrameSize() == 65536
+			},
+		},
+		{
+			frame: serverFrame{Type: "ack", Ref: "m1", Data: &models.AckEvent{ID: "id", ClientID: "c1", Timestamp: "2024-01-01T00:00:00Z"}},
+			proto: func(f *chatv1.Frame) bool { return f.GetAck().GetId() == "id" && f.GetAck().GetClientId() == "c1" },
+		},
+		{
+			frame: serverFrame{Type: "ack", Ref: "p1"},
+			proto: func(f *chatv1.Frame) bool { return f.GetAck() != nil },
+		},
+		{
+			frame: errorFrame("e1", errCodeUnknownCommand, "unknown command"),
+			proto: func(f *chatv1.Frame) bool { return f.GetError().GetCode() == errCodeUnknownCommand },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.frame.Type+"/"+tt.frame.Ref, func(t *testing.T) {
+			payload, err := formatJSON.encodeFrame(tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame := validateFrame(t, payload); frame.Ref != tt.frame.Ref {
+				t.Errorf("JSON frame has ref %q, want %q", frame.Ref, tt.frame.Ref)
+			}
+
+			payload, err = formatProto.encodeFrame(tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pb chatv1.Frame
+			if err := proto.Unmarshal(payload, &pb); err != nil {
+				t.Fatal(err)
+			}
+			if pb.Ref != tt.frame.Ref || !tt.proto(&pb) {
+				t.Errorf("protobuf frame = %v", &pb)
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+	payload, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// BenchmarkFanout pushes one broadcast through an outboundEvent to many
+// clients of each wire format, as the hub does: it is encoded and, with
+// permessage-deflate, compressed once for all of them.
+func BenchmarkFanout(b *testing.B) {
+	const clients = 1000
+	msg := models.WSMessage{
+		Type:      "broadcast",
+		From:      "announcer",
+		Content:   strings.Repeat("All hands meeting moved to the big room. ", 7)[:256],
+		ID:        "0b5e0d9e-3b0c-4f43-9a67-8f6f5d2f3a10",
+		Timestamp: "2024-01-01T00:00:00Z",
+		Seq:       1234,
+	}
+
+	for _, compress := range []bool{false, true} {
+		for _, subprotocol := range []string{"", models.ProtocolV1, models.ProtocolV1Proto} {
+			name := subprotocol
+			if name == "" {
+				name = "legacy"
+			}
+			if compress {
+				name += "/deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				conns := connectFleet(b, clients, subprotocol, compress)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ev := newOutboundEvent(msg)
+					for _, c := range conns {
+						if err := c.writePrepared(ev.prepared(c.format)); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*clients), "ns/client")
+			})
+		}
+	}
+}
+
+// connectFleet connects n clients speaking the subprotocol and returns the
+// server side of their connections. The clients discard what they read.
+func connectFleet(b *testing.B, n int, subprotocol string, compress bool) []*wsConn {
+	b.Helper()
+	accepted := make(chan *wsConn)
+	upgrader := websocket.Upgrader{Subprotocols: []string{models.ProtocolV1, models.ProtocolV1Proto}, EnableCompression: compress}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- newWSConn(conn, WebSocketConfig{WriteTimeout: 10 * time.Second, PongTimeout: time.Minute, MaxFrameSize: 64 << 10})
+	}))
+	b.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	if subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+	conns := make([]*wsConn, 0, n)
+	for i := 0; i < n; i++ {
+		client, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			b.Fatalf("client %d: %v", i, err)
+		}
+		c := <-accepted
+		conns = append(conns, c)
+		go func() {
+			for {
+				if _, _, err := client.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		b.Cleanup(func() {
+			c.shutdown(closeReasonShutdown)
+			client.Close()
+		})
+	}
+	return conns
+}
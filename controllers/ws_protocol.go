@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codes of v1 error frames that only the frame protocol has. They are
+// stable, like the codes shared with the other APIs (models.ErrCode*);
+// clients branch on them, not on the message.
+const (
+	errCodeHandshakeRequired  = "handshake_required"  // the first frame was not a hello
+	errCodeUnsupportedVersion = "unsupported_version" // the hello asked for a version the server does not speak
+	errCodeInvalidFrame       = "invalid_frame"       // a frame that cannot be read, or data that does not match the command
+	errCodeUnknownCommand     = "unknown_command"     // a frame type that is not a client command
+)
+
+// serverCapabilities are the capabilities this server offers to v1 clients.
+var serverCapabilities = []string{
+	models.CapabilityTyping,
+	models.CapabilityPresence,
+	models.CapabilityReceipts,
+	models.CapabilityReactions,
+	models.CapabilityThreads,
+}
+
+// eventCapabilities maps the event types of optional families to the
+// capability a client must ask for to receive them.
+var eventCapabilities = map[string]string{
+	"typing":           models.CapabilityTyping,
+	"presence":         models.CapabilityPresence,
+	"read.receipt":     models.CapabilityReceipts,
+	"reaction.added":   models.CapabilityReactions,
+	"reaction.removed": models.CapabilityReactions,
+	"thread.reply":     models.CapabilityThreads,
+}
+
+// handshake reads the hello that opens a v1 connection and agrees on the
+// capabilities. On a bad hello the client is sent an error frame and the
+// connection is closed with a protocol error.
+func handshake(conn *wsConn) (*models.HelloCommand, bool) {
+	fail := func(code, message string) (*models.HelloCommand, bool) {
+		conn.writeFrame(errorFrame("", code, message))
+		closeFrame := websocket.FormatCloseMessage(websocket.CloseProtocolError, message)
+		conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(conn.writeTimeout))
+		conn.shutdown(closeReasonHandshake)
+		return nil, false
+	}
+
+	messageType, payload, err := conn.ReadMessage()
+	if err != nil {
+		conn.shutdown(readErrorReason(err))
+		return nil, false
+	}
+	cmd, err := conn.format.decodeCommand(payload)
+	if messageType != conn.format.messageType() || cmd.Type != "hello" {
+		return fail(errCodeHandshakeRequired, "the first frame must be a hello")
+	}
+	if err != nil {
+		return fail(errCodeInvalidFrame, err.Error())
+	}
+	hello := cmd.Data.(*models.HelloCommand)
+	if hello.Version != models.ProtocolVersion {
+		return fail(errCodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported, use %d", hello.Version, models.ProtocolVersion))
+	}
+	if hello.Cursor != nil && *hello.Cursor < 0 {
+		return fail(errCodeInvalidFrame, "cursor must not be negative")
+	}
+
+	conn.capabilities = agreeCapabilities(hello.Capabilities)
+	return hello, true
+}
+
+// agreeCapabilities returns the capabilities asked for that the server
+// offers; the rest are ignored.
+func agreeCapabilities(asked []string) map[string]bool {
+	agreed := make(map[string]bool)
+	for _, capability := range asked {
+		for _, offered := range serverCapabilities {
+			if capability == offered {
+				agreed[capability] = true
+			}
+		}
+	}
+	return agreed
+}
+
+// welcomeFrame answers a successful hello.
+func (wsc *webSocketController) welcomeFrame(conn *wsConn) serverFrame {
+	welcome := &models.WelcomeEvent{
+		Version:      models.ProtocolVersion,
+		Capabilities: []string{},
+		Device:       conn.device,
+		PingInterval: wsc.config.PingInterval.Milliseconds(),
+		MaxFrameSize: wsc.config.MaxFrameSize,
+	}
+	for _, capability := range serverCapabilities {
+		if conn.capabilities[capability] {
+			welcome.Capabilities = append(welcome.Capabilities, capability)
+		}
+	}
+	return serverFrame{Type: "welcome", Data: welcome}
+}
+
+// readCommands runs the read loop of a v1 connection, answering every command
+// with an ack or an error frame. Frames that cannot be parsed are answered
+// too, rather than closing the connection.
+func (wsc *webSocketController) readCommands(conn *wsConn, typing *typingState) error {
+	for {
+		messageType, payload, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		// Any frame proves the client is alive, not only pongs
+		conn.SetReadDeadline(time.Now().Add(wsc.config.PongTimeout))
+
+		if messageType != conn.format.messageType() {
+			conn.writeFrame(errorFrame("", errCodeInvalidFrame, "frames of this subprotocol are sent as "+messageTypeName(conn.format.messageType())+" messages"))
+			continue
+		}
+		cmd, err := conn.format.decodeCommand(payload)
+		if cmd.Type == "" {
+			conn.writeFrame(errorFrame("", errCodeInvalidFrame, err.Error()))
+			continue
+		}
+		var answer serverFrame
+		if err != nil {
+			answer = errorFrame(cmd.Ref, errCodeInvalidFrame, err.Error())
+		} else {
+			answer = wsc.handleCommand(conn, typing, cmd)
+		}
+		if err := conn.writeFrame(answer); err != nil {
+			return err
+		}
+	}
+}
+
+// handleCommand carries out a v1 command and returns the frame answering it.
+func (wsc *webSocketController) handleCommand(conn *wsConn, typing *typingState, frame command) serverFrame {
+	username := conn.username
+	ack := serverFrame{Type: "ack", Ref: frame.Ref}
+
+	switch cmd := frame.Data.(type) {
+	case *models.SendMessageCommand:
+		if cmd.Kind != "dm" && cmd.Kind != "group" && cmd.Kind != "broadcast" {
+			return errorFrame(frame.Ref, models.ErrCodeInvalidRequest, "kind must be dm, group or broadcast")
+		}
+		msg := models.WSMessage{Type: cmd.Kind, From: username, To: cmd.To, Content: cmd.Content, ClientID: cmd.ClientID, ParentID: cmd.ParentID, Attachments: cmd.Attachments}
+		sent, err := wsc.handleMessage(msg)
+		if err != nil {
+			return errorFrame(frame.Ref, errorCode(err), wsErrorText(conn, err, cmd.Kind))
+		}
+		if conversationID := typingConversation(msg); conversationID != "" {
+			wsc.stopTyping(typing, username, conversationID)
+		}
+		ack.Data = &models.AckEvent{ID: sent.ID, ClientID: sent.ClientID, Timestamp: sent.Timestamp}
+		return ack
+
+	case *models.SetPresenceCommand:
+		if _, err := wsc.handleMessage(models.WSMessage{Type: "presence", From: username, Content: cmd.State}); err != nil {
+			return errorFrame(frame.Ref, errorCode(err), wsErrorText(conn, err, "presence"))
+		}
+		return ack
+
+	case *models.TypingCommand:
+		msg := models.WSMessage{Type: "typing", From: username, To: cmd.Conversation}
+		if frame.Type == "typing.stop" {
+			msg.Content = "stop"
+		}
+		if err := wsc.handleTyping(typing, username, msg); err != nil {
+			return errorFrame(frame.Ref, errorCode(err), wsErrorText(conn, err, "typing"))
+		}
+		return ack
+
+	case *models.HelloCommand:
+		return errorFrame(frame.Ref, errCodeInvalidFrame, "hello is only sent once, to open the connection")
+
+	default:
+		return errorFrame(frame.Ref, errCodeUnknownCommand, fmt.Sprintf("unknown command %q", frame.Type))
+	}
+}
+
+// decodeData unmarshals the data of a command, rejecting fields the command
+// does not have.
+func decodeData(frame models.Frame, v interface{}) error {
+	data := frame.Data
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid %s data: %v", frame.Type, err)
+	}
+	return nil
+}
+
+func errorFrame(ref, code, message string) serverFrame {
+	return serverFrame{Type: "error", Ref: ref, Data: &models.ErrorEvent{Code: code, Message: message}}
+}
+
+func messageTypeName(messageType int) string {
+	if messageType == websocket.BinaryMessage {
+		return "binary"
+	}
+	return "text"
+}
+
+// wantsEvent reports whether a v1 client asked for the capability of an
+// event type.
+func wantsEvent(eventType string, capabilities map[string]bool) bool {
+	capability, ok := eventCapabilities[eventType]
+	return !ok || capabilities[capability]
+}
+
+// eventFrame turns an event into its v1 frame. The data of events that carry
+// a payload is decoded into its models type, so every wire format can encode
+// it; payloads of unknown types are passed through as JSON.
+func eventFrame(msg models.WSMessage) serverFrame {
+	frame := serverFrame{Type: msg.Type, Seq: msg.Seq}
+	var data interface{}
+	switch msg.Type {
+	case "dm", "group", "broadcast":
+		frame.Type = "message.new"
+		frame.Data = &models.MessageEvent{Kind: msg.Type, Message: models.Message{
+			MessageMeta: models.MessageMeta{ID: msg.ID, ClientID: msg.ClientID, ParentID: msg.ParentID, Attachments: msg.Attachments},
+			From:        msg.From,
+			To:          msg.To,
+			Group:       msg.Group,
+			Content:     msg.Content,
+			Timestamp:   msg.Timestamp,
+		}}
+		return frame
+	case "reaction.added", "reaction.removed":
+		var reaction models.Reaction
+		json.Unmarshal(msg.Data, &reaction)
+		frame.Data = &models.ReactionEvent{MessageID: msg.ID, User: msg.From, Emoji: reaction.Emoji, Count: reaction.Count}
+		return frame
+	case "resync":
+		frame.Data = &models.ResyncEvent{Reason: msg.Content}
+		return frame
+	case "message.edited", "message.deleted", "thread.reply":
+		data = &models.Message{}
+	case "read.receipt":
+		data = &models.ReadReceipt{}
+	case "presence":
+		data = &models.Presence{}
+	case "typing":
+		data = &models.TypingIndicator{}
+	case "unread":
+		data = &models.UnreadCounts{}
+	case "going_away":
+		data = &models.GoingAwayEvent{}
+	}
+
+	if data != nil && json.Unmarshal(msg.Data, data) == nil {
+		frame.Data = data
+	} else if len(msg.Data) > 0 {
+		frame.Data = msg.Data
+	}
+	return frame
+}
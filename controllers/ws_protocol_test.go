@@ -0,0 +1,370 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/haileamlak/chat-system/models"
+	chatv1 "github.com/haileamlak/chat-system/protocol/v1"
+)
+
+// v1Client is a v1 connection that validates every JSON frame in both
+// directions against its schema.
+type v1Client struct {
+	t    *testing.T
+	conn *websocket.Conn
+	// requestID is the X-Request-ID of the upgrade, which error frames carry
+	requestID string
+}
+
+func (n *testNode) dialV1(t *testing.T, token string, subprotocols ...string) *v1Client {
+	t.Helper()
+	conn, resp := n.upgrade(t, token, subprotocols...)
+	return &v1Client{t: t, conn: conn, requestID: resp.Header.Get("X-Request-ID")}
+}
+
+// connect opens a v1 connection and completes the handshake.
+func (n *testNode) connect(t *testing.T, token string, hello models.HelloCommand) (*v1Client, models.WelcomeEvent) {
+	t.Helper()
+	c := n.dialV1(t, token, models.ProtocolV1)
+	c.send("hello", "", hello)
+	var welcome models.WelcomeEvent
+	json.Unmarshal(c.expect("welcome").Data, &welcome)
+	c.expect("unread")
+	return c, welcome
+}
+
+// send writes a command after checking it against its own schema, so the
+// schemas are known to accept what clients send.
+func (c *v1Client) send(frameType, ref string, data interface{}) {
+	c.t.Helper()
+	raw, _ := json.Marshal(data)
+	payload, _ := json.Marshal(models.Frame{Type: frameType, Ref: ref, Data: raw})
+	validateFrame(c.t, payload)
+	c.write(websocket.TextMessage, payload)
+}
+
+func (c *v1Client) write(messageType int, payload []byte) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(messageType, payload); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads the next frame and fails unless it has the given type.
+func (c *v1Client) expect(frameType string) models.Frame {
+	c.t.Helper()
+	_, payload, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("waiting for %s: %v", frameType, err)
+	}
+	frame := validateFrame(c.t, payload)
+	if frame.Type != frameType {
+		c.t.Fatalf("expected a %s frame, got %s: %s", frameType, frame.Type, frame.Data)
+	}
+	return frame
+}
+
+// expectError reads the next frame and fails unless it is an error with the
+// given ref and code, carrying the ID of the connection's upgrade request.
+func (c *v1Client) expectError(ref, code string) {
+	c.t.Helper()
+	frame := c.expect("error")
+	var e models.ErrorEvent
+	json.Unmarshal(frame.Data, &e)
+	if frame.Ref != ref || e.Code != code {
+		c.t.Errorf("expected error %s for ref %q, got %s for ref %q: %s", code, ref, e.Code, frame.Ref, e.Message)
+	}
+	if c.requestID == "" || e.RequestID != c.requestID {
+		c.t.Errorf("expected error %s to carry the request ID %q, got %q", code, c.requestID, e.RequestID)
+	}
+}
+
+func (c *v1Client) expectClose(code int) {
+	c.t.Helper()
+	if _, _, err := c.conn.ReadMessage(); !websocket.IsCloseError(err, code) {
+		c.t.Errorf("expected close code %d, got %v", code, err)
+	}
+}
+
+// sendProto writes a binary frame.
+func (c *v1Client) sendProto(frame *chatv1.Frame) {
+	c.t.Helper()
+	payload, err := proto.Marshal(frame)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.write(websocket.BinaryMessage, payload)
+}
+
+// nextProto reads the next frame and fails unless it is a binary Frame.
+func (c *v1Client) nextProto() *chatv1.Frame {
+	c.t.Helper()
+	messageType, payload, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage {
+		c.t.Fatalf("expected a binary frame, got %s", payload)
+	}
+	var frame chatv1.Frame
+	if err := proto.Unmarshal(payload, &frame); err != nil {
+		c.t.Fatal(err)
+	}
+	return &frame
+}
+
+// connectProto opens a binary v1 connection and completes the handshake.
+func (n *testNode) connectProto(t *testing.T, token, device string) *v1Client {
+	t.Helper()
+	c := n.dialV1(t, token, models.ProtocolV1Proto)
+	if got := c.conn.Subprotocol(); got != models.ProtocolV1Proto {
+		t.Fatalf("server chose subprotocol %q, want %q", got, models.ProtocolV1Proto)
+	}
+	c.sendProto(&chatv1.Frame{Body: &chatv1.Frame_Hello{Hello: &chatv1.Hello{Version: models.ProtocolVersion, Device: device}}})
+	if welcome := c.nextProto().GetWelcome(); welcome.GetVersion() != models.ProtocolVersion || welcome.GetDevice() != device {
+		t.Fatalf("unexpected welcome %v", welcome)
+	}
+	if frame := c.nextProto(); frame.GetUnread() == nil {
+		t.Fatalf("expected unread, got %v", frame)
+	}
+	return c
+}
+
+func TestSubprotocolIsNegotiated(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	conn := node.dial(t, node.login(t, "alice"), "chat.v9", models.ProtocolV1)
+	if got := conn.Subprotocol(); got != models.ProtocolV1 {
+		t.Errorf("server chose subprotocol %q, want %q", got, models.ProtocolV1)
+	}
+}
+
+func TestFirstFrameMustBeHello(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	c := node.dialV1(t, node.login(t, "alice"), models.ProtocolV1)
+	c.send("presence.set", "p1", models.SetPresenceCommand{State: "away"})
+	c.expectError("", errCodeHandshakeRequired)
+	c.expectClose(websocket.CloseProtocolError)
+}
+
+func TestUnsupportedVersionIsRefused(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	c := node.dialV1(t, node.login(t, "alice"), models.ProtocolV1)
+	// Sent raw, as the hello schema itself only allows version 1
+	c.write(websocket.TextMessage, []byte(`{"type":"hello","data":{"version":2}}`))
+	c.expectError("", errCodeUnsupportedVersion)
+	c.expectClose(websocket.CloseProtocolError)
+}
+
+func TestMessageSendIsAckedAndDelivered(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	a, welcome := node.connect(t, node.login(t, "alice"), models.HelloCommand{Version: models.ProtocolVersion, Device: "phone"})
+	if welcome.Version != models.ProtocolVersion || welcome.Device != "phone" {
+		t.Errorf("unexpected welcome %+v", welcome)
+	}
+	b, _ := node.connect(t, node.login(t, "bob"), models.HelloCommand{Version: models.ProtocolVersion})
+
+	a.send("message.send", "m1", models.SendMessageCommand{Kind: "dm", To: "bob", Content: "hello", ClientID: "c1"})
+	frame := a.expect("ack")
+	var ack models.AckEvent
+	json.Unmarshal(frame.Data, &ack)
+	if frame.Ref != "m1" || ack.ID == "" || ack.ClientID != "c1" {
+		t.Fatalf("unexpected ack %s for ref %q", frame.Data, frame.Ref)
+	}
+
+	frame = b.expect("message.new")
+	var msg models.MessageEvent
+	json.Unmarshal(frame.Data, &msg)
+	if msg.ID != ack.ID || msg.Kind != "dm" || msg.From != "alice" || msg.Content != "hello" || frame.Seq == 0 {
+		t.Errorf("unexpected message.new %s with seq %d", frame.Data, frame.Seq)
+	}
+}
+
+func TestBadCommandsGetErrorFrames(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	a, _ := node.connect(t, node.login(t, "alice"), models.HelloCommand{Version: models.ProtocolVersion})
+	node.login(t, "bob")
+
+	// Sent raw, as there are no schemas for frames that are not commands
+	a.write(websocket.TextMessage, []byte(`{"type":"message.delete","ref":"e1","data":{}}`))
+	a.expectError("e1", errCodeUnknownCommand)
+
+	a.write(websocket.TextMessage, []byte(`{"type":"message.send","ref":"e2","data":{"kind":"dm","to":"bob","content":"hi","colour":"red"}}`))
+	a.expectError("e2", errCodeInvalidFrame)
+
+	a.write(websocket.TextMessage, []byte(`not json`))
+	a.expectError("", errCodeInvalidFrame)
+
+	a.send("message.send", "e3", models.SendMessageCommand{Kind: "dm", To: "bob", Content: "reply", ParentID: "no-such-message"})
+	a.expectError("e3", "invalid_request")
+
+	a.send("hello", "e4", models.HelloCommand{Version: models.ProtocolVersion})
+	a.expectError("e4", errCodeInvalidFrame)
+}
+
+func TestEventsFollowCapabilities(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	a, _ := node.connect(t, node.login(t, "alice"), models.HelloCommand{Version: models.ProtocolVersion})
+	bobToken := node.login(t, "bob")
+	typing, welcome := node.connect(t, bobToken, models.HelloCommand{Version: models.ProtocolVersion, Capabilities: []string{models.CapabilityTyping, "teleport"}})
+	if len(welcome.Capabilities) != 1 || welcome.Capabilities[0] != models.CapabilityTyping {
+		t.Errorf("welcome agreed to %v, want only typing", welcome.Capabilities)
+	}
+	plain, _ := node.connect(t, bobToken, models.HelloCommand{Version: models.ProtocolVersion})
+
+	a.send("typing.start", "t1", models.TypingCommand{Conversation: "dm:alice:bob"})
+	if frame := a.expect("ack"); frame.Ref != "t1" {
+		t.Errorf("typing.start acked as %q", frame.Ref)
+	}
+	typing.expect("typing")
+
+	// The connection without the capability gets the message and nothing
+	// before it
+	a.send("message.send", "t2", models.SendMessageCommand{Kind: "dm", To: "bob", Content: "done typing"})
+	a.expect("ack")
+	plain.expect("message.new")
+}
+
+func TestPresenceSetIsAckedAndAnnounced(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	a, _ := node.connect(t, node.login(t, "alice"), models.HelloCommand{Version: models.ProtocolVersion})
+	b, _ := node.connect(t, node.login(t, "bob"), models.HelloCommand{Version: models.ProtocolVersion, Capabilities: []string{models.CapabilityPresence}})
+
+	// Presence goes to contacts only
+	a.send("message.send", "s0", models.SendMessageCommand{Kind: "dm", To: "bob", Content: "hi"})
+	a.expect("ack")
+
+	a.send("presence.set", "s1", models.SetPresenceCommand{State: "away"})
+	if frame := a.expect("ack"); frame.Ref != "s1" {
+		t.Errorf("presence.set acked as %q", frame.Ref)
+	}
+	for {
+		_, payload, err := b.conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for presence: %v", err)
+		}
+		frame := validateFrame(t, payload)
+		var presence models.Presence
+		json.Unmarshal(frame.Data, &presence)
+		if frame.Type == "presence" && presence.User == "alice" && presence.State == "away" {
+			break
+		}
+	}
+
+	a.send("presence.set", "s2", models.SetPresenceCommand{State: "online"})
+	a.expect("ack")
+}
+
+func TestHelloCursorReplaysMissedEvents(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	aliceToken := node.login(t, "alice")
+	a, _ := node.connect(t, aliceToken, models.HelloCommand{Version: models.ProtocolVersion})
+	b, _ := node.connect(t, node.login(t, "bob"), models.HelloCommand{Version: models.ProtocolVersion})
+
+	// Alice is up to date, then misses one message
+	b.send("message.send", "r1", models.SendMessageCommand{Kind: "dm", To: "alice", Content: "seen"})
+	b.expect("ack")
+	cursor := a.expect("message.new").Seq
+	a.conn.Close()
+	b.send("message.send", "r2", models.SendMessageCommand{Kind: "dm", To: "alice", Content: "while you were away"})
+	b.expect("ack")
+
+	a, _ = node.connect(t, aliceToken, models.HelloCommand{Version: models.ProtocolVersion, Cursor: &cursor})
+	frame := a.expect("message.new")
+	var msg models.MessageEvent
+	json.Unmarshal(frame.Data, &msg)
+	if msg.Content != "while you were away" || frame.Seq <= cursor {
+		t.Errorf("replayed %s with seq %d after cursor %d", frame.Data, frame.Seq, cursor)
+	}
+}
+
+// A cursor the event log cannot serve gets a resync frame carrying the seq to
+// resume from once the client has refetched its history.
+func TestHelloCursorTooOldGetsResync(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	aliceToken := node.login(t, "alice")
+	a, _ := node.connect(t, aliceToken, models.HelloCommand{Version: models.ProtocolVersion})
+	b, _ := node.connect(t, node.login(t, "bob"), models.HelloCommand{Version: models.ProtocolVersion})
+	b.send("message.send", "r1", models.SendMessageCommand{Kind: "dm", To: "alice", Content: "seen"})
+	b.expect("ack")
+	latest := a.expect("message.new").Seq
+	a.conn.Close()
+
+	// The cursor is from before the event log was reset
+	stale := latest + 100
+	a, _ = node.connect(t, aliceToken, models.HelloCommand{Version: models.ProtocolVersion, Cursor: &stale})
+	frame := a.expect("resync")
+	var resync models.ResyncEvent
+	json.Unmarshal(frame.Data, &resync)
+	if frame.Seq != latest || resync.Reason == "" {
+		t.Errorf("resync %s with seq %d, want seq %d", frame.Data, frame.Seq, latest)
+	}
+}
+
+func TestClientsWithoutSubprotocolKeepOriginalFrames(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	node.login(t, "bob")
+	conn := node.dial(t, node.login(t, "alice"))
+	if got := conn.Subprotocol(); got != "" {
+		t.Errorf("server chose subprotocol %q for a client that asked for none", got)
+	}
+
+	var frame models.WSMessage
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "unread" {
+		t.Fatalf("first frame = %+v, %v; want unread", frame, err)
+	}
+	conn.WriteJSON(models.WSMessage{Type: "dm", To: "bob", Content: "legacy", ClientID: "l1"})
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "ack" || frame.ClientID != "l1" {
+		t.Errorf("expected an original ack frame, got %+v: %v", frame, err)
+	}
+}
+
+func TestBinaryClientsMustOpenWithBinaryHello(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	c := node.dialV1(t, node.login(t, "alice"), models.ProtocolV1Proto)
+	c.write(websocket.TextMessage, []byte(`{"type":"hello","data":{"version":1}}`))
+	if frame := c.nextProto(); frame.GetError().GetCode() != errCodeHandshakeRequired {
+		t.Errorf("expected a handshake_required error, got %v", frame)
+	}
+	c.expectClose(websocket.CloseProtocolError)
+}
+
+// A message from a binary client reaches a user connected on two devices, one
+// per framing, as the same message on both.
+func TestBinaryFramesCarrySameMessages(t *testing.T) {
+	node := newTestNode(t, miniredis.RunT(t), "node-a")
+	a := node.connectProto(t, node.login(t, "alice"), "phone")
+	bobToken := node.login(t, "bob")
+	bin := node.connectProto(t, bobToken, "phone")
+	text, _ := node.connect(t, bobToken, models.HelloCommand{Version: models.ProtocolVersion, Device: "desktop"})
+
+	send := &chatv1.SendMessage{Kind: "dm", To: "bob", Content: "binary hello", ClientId: "pb1"}
+	a.sendProto(&chatv1.Frame{Ref: "b1", Body: &chatv1.Frame_MessageSend{MessageSend: send}})
+	frame := a.nextProto()
+	ack := frame.GetAck()
+	if frame.Ref != "b1" || ack.GetId() == "" || ack.GetClientId() != "pb1" {
+		t.Fatalf("unexpected ack %v", frame)
+	}
+
+	frame = bin.nextProto()
+	msg := frame.GetMessageNew()
+	if msg.GetKind() != "dm" || msg.GetMessage().GetId() != ack.GetId() || msg.GetMessage().GetFrom() != "alice" || msg.GetMessage().GetContent() != "binary hello" || frame.Seq == 0 {
+		t.Errorf("unexpected message_new %v", frame)
+	}
+
+	jsonFrame := text.expect("message.new")
+	var event models.MessageEvent
+	json.Unmarshal(jsonFrame.Data, &event)
+	if event.ID != ack.GetId() || jsonFrame.Seq != frame.Seq {
+		t.Errorf("JSON client got %s with seq %d, binary client message %s with seq %d", jsonFrame.Data, jsonFrame.Seq, ack.GetId(), frame.Seq)
+	}
+
+	a.sendProto(&chatv1.Frame{Ref: "b2", Body: &chatv1.Frame_Welcome{Welcome: &chatv1.Welcome{}}})
+	if frame := a.nextProto(); frame.Ref != "b2" || frame.GetError().GetCode() != errCodeUnknownCommand {
+		t.Errorf("expected an unknown_command error for ref b2, got %v", frame)
+	}
+}
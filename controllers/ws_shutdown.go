@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+func (wsc *webSocketController) isDraining() bool {
+	wsc.mu.RLock()
+	defer wsc.mu.RUnlock()
+	return wsc.draining
+}
+
+// Shutdown drains the node. New upgrades are refused, and every client is
+// told to reconnect after a random delay within the reconnect window and sent
+// a going-away close frame once its in-flight write is done. When the clients
+// have closed, or ctx expires and the rest are cut off, the node's pub/sub
+// subscription is closed. Redis is left for the caller to close.
+func (wsc *webSocketController) Shutdown(ctx context.Context) error {
+	wsc.mu.Lock()
+	if wsc.draining {
+		wsc.mu.Unlock()
+		return nil
+	}
+	wsc.draining = true
+	wsc.mu.Unlock()
+	conns := wsc.connectedClients()
+	close(wsc.stop)
+
+	log.Println("Draining", len(conns), "WebSocket connections")
+	for _, conn := range conns {
+		go conn.goAway(reconnectDelay(wsc.config.ReconnectWindow))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		wsc.connections.Wait()
+		close(closed)
+	}()
+
+	var err error
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		err = ctx.Err()
+		for _, conn := range conns {
+			conn.shutdown(closeReasonShutdown)
+		}
+	}
+
+	if err := wsc.subscriber.Close(); err != nil {
+		log.Println("Failed to close the Redis subscription:", err)
+	}
+	return err
+}
+
+// reconnectDelay picks when a client should reconnect, so that a node going
+// away does not have every client reconnect at the same moment.
+func reconnectDelay(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
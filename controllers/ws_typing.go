@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+// maxTypingConversations caps how many conversations one connection can show
+// as typing in at the same time.
+const maxTypingConversations = 10
+
+// typingState tracks the indicators a single connection has relayed, so that
+// they can be capped and cleared when the user sends a message or
+// disconnects. It is only touched by the connection's read loop.
+type typingState struct {
+	relayedAt map[string]time.Time // conversation ID -> last relayed start
+}
+
+func newTypingState() *typingState {
+	return &typingState{relayedAt: make(map[string]time.Time)}
+}
+
+// handleTyping relays a typing frame. The client sends { "type": "typing",
+// "to": "<conversation ID>" } while typing and adds "content": "stop" when it
+// gives up; the use case drops starts arriving faster than the typing
+// interval.
+func (wsc *webSocketController) handleTyping(state *typingState, username string, msg models.WSMessage) error {
+	now := time.Now()
+	for conversationID, at := range state.relayedAt {
+		if now.Sub(at) >= wsc.config.TypingTTL {
+			delete(state.relayedAt, conversationID)
+		}
+	}
+
+	if msg.Content == "stop" {
+		wsc.stopTyping(state, username, msg.To)
+		return nil
+	}
+
+	if _, ok := state.relayedAt[msg.To]; !ok && len(state.relayedAt) >= maxTypingConversations {
+		return nil
+	}
+
+	if err := wsc.typingUseCase.StartTyping(context.Background(), username, msg.To); err != nil {
+		return err
+	}
+	state.relayedAt[msg.To] = now
+	return nil
+}
+
+// stopTyping clears the user's indicator in a conversation if one is showing.
+func (wsc *webSocketController) stopTyping(state *typingState, username, conversationID string) {
+	if _, ok := state.relayedAt[conversationID]; !ok {
+		return
+	}
+	delete(state.relayedAt, conversationID)
+
+	if err := wsc.typingUseCase.StopTyping(context.Background(), username, conversationID); err != nil {
+		log.Println("Failed to clear typing of", username, ":", err)
+	}
+}
+
+// stopAllTyping clears every indicator of a connection that is going away.
+func (wsc *webSocketController) stopAllTyping(state *typingState, username string) {
+	for conversationID := range state.relayedAt {
+		wsc.stopTyping(state, username, conversationID)
+	}
+}
+
+// typingConversation returns the conversation a sent message clears the
+// typing indicator of, or "" for messages without one.
+func typingConversation(msg models.WSMessage) string {
+	switch msg.Type {
+	case "dm":
+		return usecases.DMConversationID(msg.From, msg.To)
+	case "group":
+		return usecases.GroupConversationID(msg.To)
+	default:
+		return ""
+	}
+}
@@ -1,14 +1,29 @@
 package infrastructure
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type AuthMiddleware interface {
 	Authenticate() gin.HandlerFunc
+	// UnaryInterceptor and StreamInterceptor authenticate gRPC calls the same
+	// way, from the "authorization" metadata. Methods listed as public, by
+	// full name, are let through without a token.
+	UnaryInterceptor(public ...string) grpc.UnaryServerInterceptor
+	StreamInterceptor(public ...string) grpc.StreamServerInterceptor
+	// AuthenticateToken returns the user of an "Bearer <token>" value sent
+	// outside the Authorization header, such as in the connection_init
+	// message of a GraphQL subscription.
+	AuthenticateToken(authorization string) (string, error)
 }
 
 type authMiddleware struct {
@@ -25,14 +40,14 @@ func (m *authMiddleware) Authenticate() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid Authorization header"})
+			AbortWithProblem(c, http.StatusUnauthorized, "Missing or invalid Authorization header")
 			return
 		}
 
 		token := strings.TrimPrefix(authHeader, "Bearer ")
 		username, err := m.tokenService.ValidateToken(token)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session token"})
+			AbortWithProblem(c, http.StatusUnauthorized, "Invalid or expired session token")
 			return
 		}
 
@@ -40,3 +55,90 @@ func (m *authMiddleware) Authenticate() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func (m *authMiddleware) UnaryInterceptor(public ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if isPublic(info.FullMethod, public) {
+			return handler(ctx, req)
+		}
+		ctx, err := m.authenticateCall(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (m *authMiddleware) StreamInterceptor(public ...string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isPublic(info.FullMethod, public) {
+			return handler(srv, ss)
+		}
+		ctx, err := m.authenticateCall(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticateCall validates the bearer token of a gRPC call and returns its
+// context carrying the user.
+func (m *authMiddleware) authenticateCall(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || !strings.HasPrefix(values[0], "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "Missing or invalid authorization metadata")
+	}
+
+	username, err := m.tokenService.ValidateToken(strings.TrimPrefix(values[0], "Bearer "))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid or expired session token")
+	}
+	return ContextWithUser(ctx, username), nil
+}
+
+func isPublic(method string, public []string) bool {
+	for _, p := range public {
+		if method == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *authMiddleware) AuthenticateToken(authorization string) (string, error) {
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", errors.New("Missing or invalid authorization")
+	}
+	username, err := m.tokenService.ValidateToken(strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil {
+		return "", errors.New("Invalid or expired session token")
+	}
+	return username, nil
+}
+
+type userKey struct{}
+
+// ContextWithUser returns a context carrying the user, for UserFromContext.
+func ContextWithUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, userKey{}, username)
+}
+
+// UserFromContext returns the user a gRPC call or GraphQL operation was
+// authenticated as.
+func UserFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(userKey{}).(string)
+	return username
+}
+
+// contextStream is a server stream with a context of its own, such as one
+// carrying the user.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
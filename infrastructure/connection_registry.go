@@ -0,0 +1,81 @@
+package infrastructure
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ConnectionRegistry records which nodes the devices of every connected user
+// are on, so that events are only published to the nodes holding their
+// recipients. Entries expire unless they are registered again within the TTL,
+// which clears the connections of nodes that died.
+type ConnectionRegistry interface {
+	NodeID() string
+	Register(ctx context.Context, user, device string) error
+	Unregister(ctx context.Context, user, device string) error
+	Nodes(ctx context.Context, user string) ([]string, error)
+}
+
+type connectionRegistry struct {
+	redisService RedisService
+	nodeID       string
+	ttl          time.Duration
+}
+
+// creates a registry for the connections of this node. Node IDs must not
+// contain a slash.
+func NewConnectionRegistry(redisService RedisService, nodeID string, ttl time.Duration) ConnectionRegistry {
+	return &connectionRegistry{redisService: redisService, nodeID: nodeID, ttl: ttl}
+}
+
+func (r *connectionRegistry) NodeID() string {
+	return r.nodeID
+}
+
+// records or refreshes a device of the user as connected to this node
+func (r *connectionRegistry) Register(ctx context.Context, user, device string) error {
+	expiry := time.Now().Add(r.ttl).UnixMilli()
+	member := r.nodeID + "/" + device
+	return r.redisService.GetClient().ZAdd(ctx, "connections:user:"+user, &redis.Z{Score: float64(expiry), Member: member}).Err()
+}
+
+func (r *connectionRegistry) Unregister(ctx context.Context, user, device string) error {
+	return r.redisService.GetClient().ZRem(ctx, "connections:user:"+user, r.nodeID+"/"+device).Err()
+}
+
+// returns the nodes holding a live connection of the user, dropping the
+// entries that expired
+func (r *connectionRegistry) Nodes(ctx context.Context, user string) ([]string, error) {
+	key := "connections:user:" + user
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	var live *redis.StringSliceCmd
+	_, err := r.redisService.GetClient().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+now)
+		live = pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: now, Max: "+inf"})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []string{}
+	seen := map[string]bool{}
+	for _, member := range live.Val() {
+		node := strings.SplitN(member, "/", 2)[0]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// NodeChannel is the pub/sub channel a node receives its targeted events on.
+func NodeChannel(nodeID string) string {
+	return "channel:node:" + nodeID
+}
@@ -0,0 +1,48 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/haileamlak/chat-system/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProblemContentType is the media type of problem responses.
+const ProblemContentType = "application/problem+json"
+
+// AbortWithProblem ends a request with an error response: a problem whose
+// code follows from the status, carrying the request's ID.
+func AbortWithProblem(c *gin.Context, status int, detail string) {
+	problem := models.Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  c.Request.URL.Path,
+		Code:      models.ErrorCode(status),
+		RequestID: RequestIDFromContext(c.Request.Context()),
+	}
+	c.Abort()
+	c.Render(status, problemRender{problem})
+}
+
+// problemRender writes a problem as JSON with the problem content type.
+type problemRender struct {
+	problem models.Problem
+}
+
+func (r problemRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	body, err := json.Marshal(r.problem)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func (r problemRender) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ProblemContentType)
+}
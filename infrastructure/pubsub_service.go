@@ -0,0 +1,50 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+)
+
+type PubSubService interface {
+	Publish(ctx context.Context, channel string, payload interface{}) error
+	PublishToUser(ctx context.Context, user string, payload interface{}) error
+}
+
+type pubSubService struct {
+	redisService RedisService
+	registry     ConnectionRegistry
+}
+
+// creates a new pub/sub service backed by Redis
+func NewPubSubService(redisService RedisService, registry ConnectionRegistry) PubSubService {
+	return &pubSubService{redisService: redisService, registry: registry}
+}
+
+// publishes the JSON encoding of payload on the given channel
+func (s *pubSubService) Publish(ctx context.Context, channel string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.redisService.GetClient().Publish(ctx, channel, data).Err()
+}
+
+// publishes payload to the channels of the nodes the user is connected to;
+// nothing is sent while the user is offline
+func (s *pubSubService) PublishToUser(ctx context.Context, user string, payload interface{}) error {
+	nodes, err := s.registry.Nodes(ctx, user)
+	if err != nil || len(nodes) == 0 {
+		return err
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err := s.redisService.GetClient().Publish(ctx, NodeChannel(node), data).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package infrastructure
+
+import (
+	"context"
+
+	"github.com/haileamlak/chat-system/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// RequestIDHeader carries the ID of a request, in both directions. A client
+// may choose it; otherwise the server does.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the IDs clients may choose.
+const maxRequestIDLength = 128
+
+// ErrorDomain is the domain of the ErrorInfo attached to gRPC errors, whose
+// reason is the error code.
+const ErrorDomain = "chat-system"
+
+type requestIDKey struct{}
+
+// RequestID gives every request an ID, echoed in the X-Request-ID response
+// header and put in the problem of any error response.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := requestID(c.GetHeader(RequestIDHeader))
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(ContextWithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// RequestIDUnaryInterceptor and RequestIDStreamInterceptor do the same for
+// gRPC calls, with the "x-request-id" metadata. The ID is added to the
+// ErrorInfo of the call's error, and one is attached if the error has none.
+func RequestIDUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, id := callRequestID(ctx)
+		resp, err := handler(ctx, req)
+		return resp, withRequestID(err, id)
+	}
+}
+
+func RequestIDStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, id := callRequestID(ss.Context())
+		err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		return withRequestID(err, id)
+	}
+}
+
+// ContextWithRequestID returns a context carrying a request ID, for
+// RequestIDFromContext.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID of the request or gRPC call a context
+// belongs to.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the ID a client chose, if it is printable ASCII and not
+// too long, or else a new one.
+func requestID(chosen string) string {
+	if chosen == "" || len(chosen) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+	for i := 0; i < len(chosen); i++ {
+		if chosen[i] <= ' ' || chosen[i] > '~' {
+			return uuid.NewString()
+		}
+	}
+	return chosen
+}
+
+func callRequestID(ctx context.Context) (context.Context, string) {
+	var chosen string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(RequestIDHeader); len(values) > 0 {
+		chosen = values[0]
+	}
+	id := requestID(chosen)
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id))
+	return ContextWithRequestID(ctx, id), id
+}
+
+// grpcErrorCodes are the error codes of gRPC errors created without an
+// ErrorInfo.
+var grpcErrorCodes = map[codes.Code]string{
+	codes.InvalidArgument:    models.ErrCodeInvalidRequest,
+	codes.OutOfRange:         models.ErrCodeInvalidRequest,
+	codes.Unauthenticated:    models.ErrCodeUnauthorized,
+	codes.PermissionDenied:   models.ErrCodeForbidden,
+	codes.NotFound:           models.ErrCodeNotFound,
+	codes.AlreadyExists:      models.ErrCodeConflict,
+	codes.FailedPrecondition: models.ErrCodeConflict,
+	codes.ResourceExhausted:  models.ErrCodeRateLimited,
+	codes.Unavailable:        models.ErrCodeUnavailable,
+}
+
+// withRequestID adds the request ID to the ErrorInfo of a gRPC error.
+func withRequestID(err error, id string) error {
+	st, ok := status.FromError(err)
+	if err == nil || !ok {
+		return err
+	}
+	pb := st.Proto()
+	at := -1
+	info := &errdetails.ErrorInfo{}
+	for i, detail := range pb.Details {
+		if detail.MessageIs(info) && detail.UnmarshalTo(info) == nil {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		reason, ok := grpcErrorCodes[st.Code()]
+		if !ok {
+			reason = models.ErrCodeInternal
+		}
+		info = &errdetails.ErrorInfo{Reason: reason, Domain: ErrorDomain}
+	}
+	if info.Metadata == nil {
+		info.Metadata = make(map[string]string)
+	}
+	info.Metadata["request_id"] = id
+
+	detail, anyErr := anypb.New(info)
+	if anyErr != nil {
+		return err
+	}
+	if at < 0 {
+		pb.Details = append(pb.Details, detail)
+	} else {
+		pb.Details[at] = detail
+	}
+	return status.FromProto(pb).Err()
+}
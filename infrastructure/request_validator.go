@@ -0,0 +1,288 @@
+package infrastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// openAPIURL is where the OpenAPI document is loaded as a schema resource, so
+// that the schemas in it can be compiled by JSON pointer.
+const openAPIURL = "file:///openapi.json"
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// RequestValidator checks HTTP requests against the OpenAPI document that
+// describes them, so that handlers see only requests the document allows.
+type RequestValidator interface {
+	// Validate rejects requests whose parameters or JSON body do not match
+	// their operation with a 400. Routes must be registered for it to find
+	// the operation of a request.
+	Validate() gin.HandlerFunc
+	// CheckRoutes reports the routes the document does not describe, and the
+	// operations it describes that no route serves.
+	CheckRoutes(routes gin.RoutesInfo) error
+}
+
+type requestValidator struct {
+	operations map[string]*openAPIOperation // "GET /messages/{id}" -> operation
+}
+
+// openAPIOperation holds the compiled schemas of an operation's parameters
+// and JSON request body.
+type openAPIOperation struct {
+	parameters   []*openAPIParameter
+	body         *jsonschema.Schema // nil if the operation takes no JSON body
+	bodyRequired bool
+}
+
+type openAPIParameter struct {
+	Ref      string          `json:"$ref"`
+	Name     string          `json:"name"`
+	In       string          `json:"in"`
+	Required bool            `json:"required"`
+	Schema   json.RawMessage `json:"schema"`
+
+	schema   *jsonschema.Schema
+	dataType string // the schema's type, which query strings are converted to
+}
+
+// NewRequestValidator compiles the schemas of every operation of an OpenAPI
+// 3.1 document, whose schemas are JSON Schema 2020-12.
+func NewRequestValidator(spec []byte) (RequestValidator, error) {
+	var document struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Parameters map[string]*openAPIParameter `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &document); err != nil {
+		return nil, err
+	}
+	resource, err := jsonschema.UnmarshalJSON(bytes.NewReader(spec))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(openAPIURL, resource); err != nil {
+		return nil, err
+	}
+
+	v := &requestValidator{operations: make(map[string]*openAPIOperation)}
+	for path, item := range document.Paths {
+		for _, method := range openAPIMethods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			pointer := "#/paths/" + escapePointer(path) + "/" + method
+			op, err := compileOperation(compiler, pointer, raw, document.Components.Parameters)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+			}
+			v.operations[strings.ToUpper(method)+" "+path] = op
+		}
+	}
+	return v, nil
+}
+
+func compileOperation(compiler *jsonschema.Compiler, pointer string, raw json.RawMessage, shared map[string]*openAPIParameter) (*openAPIOperation, error) {
+	var operation struct {
+		Parameters  []*openAPIParameter `json:"parameters"`
+		RequestBody *struct {
+			Required bool                       `json:"required"`
+			Content  map[string]json.RawMessage `json:"content"`
+		} `json:"requestBody"`
+	}
+	if err := json.Unmarshal(raw, &operation); err != nil {
+		return nil, err
+	}
+
+	op := &openAPIOperation{}
+	for i, param := range operation.Parameters {
+		location := fmt.Sprintf("%s/parameters/%d", pointer, i)
+		if param.Ref != "" {
+			name := strings.TrimPrefix(param.Ref, "#/components/parameters/")
+			if param = shared[name]; param == nil {
+				return nil, fmt.Errorf("unknown parameter %s", name)
+			}
+			location = "#/components/parameters/" + escapePointer(name)
+		}
+		if param.schema == nil {
+			var err error
+			if param.schema, err = compiler.Compile(openAPIURL + location + "/schema"); err != nil {
+				return nil, err
+			}
+			var schema struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(param.Schema, &schema)
+			param.dataType = schema.Type
+		}
+		op.parameters = append(op.parameters, param)
+	}
+
+	if body := operation.RequestBody; body != nil {
+		if _, ok := body.Content["application/json"]; ok {
+			var err error
+			op.body, err = compiler.Compile(openAPIURL + pointer + "/requestBody/content/application~1json/schema")
+			if err != nil {
+				return nil, err
+			}
+			op.bodyRequired = body.Required
+		}
+	}
+	return op, nil
+}
+
+func (v *requestValidator) Validate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		op, ok := v.operations[c.Request.Method+" "+openAPIPath(c.FullPath())]
+		if !ok {
+			c.Next()
+			return
+		}
+		if err := op.validate(c); err != nil {
+			AbortWithProblem(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Next()
+	}
+}
+
+func (op *openAPIOperation) validate(c *gin.Context) error {
+	query := c.Request.URL.Query()
+	for _, param := range op.parameters {
+		var value string
+		var present bool
+		switch param.In {
+		case "path":
+			value = c.Param(param.Name)
+			present = value != ""
+		case "query":
+			_, present = query[param.Name]
+			value = query.Get(param.Name)
+		case "header":
+			value = c.GetHeader(param.Name)
+			present = value != ""
+		}
+		if !present {
+			if param.Required {
+				return fmt.Errorf("Missing %s parameter '%s'", param.In, param.Name)
+			}
+			continue
+		}
+		if err := param.validate(value); err != nil {
+			return fmt.Errorf("Invalid %s parameter '%s': %w", param.In, param.Name, err)
+		}
+	}
+
+	if op.body == nil {
+		return nil
+	}
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return errors.New("Invalid request body")
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(payload))
+	if len(bytes.TrimSpace(payload)) == 0 {
+		if op.bodyRequired {
+			return errors.New("Missing request body")
+		}
+		return nil
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		return errors.New("Request body is not valid JSON")
+	}
+	if err := op.body.Validate(instance); err != nil {
+		return fmt.Errorf("Invalid request body: %w", validationCause(err))
+	}
+	return nil
+}
+
+// validate converts a parameter to the type of its schema and validates it.
+func (p *openAPIParameter) validate(value string) error {
+	var instance interface{} = value
+	switch p.dataType {
+	case "integer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		instance = json.Number(strconv.FormatInt(n, 10))
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		instance = b
+	}
+	if err := p.schema.Validate(instance); err != nil {
+		return errors.New(strings.TrimPrefix(validationCause(err).Error(), "at '': "))
+	}
+	return nil
+}
+
+// validationCause returns the first of the innermost errors of a validation
+// error, which say what is wrong where, e.g. "at '/to': minLength: got 0,
+// want 1".
+func validationCause(err error) error {
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+	for len(validationErr.Causes) > 0 {
+		validationErr = validationErr.Causes[0]
+	}
+	return validationErr
+}
+
+func (v *requestValidator) CheckRoutes(routes gin.RoutesInfo) error {
+	served := make(map[string]bool, len(routes))
+	var problems []string
+	for _, route := range routes {
+		key := route.Method + " " + openAPIPath(route.Path)
+		served[key] = true
+		if _, ok := v.operations[key]; !ok {
+			problems = append(problems, key+" is not in the OpenAPI document")
+		}
+	}
+	for key := range v.operations {
+		if !served[key] {
+			problems = append(problems, key+" is in the OpenAPI document but not routed")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// openAPIPath turns a gin route such as /messages/:id or /protocol/*filepath
+// into an OpenAPI path, /messages/{id} or /protocol/{filepath}.
+func openAPIPath(route string) string {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapePointer escapes a key for use in a JSON pointer.
+func escapePointer(key string) string {
+	return url.PathEscape(strings.NewReplacer("~", "~0", "/", "~1").Replace(key))
+}
@@ -0,0 +1,193 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+)
+
+// The key derivation matches the example of the AWS documentation.
+func TestSigningKey(t *testing.T) {
+	got := hex.EncodeToString(signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam"))
+	if want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("signing key = %s, want %s", got, want)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	store := NewS3BlobStore(S3Config{Endpoint: "http://s3.test/", Region: "us-east-1", Bucket: "chat", AccessKey: testAccessKey, SecretKey: testSecretKey}).(*s3BlobStore)
+	req, err := store.newRequest(context.Background(), http.MethodPut, "a b/c.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.sign(req, time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC))
+
+	wantCanonical := "PUT\n" +
+		"/chat/a%20b%2Fc.png\n" +
+		"\n" +
+		"host:s3.test\n" +
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+		"x-amz-date:20130524T000000Z\n" +
+		"\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" +
+		"UNSIGNED-PAYLOAD"
+	if got := canonicalRequest(req, "20130524T000000Z"); got != wantCanonical {
+		t.Errorf("canonical request:\n%s\nwant:\n%s", got, wantCanonical)
+	}
+	wantAuthorization := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=105ea3000f10fa9aed09151b1924cf3f8e44d68633eba11a68413415db08ba85"
+	if got := req.Header.Get("Authorization"); got != wantAuthorization {
+		t.Errorf("Authorization = %s, want %s", got, wantAuthorization)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20130524T000000Z" {
+		t.Errorf("X-Amz-Date = %s", got)
+	}
+}
+
+var authorizationPattern = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+// fakeS3 is a bucket that, like S3, checks the signature of every request
+// before serving it.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		http.Error(w, "<Code>SignatureDoesNotMatch</Code><Message>"+err.Error()+"</Message>", http.StatusForbidden)
+		return
+	}
+	path := r.URL.EscapedPath()
+	if path == "/chat/broken" {
+		http.Error(w, "<Code>InternalError</Code>", http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[path] = string(data)
+	case http.MethodGet:
+		data, ok := f.objects[path]
+		if !ok {
+			http.Error(w, "<Code>NoSuchKey</Code>", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, data)
+	case http.MethodDelete:
+		if _, ok := f.objects[path]; !ok {
+			http.Error(w, "<Code>NoSuchKey</Code>", http.StatusNotFound)
+			return
+		}
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify recomputes the signature of a request the way S3 does.
+func (f *fakeS3) verify(r *http.Request) error {
+	match := authorizationPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return errors.New("malformed Authorization")
+	}
+	accessKey, date, region, signedHeaders, signature := match[1], match[2], match[3], match[4], match[5]
+	amzDate := r.Header.Get("X-Amz-Date")
+	if accessKey != testAccessKey || !strings.HasPrefix(amzDate, date) || region != "eu-test-1" {
+		return errors.New("bad credential scope")
+	}
+
+	var canonicalHeaders string
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, canonicalHeaders, signedHeaders, r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + date + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if hex.EncodeToString(key) != signature {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func newFakeS3Store(t *testing.T, secretKey string) BlobStore {
+	t.Helper()
+	server := httptest.NewServer(&fakeS3{objects: map[string]string{}})
+	t.Cleanup(server.Close)
+	return NewS3BlobStore(S3Config{Endpoint: server.URL, Region: "eu-test-1", Bucket: "chat", AccessKey: testAccessKey, SecretKey: secretKey})
+}
+
+func TestS3BlobStoreRoundTrip(t *testing.T) {
+	store := newFakeS3Store(t, testSecretKey)
+	ctx := context.Background()
+
+	const key, content = "attachments/a b.txt", "hello, bucket"
+	if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != content {
+		t.Errorf("Get = %q, want %q", data, content)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, key); err != ErrBlobNotFound {
+		t.Errorf("Get after Delete = %v, want ErrBlobNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("deleting a missing blob = %v, want nil", err)
+	}
+}
+
+func TestS3BlobStoreErrors(t *testing.T) {
+	ctx := context.Background()
+
+	err := newFakeS3Store(t, "wrong secret").Put(ctx, "k", strings.NewReader("x"), 1, "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Put with a wrong secret = %v, want a 403 SignatureDoesNotMatch error", err)
+	}
+
+	store := newFakeS3Store(t, testSecretKey)
+	if _, err := store.Get(ctx, "broken"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Get of a failing object = %v, want a 500 error", err)
+	}
+	if err := store.Delete(ctx, "broken"); err == nil || err == ErrBlobNotFound {
+		t.Errorf("Delete of a failing object = %v, want an error", err)
+	}
+}
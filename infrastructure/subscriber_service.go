@@ -0,0 +1,44 @@
+package infrastructure
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// how long the subscription may stay idle before its connection is pinged
+const subscriberHealthCheck = 30 * time.Second
+
+// SubscriberService receives every channel this node is interested in over a
+// single Redis pub/sub connection. The channels are fixed when it is created:
+// events reach a node on its own channel, whoever they are for.
+type SubscriberService interface {
+	Run(handler func(channel string, payload []byte))
+	Close() error
+}
+
+type subscriberService struct {
+	pubsub *redis.PubSub
+}
+
+// creates a subscriber to the given channels; nothing is received until Run
+func NewSubscriberService(redisService RedisService, channels ...string) SubscriberService {
+	return &subscriberService{
+		pubsub: redisService.GetClient().Subscribe(context.Background(), channels...),
+	}
+}
+
+// receives messages and passes them to handler until Close is called. When
+// the connection to Redis is lost, go-redis reconnects and subscribes to the
+// channels again.
+func (s *subscriberService) Run(handler func(channel string, payload []byte)) {
+	for msg := range s.pubsub.Channel(redis.WithChannelHealthCheckInterval(subscriberHealthCheck)) {
+		handler(msg.Channel, []byte(msg.Payload))
+	}
+}
+
+// stops Run and closes the pub/sub connection
+func (s *subscriberService) Close() error {
+	return s.pubsub.Close()
+}
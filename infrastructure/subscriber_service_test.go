@@ -0,0 +1,48 @@
+package infrastructure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The subscription outlives a Redis restart: go-redis reconnects and
+// subscribes to the channels again.
+func TestSubscriberSurvivesRedisRestart(t *testing.T) {
+	server := miniredis.RunT(t)
+	redisService := NewRedisService(server.Addr())
+	defer redisService.Close()
+	subscriber := NewSubscriberService(redisService, "channel:node:a")
+	defer subscriber.Close()
+
+	received := make(chan string, 16)
+	go subscriber.Run(func(channel string, payload []byte) { received <- string(payload) })
+
+	// expect publishes until the payload arrives, since the subscription may
+	// not be back yet
+	expect := func(payload string) {
+		t.Helper()
+		deadline := time.After(10 * time.Second)
+		for {
+			redisService.GetClient().Publish(context.Background(), "channel:node:a", payload)
+			select {
+			case got := <-received:
+				if got == payload {
+					return
+				}
+			case <-time.After(100 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("%s was not received", payload)
+			}
+		}
+	}
+
+	expect("before")
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	expect("after")
+}
@@ -0,0 +1,94 @@
+package infrastructure
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+// images larger than this are refused before being decoded
+const maxThumbnailSourcePixels = 40_000_000
+
+var ErrImageTooLarge = errors.New("image is too large to thumbnail")
+
+type ThumbnailService interface {
+	Generate(data []byte) ([]byte, error)
+}
+
+type thumbnailService struct {
+	maxSize int
+}
+
+// creates a thumbnail service producing JPEGs that fit in a maxSize square
+func NewThumbnailService(maxSize int) ThumbnailService {
+	return &thumbnailService{maxSize: maxSize}
+}
+
+// decodes a JPEG, PNG or GIF image and returns a downscaled JPEG of it
+func (s *thumbnailService) Generate(data []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, s.scale(src), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scale shrinks the image to fit maxSize by averaging every source pixel that
+// falls into each destination pixel. Transparent areas are flattened onto white.
+func (s *thumbnailService) scale(src image.Image) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return src
+	}
+
+	dstWidth, dstHeight := width, height
+	if width > s.maxSize || height > s.maxSize {
+		if width >= height {
+			dstWidth, dstHeight = s.maxSize, max(1, height*s.maxSize/width)
+		} else {
+			dstWidth, dstHeight = max(1, width*s.maxSize/height), s.maxSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := bounds.Min.Y + y*height/dstHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/dstHeight)
+		for x := 0; x < dstWidth; x++ {
+			x0 := bounds.Min.X + x*width/dstWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/dstWidth)
+
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					// composite over white: colour is premultiplied by alpha
+					r += uint64(pr + 0xffff - pa)
+					g += uint64(pg + 0xffff - pa)
+					b += uint64(pb + 0xffff - pa)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: 0xffff})
+		}
+	}
+	return dst
+}
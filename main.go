@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/protocol"
 	"github.com/haileamlak/chat-system/repositories"
 	"github.com/haileamlak/chat-system/usecases"
 	"github.com/haileamlak/chat-system/controllers"
 	"github.com/haileamlak/chat-system/routers"
 
+	uuid "github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -24,27 +34,232 @@ func main() {
 	defer redisService.Close()
 	passwordService := infrastructure.NewPasswordService()
 	tokenService := infrastructure.NewTokenService(redisService)
+	presenceConfig := usecases.PresenceConfig{SessionTTL: durationEnv("PRESENCE_TTL", time.Minute)}
+	// Connections are heartbeated with presence, so they share its TTL
+	registry := infrastructure.NewConnectionRegistry(redisService, nodeID(), presenceConfig.SessionTTL)
+	pubSubService := infrastructure.NewPubSubService(redisService, registry)
+	// Events for users connected here arrive on the node's own channel
+	subscriberService := infrastructure.NewSubscriberService(redisService, "channel:broadcast", infrastructure.NodeChannel(registry.NodeID()))
 
 	authMiddleware := infrastructure.NewAuthMiddleware(tokenService)
 
 	// Initialize repositories
 	userRepo := repositories.NewUserRepository(redisService)
 	messageRepo := repositories.NewMessageRepository(redisService)
+	searchRepo := repositories.NewSearchRepository(redisService)
+	attachmentRepo := repositories.NewAttachmentRepository(redisService)
+	conversationRepo := repositories.NewConversationRepository(redisService)
+	presenceRepo := repositories.NewPresenceRepository(redisService)
+	eventRepo := repositories.NewEventRepository(redisService)
+	typingRepo := repositories.NewTypingRepository(redisService)
+
+	blobStore := newBlobStore()
 
 	// Initialize use cases
 	userUseCase := usecases.NewUserUseCase(userRepo, passwordService, tokenService)
-	messageUseCase := usecases.NewMessageUseCase(messageRepo)
+	messageUseCase := usecases.NewMessageUseCase(messageRepo, searchRepo, attachmentRepo, blobStore, conversationRepo, eventRepo, pubSubService, usecases.MessageConfig{
+		EditWindow:              durationEnv("MESSAGE_EDIT_WINDOW", 15*time.Minute),
+		MaxReactions:            intEnv("MESSAGE_MAX_REACTIONS", 20),
+		ReadReceiptMaxGroupSize: intEnv("READ_RECEIPT_MAX_GROUP_SIZE", 20),
+		DedupeWindow:            durationEnv("MESSAGE_DEDUPE_WINDOW", 24*time.Hour),
+		EventLogSize:            intEnv("EVENT_LOG_SIZE", 1000),
+	})
+
+	searchUseCase := usecases.NewSearchUseCase(messageRepo, searchRepo, conversationRepo)
+	presenceUseCase := usecases.NewPresenceUseCase(presenceRepo, conversationRepo, messageRepo, pubSubService, presenceConfig)
+	eventUseCase := usecases.NewEventUseCase(eventRepo, usecases.EventConfig{ReplayLimit: intEnv("REPLAY_LIMIT", 500)})
+	typingConfig := usecases.TypingConfig{
+		TTL:      durationEnv("TYPING_TTL", 6*time.Second),
+		Interval: durationEnv("TYPING_INTERVAL", 2*time.Second),
+	}
+	typingUseCase := usecases.NewTypingUseCase(messageRepo, typingRepo, pubSubService, typingConfig)
+	attachmentConfig := usecases.AttachmentConfig{MaxSize: intEnv("ATTACHMENT_MAX_SIZE", 10<<20)}
+	attachmentUseCase := usecases.NewAttachmentUseCase(attachmentRepo, messageRepo, blobStore, infrastructure.NewThumbnailService(256), attachmentConfig)
+
+	// `chat-system reindex` rebuilds the search index and exits
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		count, err := searchUseCase.Reindex(context.Background())
+		if err != nil {
+			log.Fatal("Reindex failed:", err)
+		}
+		log.Println("Reindexed", count, "messages")
+		return
+	}
+
+	// `chat-system backfill-conversations` fills the conversation lists from
+	// existing DMs and groups and exits
+	if len(os.Args) > 1 && os.Args[1] == "backfill-conversations" {
+		count, err := messageUseCase.BackfillConversations(context.Background())
+		if err != nil {
+			log.Fatal("Backfill failed:", err)
+		}
+		log.Println("Backfilled", count, "conversations")
+		return
+	}
 
 	// Initialize controllers
 	userController := controllers.NewUserController(userUseCase)
 	messageController := controllers.NewMessageController(messageUseCase)
-	webSocketController := controllers.NewWebSocketController(messageUseCase, redisService)
+	searchController := controllers.NewSearchController(searchUseCase)
+	attachmentController := controllers.NewAttachmentController(attachmentUseCase, attachmentConfig.MaxSize)
+	conversationController := controllers.NewConversationController(messageUseCase, typingUseCase)
+	presenceController := controllers.NewPresenceController(presenceUseCase)
+	webSocketController := controllers.NewWebSocketController(messageUseCase, presenceUseCase, typingUseCase, eventUseCase, subscriberService, registry, authMiddleware, controllers.WebSocketConfig{
+		// Heartbeat well within the TTL so one late tick does not flap presence
+		HeartbeatInterval: presenceConfig.SessionTTL / 3,
+		TypingTTL:         typingConfig.TTL,
+		PingInterval:      durationEnv("WS_PING_INTERVAL", 30*time.Second),
+		PongTimeout:       durationEnv("WS_PONG_TIMEOUT", time.Minute),
+		WriteTimeout:      durationEnv("WS_WRITE_TIMEOUT", 10*time.Second),
+		MaxFrameSize:      intEnv("WS_MAX_FRAME_SIZE", 64<<10),
+		ReconnectWindow:   durationEnv("WS_RECONNECT_WINDOW", 5*time.Second),
+		CompressionLevel:  int(intEnv("WS_COMPRESSION_LEVEL", 1)),
+	})
+
+	graphqlController := controllers.NewGraphQLController(userUseCase, messageUseCase, presenceUseCase, webSocketController, authMiddleware)
+
+	requestValidator, err := infrastructure.NewRequestValidator(protocol.OpenAPI)
+	if err != nil {
+		log.Fatal("Invalid OpenAPI document:", err)
+	}
+	router := routers.SetupRouter(userController, messageController, searchController, attachmentController, conversationController, presenceController, webSocketController, graphqlController, authMiddleware.Authenticate(), requestValidator.Validate())
+
+	// Nodes sharing a host need their own ports
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed to start:", err)
+		}
+	}()
+	log.Println("Server running on http://localhost:"+port, "as node", registry.NodeID())
+
+	// The gRPC API listens on a port of its own
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9090"
+	}
+	grpcServer := controllers.NewGRPCServer(userUseCase, messageUseCase, webSocketController, authMiddleware)
+	grpcListener, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		log.Fatal("gRPC server failed to start:", err)
+	}
+	go grpcServer.Serve(grpcListener)
+	log.Println("gRPC API on localhost:" + grpcPort)
+
+	// Metrics reveal the command line and memory stats, so they are served
+	// apart from the API, on the loopback interface unless DEBUG_ADDR says
+	// otherwise
+	debugAddr := os.Getenv("DEBUG_ADDR")
+	if debugAddr == "" {
+		debugAddr = "127.0.0.1:6060"
+	}
+	debugMux := http.NewServeMux()
+	debugMux.Handle("/debug/vars", expvar.Handler())
+	debugServer := &http.Server{Addr: debugAddr, Handler: debugMux}
+	go func() {
+		if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Debug server failed to start:", err)
+		}
+	}()
+	log.Println("Metrics on http://" + debugAddr + "/debug/vars")
+
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-signals.Done()
+	stop()
 
-	router := routers.SetupRouter(userController, messageController, webSocketController, authMiddleware.Authenticate())
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), durationEnv("SHUTDOWN_TIMEOUT", 15*time.Second))
+	defer cancel()
 
-	if err := router.Run(":8080"); err != nil {
-		log.Fatal("Server failed to start:", err)
+	// WebSockets are hijacked connections that http.Server does not track, so
+	// they are drained first; Redis is closed by the deferred Close last
+	if err := webSocketController.Shutdown(ctx); err != nil {
+		log.Println("WebSocket connections did not drain in time:", err)
 	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("HTTP server did not shut down cleanly:", err)
+	}
+	debugServer.Close()
+	// Subscribe streams ended with the hub; unary calls in flight finish
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+	log.Println("Server stopped")
+}
+
+// nodeID names this instance in the connection registry. NODE_ID is used
+// when set; otherwise the host name plus a random suffix keeps a restarted
+// node from inheriting the connections of its previous run.
+func nodeID() string {
+	if id := os.Getenv("NODE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return host + "-" + uuid.New().String()[:8]
+}
+
+// durationEnv reads a duration such as "15m" from the environment, falling
+// back to def when the variable is unset or invalid.
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println("Invalid", name, "value, using default:", err)
+		return def
+	}
+	return d
+}
+
+// intEnv reads an integer from the environment, falling back to def when the
+// variable is unset or invalid.
+func intEnv(name string, def int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Println("Invalid", name, "value, using default:", err)
+		return def
+	}
+	return n
+}
 
-	log.Println("Server running on http://localhost:8080")
+// newBlobStore picks where attachments are stored: the local filesystem by
+// default, or an S3-compatible bucket when BLOB_STORE=s3.
+func newBlobStore() infrastructure.BlobStore {
+	if os.Getenv("BLOB_STORE") == "s3" {
+		return infrastructure.NewS3BlobStore(infrastructure.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+	}
+
+	dir := os.Getenv("BLOB_DIR")
+	if dir == "" {
+		dir = "data/blobs"
+	}
+	store, err := infrastructure.NewLocalBlobStore(dir)
+	if err != nil {
+		log.Fatal("Failed to open blob directory:", err)
+	}
+	return store
 }
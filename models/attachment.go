@@ -0,0 +1,14 @@
+package models
+
+type Attachment struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	MIMEType     string `json:"mime_type"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum"` // hex SHA-256 of the content
+	Conversation string `json:"conversation"`
+	Uploader     string `json:"uploader"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
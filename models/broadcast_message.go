@@ -1,6 +1,7 @@
 package models
 
 type BroadcastMessage struct {
+	MessageMeta
 	From      string `json:"from" binding:"required"`
 	Content   string `json:"content" binding:"required"`
 	Timestamp string `json:"timestamp" binding:"required"`
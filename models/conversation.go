@@ -0,0 +1,23 @@
+package models
+
+// ConversationActivity is an entry of a user's conversation list.
+type ConversationActivity struct {
+	Key          string
+	LastActivity int64 // unix milliseconds
+}
+
+type ConversationSummary struct {
+	ID             string   `json:"id"`
+	Kind           string   `json:"kind"` // dm | group
+	Name           string   `json:"name"` // the other user for DMs, the group name for groups
+	Participants   []string `json:"participants"`
+	MemberCount    int      `json:"member_count"`
+	LastActivityAt string   `json:"last_activity_at"`
+	LastMessage    *Message `json:"last_message,omitempty"`
+	UnreadCount    int64    `json:"unread_count"`
+}
+
+type ConversationList struct {
+	Conversations []*ConversationSummary `json:"conversations"`
+	Total         int64                  `json:"total"`
+}
@@ -1,6 +1,7 @@
 package models
 
 type GroupMessage struct {
+	MessageMeta
 	From      string `json:"from" binding:"required"`
 	Group     string `json:"group" binding:"required"`
 	Content   string `json:"content" binding:"required"`
@@ -0,0 +1,7 @@
+package models
+
+const (
+	GroupRoleMember    = "member"
+	GroupRoleModerator = "moderator"
+	GroupRoleAdmin     = "admin"
+)
@@ -1,6 +1,7 @@
 package models
 
 type DirectMessage struct {
+	MessageMeta
 	From      string `json:"from" binding:"required"`
 	To        string `json:"to" binding:"required"`
 	Content   string `json:"content" binding:"required"`
@@ -0,0 +1,29 @@
+package models
+
+// MessageMeta holds the fields shared by every stored message regardless of kind.
+type MessageMeta struct {
+	ID        string `json:"id"`
+	ClientID  string `json:"client_id,omitempty"` // set by the sender, used to dedupe retries
+	EditedAt  string `json:"edited_at,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	DeletedAt string `json:"deleted_at,omitempty"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+
+	// ParentID is set on replies; the parent carries the thread summary.
+	ParentID    string `json:"parent_id,omitempty"`
+	ReplyCount  int64  `json:"reply_count,omitempty"`
+	LastReplyAt string `json:"last_reply_at,omitempty"`
+
+	// Attachments are sent as {"id": ...} references and stored with their metadata.
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Reactions is computed per viewer when a history is read.
+	Reactions []Reaction `json:"reactions,omitempty"`
+}
+
+// MessageRef locates a stored message inside its conversation list.
+type MessageRef struct {
+	ID    string
+	Key   string
+	Index int64
+}
@@ -0,0 +1,6 @@
+package models
+
+type MessageRevision struct {
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+}
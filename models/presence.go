@@ -0,0 +1,13 @@
+package models
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+type Presence struct {
+	User     string `json:"user"`
+	State    string `json:"state"` // online | away | offline
+	LastSeen string `json:"last_seen,omitempty"`
+}
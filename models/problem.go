@@ -0,0 +1,57 @@
+package models
+
+import "net/http"
+
+// Error codes are stable: clients branch on them, not on messages. The same
+// codes are sent in problem responses, v1 error frames, GraphQL error
+// extensions and the ErrorInfo of gRPC errors.
+const (
+	ErrCodeInvalidRequest = "invalid_request" // the request was understood but its values were rejected
+	ErrCodeUnauthorized   = "unauthorized"    // the client did not authenticate, or failed to
+	ErrCodeForbidden      = "forbidden"       // the user may not do this
+	ErrCodeNotFound       = "not_found"       // what the request refers to does not exist
+	ErrCodeConflict       = "conflict"        // the request conflicts with the current state
+	ErrCodeTooLarge       = "too_large"       // something the request refers to is too large
+	ErrCodeRateLimited    = "rate_limited"    // the client sent too many requests; it may retry later
+	ErrCodeUnavailable    = "unavailable"     // the server is shutting down; the client may retry elsewhere
+	ErrCodeInternal       = "internal"        // the server failed; the request may be retried
+)
+
+// ErrorCode returns the code of an error answered with an HTTP status.
+func ErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusConflict:
+		return ErrCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodeTooLarge
+	case http.StatusTooManyRequests:
+		return ErrCodeRateLimited
+	case http.StatusServiceUnavailable:
+		return ErrCodeUnavailable
+	default:
+		return ErrCodeInternal
+	}
+}
+
+// Problem is the body of every HTTP error response, an RFC 7807 problem
+// details object served as application/problem+json. Type is always
+// about:blank, so Title is the HTTP status text; Code and RequestID are
+// extensions.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// RequestID is the X-Request-ID of the request, to find it in the logs.
+	RequestID string `json:"request_id,omitempty"`
+}
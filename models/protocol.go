@@ -0,0 +1,119 @@
+package models
+
+import "encoding/json"
+
+// ProtocolV1 is the Sec-WebSocket-Protocol a client asks for to speak version
+// 1 of the frame protocol, and ProtocolV1Proto the one to speak it in binary
+// protobuf frames (protocol/v1/frames.proto). Clients that ask for neither get
+// the WSMessage frames of the original protocol.
+const (
+	ProtocolV1      = "chat.v1"
+	ProtocolV1Proto = "chat.v1.protobuf"
+	ProtocolVersion = 1
+)
+
+// Capabilities are the optional event families a v1 client can ask for in
+// its hello. Events of a family the client did not ask for are not sent.
+const (
+	CapabilityTyping    = "typing"    // typing events
+	CapabilityPresence  = "presence"  // presence events
+	CapabilityReceipts  = "receipts"  // read.receipt events
+	CapabilityReactions = "reactions" // reaction.added and reaction.removed events
+	CapabilityThreads   = "threads"   // thread.reply events
+)
+
+// Frame is the envelope of every v1 frame, in both directions. Data holds the
+// payload of the frame's type, described by its JSON schema in protocol/v1.
+type Frame struct {
+	Type string `json:"type"`
+	// Ref is chosen by the client on a command and echoed on the ack or
+	// error frame that answers it.
+	Ref string `json:"ref,omitempty"`
+	// Seq is the position of an event in the client's event stream.
+	Seq  int64           `json:"seq,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// HelloCommand opens a v1 connection. It must be the first frame a client
+// sends.
+type HelloCommand struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Device       string   `json:"device,omitempty"`
+	// Cursor is the seq of the last event seen, to replay what was missed.
+	Cursor *int64 `json:"cursor,omitempty"`
+}
+
+// SendMessageCommand sends a DM, group or broadcast message.
+type SendMessageCommand struct {
+	Kind        string       `json:"kind"`         // dm | group | broadcast
+	To          string       `json:"to,omitempty"` // user or group
+	Content     string       `json:"content"`
+	ClientID    string       `json:"client_id,omitempty"`
+	ParentID    string       `json:"parent_id,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// SetPresenceCommand switches the user between online and away.
+type SetPresenceCommand struct {
+	State string `json:"state"`
+}
+
+// TypingCommand starts or stops the user's typing indicator in a
+// conversation.
+type TypingCommand struct {
+	Conversation string `json:"conversation"`
+}
+
+// WelcomeEvent answers a hello with what the server agreed to.
+type WelcomeEvent struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Device       string   `json:"device"`
+	// PingInterval is how often the server pings, in milliseconds.
+	PingInterval int64 `json:"ping_interval_ms"`
+	// MaxFrameSize is the largest frame the server accepts, in bytes.
+	MaxFrameSize int64 `json:"max_frame_size"`
+}
+
+// AckEvent is the data of the ack answering message.send. Other commands are
+// acked without data.
+type AckEvent struct {
+	ID        string `json:"id"`
+	ClientID  string `json:"client_id,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// ErrorEvent rejects a command, or the connection before it is closed.
+type ErrorEvent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID is the X-Request-ID of the connection's upgrade request.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// MessageEvent is a new DM, group or broadcast message.
+type MessageEvent struct {
+	Kind string `json:"kind"` // dm | group | broadcast
+	Message
+}
+
+// ReactionEvent reports a reaction added to or removed from a message.
+type ReactionEvent struct {
+	MessageID string `json:"message_id"`
+	User      string `json:"user"`
+	Emoji     string `json:"emoji"`
+	Count     int64  `json:"count"`
+}
+
+// ResyncEvent tells a client that is too far behind to refetch its history
+// and resume from the frame's seq.
+type ResyncEvent struct {
+	Reason string `json:"reason"`
+}
+
+// GoingAwayEvent tells the client the server is shutting down and when to
+// reconnect.
+type GoingAwayEvent struct {
+	ReconnectAfter int64 `json:"reconnect_after_ms"`
+}
@@ -0,0 +1,7 @@
+package models
+
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int64  `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// SearchQuery describes a full-text search over the caller's conversations.
+// Zero values disable the corresponding filter.
+type SearchQuery struct {
+	Text         string
+	Conversation string
+	From         string
+	After        time.Time
+	Before       time.Time
+	Offset       int64
+	Limit        int64
+}
+
+// SearchDocument is the index entry of a message, enough to filter results
+// before the message itself is loaded.
+type SearchDocument struct {
+	ID        string
+	Key       string
+	From      string
+	Timestamp int64
+}
+
+type SearchResult struct {
+	Conversation string   `json:"conversation"`
+	Message      *Message `json:"message"`
+	Snippet      string   `json:"snippet"`
+}
+
+type SearchResults struct {
+	Results []*SearchResult `json:"results"`
+	Total   int64           `json:"total"`
+}
@@ -0,0 +1,12 @@
+package models
+
+// Message is a kind-agnostic view of a stored DM, group or broadcast message,
+// used when a message is addressed by its ID rather than through a history.
+type Message struct {
+	MessageMeta
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+}
@@ -0,0 +1,7 @@
+package models
+
+type Thread struct {
+	Parent  *Message   `json:"parent"`
+	Replies []*Message `json:"replies"`
+	Total   int64      `json:"total"`
+}
@@ -0,0 +1,10 @@
+package models
+
+// TypingIndicator tells the other participants of a conversation that a user
+// started or stopped typing. It is relayed, never stored.
+type TypingIndicator struct {
+	Conversation string `json:"conversation"`
+	User         string `json:"user"`
+	Typing       bool   `json:"typing"`
+	TTL          int64  `json:"ttl_ms,omitempty"` // clients drop the indicator after this long without a refresh
+}
@@ -0,0 +1,13 @@
+package models
+
+type UnreadCounts struct {
+	Total         int64            `json:"total"`
+	Conversations map[string]int64 `json:"conversations"`
+}
+
+type ReadReceipt struct {
+	Conversation string `json:"conversation"`
+	User         string `json:"user"`
+	MessageID    string `json:"message_id,omitempty"`
+	ReadAt       string `json:"read_at"`
+}
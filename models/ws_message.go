@@ -1,9 +1,18 @@
 package models
 
+import "encoding/json"
 
 type WSMessage struct {
-	Type    string `json:"type" binding:"required"`    // dm | group | broadcast
-	From    string `json:"from" binding:"required"`
-	To      string `json:"to" binding:"required"`      // user or group
-	Content string `json:"content" binding:"required"`
-}
\ No newline at end of file
+	Type        string          `json:"type" binding:"required"` // dm | group | broadcast | message.edited
+	From        string          `json:"from" binding:"required"`
+	To          string          `json:"to" binding:"required"` // user or group
+	Content     string          `json:"content" binding:"required"`
+	ID          string          `json:"id,omitempty"`
+	ClientID    string          `json:"client_id,omitempty"` // chosen by the sender to match acks and dedupe retries
+	Group       string          `json:"group,omitempty"`     // set on group messages delivered to members
+	ParentID    string          `json:"parent_id,omitempty"` // set when replying in a thread
+	Attachments []Attachment    `json:"attachments,omitempty"`
+	Timestamp   string          `json:"timestamp,omitempty"`
+	Seq         int64           `json:"seq,omitempty"` // position in the recipient's event stream, used to resume after a reconnect
+	Data        json.RawMessage `json:"data,omitempty"`
+}
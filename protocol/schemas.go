@@ -0,0 +1,25 @@
+// Package protocol holds the JSON schemas of the v1 WebSocket frame protocol,
+// one per frame type, served at /protocol/v1/<type>.json, the protobuf
+// definitions of its binary framing and of the gRPC API, the schema of the
+// GraphQL API and the OpenAPI document of the REST API. The generated Go code of the protobuf definitions is
+// package chatv1, in v1.
+package protocol
+
+import "embed"
+
+// Schemas holds v1/<frame type>.json for every frame, v1/defs.json with the
+// definitions they share, the v1/*.proto files and schema.graphql.
+//
+//go:embed v1/*.json v1/*.proto schema.graphql
+var Schemas embed.FS
+
+// GraphQLSchema is the schema of the GraphQL API.
+//
+//go:embed schema.graphql
+var GraphQLSchema string
+
+// OpenAPI is the OpenAPI 3.1 document of the REST API, served at
+// /openapi.json. Requests are validated against it.
+//
+//go:embed openapi.json
+var OpenAPI []byte
@@ -0,0 +1,91 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+)
+
+// binds every attachment of KEYS to the message ARGV[1] unless one of them
+// is bound already, returning 0 then
+var bindAttachmentsScript = redis.NewScript(`
+if redis.call("EXISTS", unpack(KEYS)) > 0 then
+	return 0
+end
+for _, key in ipairs(KEYS) do
+	redis.call("SET", key, ARGV[1])
+end
+return 1
+`)
+
+type AttachmentRepository interface {
+	SaveAttachment(attachment *models.Attachment) error
+	GetAttachment(id string) (*models.Attachment, error)
+	DeleteAttachment(id string) error
+	BindAttachments(ids []string, messageID string) (bool, error)
+	UnbindAttachments(ids []string) error
+}
+
+type attachmentRepository struct {
+	redisService infrastructure.RedisService
+}
+
+func NewAttachmentRepository(redisService infrastructure.RedisService) AttachmentRepository {
+	return &attachmentRepository{
+		redisService: redisService,
+	}
+}
+
+func (r *attachmentRepository) SaveAttachment(attachment *models.Attachment) error {
+	attachmentJSON, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+	return r.redisService.GetClient().Set(context.Background(), "attachment:"+attachment.ID, attachmentJSON, 0).Err()
+}
+
+// GetAttachment returns nil when no attachment with the given ID exists.
+func (r *attachmentRepository) GetAttachment(id string) (*models.Attachment, error) {
+	attachmentJSON, err := r.redisService.GetClient().Get(context.Background(), "attachment:"+id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attachment models.Attachment
+	if err := json.Unmarshal([]byte(attachmentJSON), &attachment); err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (r *attachmentRepository) DeleteAttachment(id string) error {
+	return r.redisService.GetClient().Del(context.Background(), "attachment:"+id, "attachment:"+id+":message").Err()
+}
+
+// BindAttachments records that the attachments belong to a message. An
+// attachment belongs to one message only, so it reports false, binding none
+// of them, when any is bound already.
+func (r *attachmentRepository) BindAttachments(ids []string, messageID string) (bool, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "attachment:" + id + ":message"
+	}
+	bound, err := bindAttachmentsScript.Run(context.Background(), r.redisService.GetClient(), keys, messageID).Int()
+	return bound == 1, err
+}
+
+// UnbindAttachments frees attachments of a message that failed to be stored.
+func (r *attachmentRepository) UnbindAttachments(ids []string) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "attachment:" + id + ":message"
+	}
+	return r.redisService.GetClient().Del(context.Background(), keys...).Err()
+}
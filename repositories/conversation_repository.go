@@ -0,0 +1,174 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+)
+
+// advances a read cursor without ever moving it backwards
+var setReadCursorScript = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) > current then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+type ConversationRepository interface {
+	TouchConversation(users []string, key string, at int64) error
+	AddConversation(users []string, key string, at int64) error
+	GetUserConversations(user string) ([]string, error)
+	SetReadCursor(user string, key string, position int64) error
+	GetReadCursors(user string, keys []string) (map[string]int64, error)
+	GetConversationLengths(keys []string) (map[string]int64, error)
+	GetConversationActivity(user string, start, stop int64) ([]*models.ConversationActivity, int64, error)
+	GetLastMessages(keys []string) (map[string]*models.Message, error)
+}
+
+type conversationRepository struct {
+	redisService infrastructure.RedisService
+}
+
+func NewConversationRepository(redisService infrastructure.RedisService) ConversationRepository {
+	return &conversationRepository{
+		redisService: redisService,
+	}
+}
+
+// TouchConversation records activity at the given time (unix milliseconds) in
+// the conversation list of every user.
+func (r *conversationRepository) TouchConversation(users []string, key string, at int64) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	_, err := r.redisService.GetClient().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for _, user := range users {
+			pipe.ZAdd(context.Background(), "user:"+user+":conversations", &redis.Z{Score: float64(at), Member: key})
+		}
+		return nil
+	})
+	return err
+}
+
+// AddConversation puts the conversation in the conversation list of every
+// user that lacks it. Existing entries keep their activity time.
+func (r *conversationRepository) AddConversation(users []string, key string, at int64) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	_, err := r.redisService.GetClient().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for _, user := range users {
+			pipe.ZAddNX(context.Background(), "user:"+user+":conversations", &redis.Z{Score: float64(at), Member: key})
+		}
+		return nil
+	})
+	return err
+}
+
+// GetUserConversations returns the message list keys of the user's DMs and
+// groups, most recently active first.
+func (r *conversationRepository) GetUserConversations(user string) ([]string, error) {
+	return r.redisService.GetClient().ZRevRange(context.Background(), "user:"+user+":conversations", 0, -1).Result()
+}
+
+// SetReadCursor marks the first position messages of the conversation as
+// read. Cursors only move forward.
+func (r *conversationRepository) SetReadCursor(user string, key string, position int64) error {
+	return setReadCursorScript.Run(context.Background(), r.redisService.GetClient(), []string{"user:" + user + ":read"}, key, position).Err()
+}
+
+func (r *conversationRepository) GetReadCursors(user string, keys []string) (map[string]int64, error) {
+	cursors := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return cursors, nil
+	}
+
+	vals, err := r.redisService.GetClient().HMGet(context.Background(), "user:"+user+":read", keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if s, ok := vals[i].(string); ok {
+			cursors[key], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return cursors, nil
+}
+
+func (r *conversationRepository) GetConversationLengths(keys []string) (map[string]int64, error) {
+	lengths := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return lengths, nil
+	}
+
+	pipe := r.redisService.GetClient().Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.LLen(context.Background(), key)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		lengths[key] = cmds[i].Val()
+	}
+	return lengths, nil
+}
+
+// GetConversationActivity returns one page of the user's conversation list,
+// most recently active first, and the total number of conversations.
+func (r *conversationRepository) GetConversationActivity(user string, start, stop int64) ([]*models.ConversationActivity, int64, error) {
+	key := "user:" + user + ":conversations"
+	total, err := r.redisService.GetClient().ZCard(context.Background(), key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries, err := r.redisService.GetClient().ZRevRangeWithScores(context.Background(), key, start, stop).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	activity := make([]*models.ConversationActivity, 0, len(entries))
+	for _, entry := range entries {
+		activity = append(activity, &models.ConversationActivity{Key: entry.Member.(string), LastActivity: int64(entry.Score)})
+	}
+	return activity, total, nil
+}
+
+// GetLastMessages returns the newest message of each conversation that has one.
+func (r *conversationRepository) GetLastMessages(keys []string) (map[string]*models.Message, error) {
+	messages := make(map[string]*models.Message, len(keys))
+	if len(keys) == 0 {
+		return messages, nil
+	}
+
+	pipe := r.redisService.GetClient().Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.LIndex(context.Background(), key, -1)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if cmds[i].Err() != nil {
+			continue
+		}
+		var msg models.Message
+		if err := json.Unmarshal([]byte(cmds[i].Val()), &msg); err != nil {
+			return nil, err
+		}
+		messages[key] = &msg
+	}
+	return messages, nil
+}
@@ -0,0 +1,115 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+)
+
+// appends an event under the next global sequence number and trims the
+// stream to ARGV[2] entries, remembering the newest sequence trimmed away
+var appendEventScript = redis.NewScript(`
+local seq = redis.call("INCR", KEYS[1])
+redis.call("XADD", KEYS[2], seq .. "-0", "event", ARGV[1])
+local excess = redis.call("XLEN", KEYS[2]) - tonumber(ARGV[2])
+if excess > 0 then
+	local trimmed = redis.call("XRANGE", KEYS[2], "-", "+", "COUNT", excess)
+	redis.call("HSET", KEYS[3], KEYS[2], trimmed[#trimmed][1])
+	redis.call("XTRIM", KEYS[2], "MAXLEN", ARGV[2])
+end
+return seq
+`)
+
+// EventRepository keeps the recent real-time events of every user, plus the
+// broadcast events shared by everyone, numbered by one global sequence.
+// A recipient of "" stands for the broadcast stream.
+type EventRepository interface {
+	AppendEvent(recipient string, event *models.WSMessage, maxLen int64) (int64, error)
+	GetEventsAfter(recipient string, after int64, count int64) ([]*models.WSMessage, error)
+	GetTrimmedSeq(recipient string) (int64, error)
+	GetLatestSeq() (int64, error)
+}
+
+type eventRepository struct {
+	redisService infrastructure.RedisService
+}
+
+func NewEventRepository(redisService infrastructure.RedisService) EventRepository {
+	return &eventRepository{
+		redisService: redisService,
+	}
+}
+
+func eventStreamKey(recipient string) string {
+	if recipient == "" {
+		return "events:broadcast"
+	}
+	return "events:user:" + recipient
+}
+
+// AppendEvent stores the event, keeping at most maxLen events for the
+// recipient, and returns its sequence number.
+func (r *eventRepository) AppendEvent(recipient string, event *models.WSMessage, maxLen int64) (int64, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{"events:seq", eventStreamKey(recipient), "events:trimmed"}
+	return appendEventScript.Run(context.Background(), r.redisService.GetClient(), keys, payload, maxLen).Int64()
+}
+
+// GetEventsAfter returns up to count events with a sequence number above
+// after, oldest first.
+func (r *eventRepository) GetEventsAfter(recipient string, after int64, count int64) ([]*models.WSMessage, error) {
+	start := strconv.FormatInt(after+1, 10) + "-0"
+	entries, err := r.redisService.GetClient().XRangeN(context.Background(), eventStreamKey(recipient), start, "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*models.WSMessage, 0, len(entries))
+	for _, entry := range entries {
+		payload, _ := entry.Values["event"].(string)
+		var event models.WSMessage
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			return nil, err
+		}
+		event.Seq = parseEventSeq(entry.ID)
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// GetTrimmedSeq returns the newest sequence number dropped from the
+// recipient's stream, or 0 if nothing was dropped yet.
+func (r *eventRepository) GetTrimmedSeq(recipient string) (int64, error) {
+	id, err := r.redisService.GetClient().HGet(context.Background(), "events:trimmed", eventStreamKey(recipient)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return parseEventSeq(id), nil
+}
+
+// GetLatestSeq returns the sequence number of the newest event of any stream.
+func (r *eventRepository) GetLatestSeq() (int64, error) {
+	seq, err := r.redisService.GetClient().Get(context.Background(), "events:seq").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// parseEventSeq extracts the sequence number from a stream ID ("<seq>-0").
+func parseEventSeq(id string) int64 {
+	seq, _ := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	return seq
+}
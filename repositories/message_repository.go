@@ -2,17 +2,106 @@ package repositories
 
 import (
 	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
 
 	"github.com/haileamlak/chat-system/infrastructure"
 	"github.com/haileamlak/chat-system/models"
 	"encoding/json"
 )
 
+// creates a group unless its member set exists; roles left behind by an
+// earlier group of the same name are dropped
+var createGroupScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("SADD", KEYS[1], unpack(ARGV, 2))
+redis.call("DEL", KEYS[2])
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// adds a reaction unless its emoji would be one kind too many (ARGV[3], 0
+// for no cap), returning how many users react with the emoji or -1
+var addReactionScript = redis.NewScript(`
+local max = tonumber(ARGV[3])
+if max > 0 and redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 and redis.call("SCARD", KEYS[1]) >= max then
+	return -1
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+redis.call("SADD", KEYS[2], ARGV[2])
+return redis.call("SCARD", KEYS[2])
+`)
+
+// removes a reaction, and its emoji from the kinds once nobody uses it,
+// returning how many users still react with the emoji
+var removeReactionScript = redis.NewScript(`
+redis.call("SREM", KEYS[2], ARGV[2])
+local count = redis.call("SCARD", KEYS[2])
+if count == 0 then
+	redis.call("SREM", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// sets a member's role unless that demotes the group's last admin, returning 0
+// then
+var setGroupRoleScript = redis.NewScript(`
+if ARGV[2] ~= ARGV[3] and redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[3] then
+	local admins = 0
+	for _, role in ipairs(redis.call("HVALS", KEYS[1])) do
+		if role == ARGV[3] then
+			admins = admins + 1
+		end
+	end
+	if admins <= 1 then
+		return 0
+	end
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// appends a message to its conversation and records where it landed under its
+// ID, returning the conversation's length
+var pushMessageScript = redis.NewScript(`
+local length = redis.call("RPUSH", KEYS[1], ARGV[1])
+redis.call("HSET", KEYS[2], "key", KEYS[1], "index", length - 1)
+return length
+`)
+
+// replaces the message at index ARGV[1] with ARGV[5] unless it is deleted or
+// no longer has the ID, content and edit time ARGV[2..4], returning 0 then;
+// ARGV[6] is a revision to keep, and ARGV[7] "1" drops the revisions
+var updateMessageScript = redis.NewScript(`
+local stored = redis.call("LINDEX", KEYS[1], ARGV[1])
+if not stored then
+	return 0
+end
+local msg = cjson.decode(stored)
+if msg.deleted or msg.id ~= ARGV[2] or msg.content ~= ARGV[3] or (msg.edited_at or "") ~= ARGV[4] then
+	return 0
+end
+redis.call("LSET", KEYS[1], ARGV[1], ARGV[5])
+if ARGV[6] ~= "" then
+	redis.call("RPUSH", KEYS[2], ARGV[6])
+end
+if ARGV[7] == "1" then
+	redis.call("DEL", KEYS[2])
+end
+return 1
+`)
+
 type MessageRepository interface {
 	SaveDirectMessage(key string, msg *models.DirectMessage) error
 	GetDirectMessage(key string, index int64) (*models.DirectMessage, error)
 	GetDMHistory(key string) ([]*models.DirectMessage, error)
-	CreateGroup(key string, members []string) error
+	CreateGroup(membersKey string, rolesKey string, members []string, creatorRole string) (bool, error)
 	GetGroupHistory(group string) ([]*models.GroupMessage, error)
 	GroupExists(key string) (bool, error)
 	AddMemberToGroup(groupKey string, member string) error
@@ -20,6 +109,30 @@ type MessageRepository interface {
 	SendGroupMessage(key string, msg *models.GroupMessage) error
 	SendBroadcastMessage(key string, msg *models.BroadcastMessage) error
 	GetBroadcastHistory(key string) ([]*models.BroadcastMessage, error)
+	GetGroupMembers(groupKey string) ([]string, error)
+	GetGroupsMembers(groupKeys []string) (map[string][]string, error)
+	GetMessageRef(id string) (*models.MessageRef, error)
+	GetMessage(ref *models.MessageRef) (*models.Message, error)
+	UpdateMessage(ref *models.MessageRef, previous *models.Message, msg *models.Message, revision *models.MessageRevision) (bool, error)
+	GetMessageRevisions(id string) ([]*models.MessageRevision, error)
+	HideMessage(user string, id string) error
+	GetHiddenMessages(user string) (map[string]bool, error)
+	SetGroupRole(rolesKey string, member string, role string, adminRole string) (bool, error)
+	GetGroupRole(rolesKey string, member string) (string, error)
+	AddReply(parentID string, replyID string, timestamp string, participants ...string) error
+	GetReplyIDs(parentID string, start, stop int64) ([]string, int64, error)
+	GetThreadParticipants(parentID string) ([]string, error)
+	FillThreadStats(metas []*models.MessageMeta) error
+	GetMessages(ids []string) ([]*models.Message, error)
+	AddReaction(id string, emoji string, user string, maxKinds int64) (int64, bool, error)
+	RemoveReaction(id string, emoji string, user string) (int64, error)
+	GetReactions(ids []string, viewer string) (map[string][]models.Reaction, error)
+	GetConversationKeys() ([]string, error)
+	GetGroupNames() ([]string, error)
+	GetConversationMessages(key string) ([]*models.Message, error)
+	GetConversationRange(key string, start, stop int64) ([]*models.Message, int64, error)
+	ReserveClientMessage(user string, clientID string, value string, ttl time.Duration) (string, bool, error)
+	ReleaseClientMessage(user string, clientID string) error
 }
 
 type messageRepository struct {
@@ -33,11 +146,7 @@ func NewMessageRepository(redisService infrastructure.RedisService) MessageRepos
 }
 
 func (r *messageRepository) SaveDirectMessage(key string, msg *models.DirectMessage) error {
-	msgJSON, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	return r.redisService.GetClient().RPush(context.Background(), key, msgJSON).Err()
+	return r.pushMessage(key, msg.ID, msg)
 }
 
 func (r *messageRepository) GetDirectMessage(key string, index int64) (*models.DirectMessage, error) {
@@ -70,8 +179,16 @@ func (r *messageRepository) GetDMHistory(key string) ([]*models.DirectMessage, e
 	return messages, nil
 }
 
-func (r *messageRepository) CreateGroup(groupKey string, members []string) error {
-	return r.redisService.GetClient().SAdd(context.Background(), groupKey, members).Err()
+// CreateGroup adds the members of a new group and gives the first of them
+// creatorRole. It reports false, changing nothing, when the group exists.
+func (r *messageRepository) CreateGroup(membersKey string, rolesKey string, members []string, creatorRole string) (bool, error) {
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, creatorRole)
+	for _, member := range members {
+		args = append(args, member)
+	}
+	created, err := createGroupScript.Run(context.Background(), r.redisService.GetClient(), []string{membersKey, rolesKey}, args...).Int()
+	return created == 1, err
 }
 
 func (r *messageRepository) GetGroupHistory(groupKey string) ([]*models.GroupMessage, error) {
@@ -107,34 +224,458 @@ func (r *messageRepository) IsMemberOfGroup(groupKey string, member string) (boo
 }
 
 func (r *messageRepository) SendGroupMessage(groupKey string, msg *models.GroupMessage) error {
+	return r.pushMessage(groupKey, msg.ID, msg)
+}
+
+func (r *messageRepository) SendBroadcastMessage(key string, msg *models.BroadcastMessage) error {
+	return r.pushMessage(key, msg.ID, msg)
+}
+
+func (r *messageRepository) GetBroadcastHistory(key string) ([]*models.BroadcastMessage, error) {
+	msgs, err := r.redisService.GetClient().LRange(context.Background(), key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*models.BroadcastMessage
+	for _, msgJSON := range msgs {
+		var msg models.BroadcastMessage
+		if err := json.Unmarshal([]byte(msgJSON), &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, &msg)
+	}
+	return messages, nil
+}
+
+func (r *messageRepository) GetGroupMembers(groupKey string) ([]string, error) {
+	return r.redisService.GetClient().SMembers(context.Background(), groupKey).Result()
+}
+
+// GetGroupsMembers returns the members of several groups in one round trip.
+// Groups that do not exist have no entry.
+func (r *messageRepository) GetGroupsMembers(groupKeys []string) (map[string][]string, error) {
+	members := make(map[string][]string, len(groupKeys))
+	if len(groupKeys) == 0 {
+		return members, nil
+	}
+
+	pipe := r.redisService.GetClient().Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(groupKeys))
+	for i, key := range groupKeys {
+		cmds[i] = pipe.SMembers(context.Background(), key)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, err
+	}
+	for i, key := range groupKeys {
+		if len(cmds[i].Val()) > 0 {
+			members[key] = cmds[i].Val()
+		}
+	}
+	return members, nil
+}
+
+// pushMessage appends msg to the conversation list and records where it landed
+// so the message can later be addressed by its ID. Both are one script, so no
+// message is stored without its ID.
+func (r *messageRepository) pushMessage(key string, id string, msg interface{}) error {
 	msgJSON, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	return r.redisService.GetClient().RPush(context.Background(), groupKey, msgJSON).Err()
+	return pushMessageScript.Run(context.Background(), r.redisService.GetClient(), []string{key, "message:" + id}, msgJSON).Err()
 }
 
-func (r *messageRepository) SendBroadcastMessage(key string, msg *models.BroadcastMessage) error {
+// GetMessageRef returns nil when no message with the given ID exists.
+func (r *messageRepository) GetMessageRef(id string) (*models.MessageRef, error) {
+	fields, err := r.redisService.GetClient().HGetAll(context.Background(), "message:"+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	index, err := strconv.ParseInt(fields["index"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &models.MessageRef{ID: id, Key: fields["key"], Index: index}, nil
+}
+
+func (r *messageRepository) GetMessage(ref *models.MessageRef) (*models.Message, error) {
+	msgJSON, err := r.redisService.GetClient().LIndex(context.Background(), ref.Key, ref.Index).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg models.Message
+	if err := json.Unmarshal([]byte(msgJSON), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// UpdateMessage replaces the message with msg, provided it is still as
+// previous was read: not deleted, with the same content and edit time. It
+// reports false, writing nothing, when it is not. The revision, if any, is
+// kept in the same step, and the revisions of a deleted msg are dropped.
+func (r *messageRepository) UpdateMessage(ref *models.MessageRef, previous *models.Message, msg *models.Message, revision *models.MessageRevision) (bool, error) {
 	msgJSON, err := json.Marshal(msg)
 	if err != nil {
+		return false, err
+	}
+	var revisionJSON []byte
+	if revision != nil {
+		if revisionJSON, err = json.Marshal(revision); err != nil {
+			return false, err
+		}
+	}
+	dropRevisions := "0"
+	if msg.Deleted {
+		dropRevisions = "1"
+	}
+
+	keys := []string{ref.Key, "message:" + ref.ID + ":revisions"}
+	updated, err := updateMessageScript.Run(context.Background(), r.redisService.GetClient(), keys,
+		ref.Index, ref.ID, previous.Content, previous.EditedAt, msgJSON, revisionJSON, dropRevisions).Int()
+	return updated == 1, err
+}
+
+func (r *messageRepository) GetMessageRevisions(id string) ([]*models.MessageRevision, error) {
+	revs, err := r.redisService.GetClient().LRange(context.Background(), "message:"+id+":revisions", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []*models.MessageRevision{}
+	for _, revJSON := range revs {
+		var rev models.MessageRevision
+		if err := json.Unmarshal([]byte(revJSON), &rev); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &rev)
+	}
+	return revisions, nil
+}
+
+func (r *messageRepository) HideMessage(user string, id string) error {
+	return r.redisService.GetClient().SAdd(context.Background(), "user:"+user+":hidden_messages", id).Err()
+}
+
+func (r *messageRepository) GetHiddenMessages(user string) (map[string]bool, error) {
+	ids, err := r.redisService.GetClient().SMembers(context.Background(), "user:"+user+":hidden_messages").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		hidden[id] = true
+	}
+	return hidden, nil
+}
+
+// SetGroupRole gives the member a role. It reports false, changing nothing,
+// when the member is the last one with adminRole and would lose it; the count
+// and the write are one script, so two admins cannot demote each other at
+// once.
+func (r *messageRepository) SetGroupRole(rolesKey string, member string, role string, adminRole string) (bool, error) {
+	set, err := setGroupRoleScript.Run(context.Background(), r.redisService.GetClient(), []string{rolesKey}, member, role, adminRole).Int()
+	return set == 1, err
+}
+
+// GetGroupRole returns an empty role for users that were never assigned one.
+func (r *messageRepository) GetGroupRole(rolesKey string, member string) (string, error) {
+	role, err := r.redisService.GetClient().HGet(context.Background(), rolesKey, member).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return role, err
+}
+
+// AddReply appends the reply to its parent's thread and updates the parent's
+// reply count, last reply time and thread participants.
+func (r *messageRepository) AddReply(parentID string, replyID string, timestamp string, participants ...string) error {
+	_, err := r.redisService.GetClient().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.RPush(context.Background(), "message:"+parentID+":replies", replyID)
+		pipe.HIncrBy(context.Background(), "message:"+parentID, "reply_count", 1)
+		pipe.HSet(context.Background(), "message:"+parentID, "last_reply_at", timestamp)
+		for _, participant := range participants {
+			pipe.SAdd(context.Background(), "message:"+parentID+":thread_participants", participant)
+		}
+		return nil
+	})
+	return err
+}
+
+// GetReplyIDs returns one page of reply IDs in send order and the total count.
+func (r *messageRepository) GetReplyIDs(parentID string, start, stop int64) ([]string, int64, error) {
+	key := "message:" + parentID + ":replies"
+	total, err := r.redisService.GetClient().LLen(context.Background(), key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ids, err := r.redisService.GetClient().LRange(context.Background(), key, start, stop).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	return ids, total, nil
+}
+
+func (r *messageRepository) GetThreadParticipants(parentID string) ([]string, error) {
+	return r.redisService.GetClient().SMembers(context.Background(), "message:"+parentID+":thread_participants").Result()
+}
+
+// FillThreadStats sets the reply count and last reply time of each message.
+func (r *messageRepository) FillThreadStats(metas []*models.MessageMeta) error {
+	if len(metas) == 0 {
+		return nil
+	}
+
+	pipe := r.redisService.GetClient().Pipeline()
+	cmds := make([]*redis.SliceCmd, len(metas))
+	for i, meta := range metas {
+		cmds[i] = pipe.HMGet(context.Background(), "message:"+meta.ID, "reply_count", "last_reply_at")
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
 		return err
 	}
-	return r.redisService.GetClient().RPush(context.Background(), key, msgJSON).Err()
+
+	for i, meta := range metas {
+		vals := cmds[i].Val()
+		if count, ok := vals[0].(string); ok {
+			meta.ReplyCount, _ = strconv.ParseInt(count, 10, 64)
+		}
+		if lastReplyAt, ok := vals[1].(string); ok {
+			meta.LastReplyAt = lastReplyAt
+		}
+	}
+	return nil
 }
 
-func (r *messageRepository) GetBroadcastHistory(key string) ([]*models.BroadcastMessage, error) {
+// GetMessages loads several messages by ID, skipping IDs that do not exist.
+func (r *messageRepository) GetMessages(ids []string) ([]*models.Message, error) {
+	messages := []*models.Message{}
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	refPipe := r.redisService.GetClient().Pipeline()
+	refCmds := make([]*redis.SliceCmd, len(ids))
+	for i, id := range ids {
+		refCmds[i] = refPipe.HMGet(context.Background(), "message:"+id, "key", "index")
+	}
+	if _, err := refPipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	msgPipe := r.redisService.GetClient().Pipeline()
+	var msgCmds []*redis.StringCmd
+	for _, cmd := range refCmds {
+		key, ok1 := cmd.Val()[0].(string)
+		indexStr, ok2 := cmd.Val()[1].(string)
+		if !ok1 || !ok2 {
+			continue
+		}
+		index, err := strconv.ParseInt(indexStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		msgCmds = append(msgCmds, msgPipe.LIndex(context.Background(), key, index))
+	}
+	if len(msgCmds) == 0 {
+		return messages, nil
+	}
+	if _, err := msgPipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for _, cmd := range msgCmds {
+		if cmd.Err() != nil {
+			continue
+		}
+		var msg models.Message
+		if err := json.Unmarshal([]byte(cmd.Val()), &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, &msg)
+	}
+	return messages, nil
+}
+
+// AddReaction records the user's reaction and returns how many users have
+// now reacted with that emoji. A new emoji is refused, reporting false, when
+// the message already has maxKinds of them; zero means no cap. The check and
+// the write are one script, so concurrent reactions cannot exceed the cap.
+func (r *messageRepository) AddReaction(id string, emoji string, user string, maxKinds int64) (int64, bool, error) {
+	keys := []string{"message:" + id + ":reactions", "message:" + id + ":reactions:" + emoji}
+	count, err := addReactionScript.Run(context.Background(), r.redisService.GetClient(), keys, emoji, user, maxKinds).Int64()
+	if err != nil {
+		return 0, false, err
+	}
+	if count < 0 {
+		return 0, false, nil
+	}
+	return count, true, nil
+}
+
+// RemoveReaction drops the user's reaction and returns how many users still
+// react with that emoji. The emoji is forgotten once nobody uses it.
+func (r *messageRepository) RemoveReaction(id string, emoji string, user string) (int64, error) {
+	keys := []string{"message:" + id + ":reactions", "message:" + id + ":reactions:" + emoji}
+	return removeReactionScript.Run(context.Background(), r.redisService.GetClient(), keys, emoji, user).Int64()
+}
+
+// GetReactions aggregates the reactions of each message, most used first,
+// flagging the ones the viewer added.
+func (r *messageRepository) GetReactions(ids []string, viewer string) (map[string][]models.Reaction, error) {
+	reactions := make(map[string][]models.Reaction)
+	if len(ids) == 0 {
+		return reactions, nil
+	}
+
+	kindPipe := r.redisService.GetClient().Pipeline()
+	kindCmds := make([]*redis.StringSliceCmd, len(ids))
+	for i, id := range ids {
+		kindCmds[i] = kindPipe.SMembers(context.Background(), "message:"+id+":reactions")
+	}
+	if _, err := kindPipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	type reactionCmds struct {
+		id    string
+		emoji string
+		count *redis.IntCmd
+		mine  *redis.BoolCmd
+	}
+	var pending []reactionCmds
+	countPipe := r.redisService.GetClient().Pipeline()
+	for i, id := range ids {
+		for _, emoji := range kindCmds[i].Val() {
+			usersKey := "message:" + id + ":reactions:" + emoji
+			pending = append(pending, reactionCmds{
+				id:    id,
+				emoji: emoji,
+				count: countPipe.SCard(context.Background(), usersKey),
+				mine:  countPipe.SIsMember(context.Background(), usersKey, viewer),
+			})
+		}
+	}
+	if len(pending) == 0 {
+		return reactions, nil
+	}
+	if _, err := countPipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for _, p := range pending {
+		if p.count.Val() == 0 {
+			continue
+		}
+		reactions[p.id] = append(reactions[p.id], models.Reaction{Emoji: p.emoji, Count: p.count.Val(), ReactedByMe: p.mine.Val()})
+	}
+	for _, list := range reactions {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Count != list[j].Count {
+				return list[i].Count > list[j].Count
+			}
+			return list[i].Emoji < list[j].Emoji
+		})
+	}
+	return reactions, nil
+}
+
+// GetConversationKeys lists the message lists of every DM, group and the
+// broadcast stream. It scans the keyspace and is meant for maintenance tasks.
+func (r *messageRepository) GetConversationKeys() ([]string, error) {
+	keys := []string{}
+	for _, pattern := range []string{"dm:*", "group:*:messages", "broadcast:messages"} {
+		iter := r.redisService.GetClient().Scan(context.Background(), 0, pattern, 100).Iterator()
+		for iter.Next(context.Background()) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// GetGroupNames lists every group, including those without messages. Like
+// GetConversationKeys it scans the keyspace.
+func (r *messageRepository) GetGroupNames() ([]string, error) {
+	names := []string{}
+	iter := r.redisService.GetClient().Scan(context.Background(), 0, "group:*:members", 100).Iterator()
+	for iter.Next(context.Background()) {
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "group:"), ":members"))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (r *messageRepository) GetConversationMessages(key string) ([]*models.Message, error) {
 	msgs, err := r.redisService.GetClient().LRange(context.Background(), key, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	var messages []*models.BroadcastMessage
+	messages := []*models.Message{}
 	for _, msgJSON := range msgs {
-		var msg models.BroadcastMessage
+		var msg models.Message
 		if err := json.Unmarshal([]byte(msgJSON), &msg); err != nil {
 			return nil, err
 		}
 		messages = append(messages, &msg)
 	}
 	return messages, nil
-}
\ No newline at end of file
+}
+
+// GetConversationRange returns the messages of a conversation from start to
+// stop, inclusive, and the length of the conversation.
+func (r *messageRepository) GetConversationRange(key string, start, stop int64) ([]*models.Message, int64, error) {
+	pipe := r.redisService.GetClient().Pipeline()
+	lengthCmd := pipe.LLen(context.Background(), key)
+	rangeCmd := pipe.LRange(context.Background(), key, start, stop)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, 0, err
+	}
+
+	messages := []*models.Message{}
+	for _, msgJSON := range rangeCmd.Val() {
+		var msg models.Message
+		if err := json.Unmarshal([]byte(msgJSON), &msg); err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, &msg)
+	}
+	return messages, lengthCmd.Val(), nil
+}
+
+// ReserveClientMessage claims a client message ID of the user for ttl, storing
+// value with it. When the ID was already claimed it reports false along with
+// the value stored by the first claim.
+func (r *messageRepository) ReserveClientMessage(user string, clientID string, value string, ttl time.Duration) (string, bool, error) {
+	key := "client_message:" + user + ":" + clientID
+	reserved, err := r.redisService.GetClient().SetNX(context.Background(), key, value, ttl).Result()
+	if err != nil || reserved {
+		return value, reserved, err
+	}
+
+	existing, err := r.redisService.GetClient().Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		// The claim expired in between; claim it afresh
+		return r.ReserveClientMessage(user, clientID, value, ttl)
+	}
+	return existing, false, err
+}
+
+// ReleaseClientMessage drops a claim so a failed send can be retried.
+func (r *messageRepository) ReleaseClientMessage(user string, clientID string) error {
+	return r.redisService.GetClient().Del(context.Background(), "client_message:"+user+":"+clientID).Err()
+}
@@ -0,0 +1,84 @@
+package repositories
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+)
+
+// newTestRedis returns a Redis service backed by an in-memory server.
+func newTestRedis(t *testing.T) infrastructure.RedisService {
+	t.Helper()
+	redisService := infrastructure.NewRedisService(miniredis.RunT(t).Addr())
+	t.Cleanup(func() { redisService.Close() })
+	return redisService
+}
+
+func saveDM(t *testing.T, repo MessageRepository, id, content string) *models.MessageRef {
+	t.Helper()
+	msg := &models.DirectMessage{MessageMeta: models.MessageMeta{ID: id}, From: "alice", To: "bob", Content: content, Timestamp: "2000-01-01T00:00:00Z"}
+	if err := repo.SaveDirectMessage("dm:alice:bob", msg); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.GetMessageRef(id)
+	if err != nil || ref == nil {
+		t.Fatalf("message %s has no ref: %v", id, err)
+	}
+	return ref
+}
+
+func TestSavedMessagesAreAddressedByID(t *testing.T) {
+	repo := NewMessageRepository(newTestRedis(t))
+	saveDM(t, repo, "m1", "first")
+	ref := saveDM(t, repo, "m2", "second")
+
+	if ref.Key != "dm:alice:bob" || ref.Index != 1 {
+		t.Errorf("m2 is at %s[%d], want dm:alice:bob[1]", ref.Key, ref.Index)
+	}
+	msg, err := repo.GetMessage(ref)
+	if err != nil || msg.ID != "m2" || msg.Content != "second" {
+		t.Errorf("GetMessage = %+v, %v", msg, err)
+	}
+}
+
+// An update is written only if the message is still as it was read, so an
+// edit read before a delete cannot bring the deleted content back.
+func TestUpdateMessageRefusesChangedMessages(t *testing.T) {
+	repo := NewMessageRepository(newTestRedis(t))
+	ref := saveDM(t, repo, "m1", "original")
+	read, _ := repo.GetMessage(ref)
+
+	edited := *read
+	edited.Content, edited.EditedAt = "edited", "2000-01-01T00:01:00Z"
+	revision := &models.MessageRevision{Content: "original", Timestamp: read.Timestamp}
+	if ok, err := repo.UpdateMessage(ref, read, &edited, revision); !ok || err != nil {
+		t.Fatalf("edit: %v, %v", ok, err)
+	}
+	if ok, err := repo.UpdateMessage(ref, read, &edited, revision); ok || err != nil {
+		t.Fatalf("edit from a stale read: %v, %v", ok, err)
+	}
+	if revisions, _ := repo.GetMessageRevisions("m1"); len(revisions) != 1 {
+		t.Errorf("expected one revision, got %d", len(revisions))
+	}
+
+	tombstone := edited
+	tombstone.Content, tombstone.Deleted = "", true
+	if ok, err := repo.UpdateMessage(ref, &edited, &tombstone, nil); !ok || err != nil {
+		t.Fatalf("delete: %v, %v", ok, err)
+	}
+	if revisions, _ := repo.GetMessageRevisions("m1"); len(revisions) != 0 {
+		t.Errorf("expected the revisions to be dropped, got %d", len(revisions))
+	}
+
+	late := edited
+	late.Content = "edited again"
+	if ok, err := repo.UpdateMessage(ref, &edited, &late, nil); ok || err != nil {
+		t.Fatalf("edit of a deleted message: %v, %v", ok, err)
+	}
+	if stored, _ := repo.GetMessage(ref); !stored.Deleted || stored.Content != "" {
+		t.Errorf("the tombstone was overwritten: %+v", stored)
+	}
+}
@@ -0,0 +1,151 @@
+package repositories
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+)
+
+// Presence is tracked per connection ("session"). Each session has an expiry
+// that its node keeps pushing forward; a session whose node stops doing so
+// (e.g. it crashed) is reaped once the expiry passes.
+//
+//	presence:sessions        zset "<session>:<user>" -> expiry, used to find expired sessions
+//	presence:user:<user>     zset <session> -> expiry, the user's live sessions
+//	presence:state           hash user -> away (absent means online)
+//	presence:last_seen       hash user -> unix milliseconds
+type PresenceRepository interface {
+	SaveSession(user string, session string, expiry int64) error
+	RemoveSession(user string, session string) (bool, error)
+	CountLiveSessions(user string, now int64) (int64, error)
+	GetExpiredSessions(now int64) ([]string, []string, error)
+	SetState(user string, state string) error
+	GetStates(users []string, now int64) (map[string]string, error)
+	SetLastSeen(user string, at int64) error
+	GetLastSeen(users []string) (map[string]int64, error)
+}
+
+type presenceRepository struct {
+	redisService infrastructure.RedisService
+}
+
+func NewPresenceRepository(redisService infrastructure.RedisService) PresenceRepository {
+	return &presenceRepository{
+		redisService: redisService,
+	}
+}
+
+// SaveSession creates or refreshes a session until expiry (unix milliseconds).
+func (r *presenceRepository) SaveSession(user string, session string, expiry int64) error {
+	_, err := r.redisService.GetClient().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(context.Background(), "presence:sessions", &redis.Z{Score: float64(expiry), Member: session + ":" + user})
+		pipe.ZAdd(context.Background(), "presence:user:"+user, &redis.Z{Score: float64(expiry), Member: session})
+		return nil
+	})
+	return err
+}
+
+// RemoveSession reports whether the session still existed, so that exactly
+// one caller acts on its removal.
+func (r *presenceRepository) RemoveSession(user string, session string) (bool, error) {
+	removed, err := r.redisService.GetClient().ZRem(context.Background(), "presence:sessions", session+":"+user).Result()
+	if err != nil {
+		return false, err
+	}
+	if err := r.redisService.GetClient().ZRem(context.Background(), "presence:user:"+user, session).Err(); err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+func (r *presenceRepository) CountLiveSessions(user string, now int64) (int64, error) {
+	return r.redisService.GetClient().ZCount(context.Background(), "presence:user:"+user, "("+strconv.FormatInt(now, 10), "+inf").Result()
+}
+
+// GetExpiredSessions returns the users and session IDs whose expiry is before now.
+func (r *presenceRepository) GetExpiredSessions(now int64) ([]string, []string, error) {
+	members, err := r.redisService.GetClient().ZRangeByScore(context.Background(), "presence:sessions", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var users, sessions []string
+	for _, member := range members {
+		// Session IDs never contain ':', usernames might
+		session, user, ok := strings.Cut(member, ":")
+		if !ok {
+			continue
+		}
+		users = append(users, user)
+		sessions = append(sessions, session)
+	}
+	return users, sessions, nil
+}
+
+func (r *presenceRepository) SetState(user string, state string) error {
+	if state == "" {
+		return r.redisService.GetClient().HDel(context.Background(), "presence:state", user).Err()
+	}
+	return r.redisService.GetClient().HSet(context.Background(), "presence:state", user, state).Err()
+}
+
+// GetStates returns the state of every user with a live session; users
+// missing from the result are offline.
+func (r *presenceRepository) GetStates(users []string, now int64) (map[string]string, error) {
+	states := make(map[string]string, len(users))
+	if len(users) == 0 {
+		return states, nil
+	}
+
+	pipe := r.redisService.GetClient().Pipeline()
+	live := make([]*redis.IntCmd, len(users))
+	for i, user := range users {
+		live[i] = pipe.ZCount(context.Background(), "presence:user:"+user, "("+strconv.FormatInt(now, 10), "+inf")
+	}
+	stateCmd := pipe.HMGet(context.Background(), "presence:state", users...)
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	stored := stateCmd.Val()
+	for i, user := range users {
+		if live[i].Val() == 0 {
+			continue
+		}
+		states[user] = models.PresenceOnline
+		if state, ok := stored[i].(string); ok {
+			states[user] = state
+		}
+	}
+	return states, nil
+}
+
+func (r *presenceRepository) SetLastSeen(user string, at int64) error {
+	return r.redisService.GetClient().HSet(context.Background(), "presence:last_seen", user, at).Err()
+}
+
+func (r *presenceRepository) GetLastSeen(users []string) (map[string]int64, error) {
+	lastSeen := make(map[string]int64, len(users))
+	if len(users) == 0 {
+		return lastSeen, nil
+	}
+
+	vals, err := r.redisService.GetClient().HMGet(context.Background(), "presence:last_seen", users...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, user := range users {
+		if s, ok := vals[i].(string); ok {
+			lastSeen[user], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return lastSeen, nil
+}
@@ -0,0 +1,194 @@
+package repositories
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/google/uuid"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+)
+
+type SearchRepository interface {
+	IndexMessage(doc *models.SearchDocument, terms []string) error
+	RemoveMessage(id string) error
+	FindMessages(keys []string, terms []string, from string, exclude []string, min, max, offset, limit int64) ([]string, int64, error)
+	GetDocuments(ids []string) ([]*models.SearchDocument, error)
+	Clear() error
+}
+
+type searchRepository struct {
+	redisService infrastructure.RedisService
+}
+
+func NewSearchRepository(redisService infrastructure.RedisService) SearchRepository {
+	return &searchRepository{
+		redisService: redisService,
+	}
+}
+
+// Posting lists are kept per conversation, so that a search only reads the
+// lists of the conversations it covers.
+func termKey(key string, term string) string {
+	return "search:" + key + ":term:" + term
+}
+
+// senderKey is the posting list of the messages a user sent to a
+// conversation, to filter on the sender the way terms are.
+func senderKey(key string, from string) string {
+	return "search:" + key + ":from:" + from
+}
+
+// IndexMessage adds the message to the posting list of every term and of its
+// sender in its conversation, scored by its send time, and remembers the
+// terms so the entry can be removed later.
+func (r *searchRepository) IndexMessage(doc *models.SearchDocument, terms []string) error {
+	score := float64(doc.Timestamp)
+	_, err := r.redisService.GetClient().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for _, term := range terms {
+			pipe.ZAdd(context.Background(), termKey(doc.Key, term), &redis.Z{Score: score, Member: doc.ID})
+			pipe.SAdd(context.Background(), "search:doc:"+doc.ID+":terms", term)
+		}
+		pipe.ZAdd(context.Background(), senderKey(doc.Key, doc.From), &redis.Z{Score: score, Member: doc.ID})
+		pipe.HSet(context.Background(), "search:doc:"+doc.ID, "key", doc.Key, "from", doc.From, "ts", doc.Timestamp)
+		return nil
+	})
+	return err
+}
+
+func (r *searchRepository) RemoveMessage(id string) error {
+	pipe := r.redisService.GetClient().Pipeline()
+	docCmd := pipe.HMGet(context.Background(), "search:doc:"+id, "key", "from")
+	termsCmd := pipe.SMembers(context.Background(), "search:doc:"+id+":terms")
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return err
+	}
+	key, ok := docCmd.Val()[0].(string)
+	if !ok {
+		return nil // not indexed
+	}
+	from, _ := docCmd.Val()[1].(string)
+
+	_, err := r.redisService.GetClient().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for _, term := range termsCmd.Val() {
+			pipe.ZRem(context.Background(), termKey(key, term), id)
+		}
+		pipe.ZRem(context.Background(), senderKey(key, from), id)
+		pipe.Del(context.Background(), "search:doc:"+id+":terms", "search:doc:"+id)
+		return nil
+	})
+	return err
+}
+
+// FindMessages returns one page of the IDs of the messages of the given
+// conversations that contain every term, were sent by from (any sender if
+// empty) between min and max (unix seconds) and are not excluded, newest
+// first, along with how many there are in all. Only the posting lists of
+// those conversations are read, and only the page leaves Redis.
+func (r *searchRepository) FindMessages(keys []string, terms []string, from string, exclude []string, min, max, offset, limit int64) ([]string, int64, error) {
+	if len(keys) == 0 || len(terms) == 0 {
+		return []string{}, 0, nil
+	}
+
+	// Each filter is the union of its posting lists across the
+	// conversations; the hits are the intersection of the filters
+	filters := make([][]string, 0, len(terms)+1)
+	for _, term := range terms {
+		lists := make([]string, len(keys))
+		for i, key := range keys {
+			lists[i] = termKey(key, term)
+		}
+		filters = append(filters, lists)
+	}
+	if from != "" {
+		lists := make([]string, len(keys))
+		for i, key := range keys {
+			lists[i] = senderKey(key, from)
+		}
+		filters = append(filters, lists)
+	}
+
+	// The temporary sets live within the transaction only
+	hitsKey := "search:tmp:" + uuid.New().String()
+	temporary := make([]string, len(filters))
+	excluded := make([]interface{}, len(exclude))
+	for i, id := range exclude {
+		excluded[i] = id
+	}
+	minScore, maxScore := strconv.FormatInt(min, 10), strconv.FormatInt(max, 10)
+	var totalCmd *redis.IntCmd
+	var idsCmd *redis.StringSliceCmd
+	_, err := r.redisService.GetClient().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for i, lists := range filters {
+			temporary[i] = hitsKey + ":" + strconv.Itoa(i)
+			pipe.ZUnionStore(context.Background(), temporary[i], &redis.ZStore{Keys: lists, Aggregate: "MAX"})
+		}
+		pipe.ZInterStore(context.Background(), hitsKey, &redis.ZStore{Keys: temporary, Aggregate: "MAX"})
+		if len(excluded) > 0 {
+			pipe.ZRem(context.Background(), hitsKey, excluded...)
+		}
+		totalCmd = pipe.ZCount(context.Background(), hitsKey, minScore, maxScore)
+		idsCmd = pipe.ZRevRangeByScore(context.Background(), hitsKey, &redis.ZRangeBy{Min: minScore, Max: maxScore, Offset: offset, Count: limit})
+		pipe.Del(context.Background(), append(temporary, hitsKey)...)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return idsCmd.Val(), totalCmd.Val(), nil
+}
+
+// GetDocuments returns the index entries of the given messages in the same
+// order, skipping IDs that are not indexed.
+func (r *searchRepository) GetDocuments(ids []string) ([]*models.SearchDocument, error) {
+	docs := []*models.SearchDocument{}
+	if len(ids) == 0 {
+		return docs, nil
+	}
+
+	pipe := r.redisService.GetClient().Pipeline()
+	cmds := make([]*redis.SliceCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HMGet(context.Background(), "search:doc:"+id, "key", "from", "ts")
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		vals := cmd.Val()
+		key, ok1 := vals[0].(string)
+		from, ok2 := vals[1].(string)
+		ts, ok3 := vals[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+		timestamp, _ := strconv.ParseInt(ts, 10, 64)
+		docs = append(docs, &models.SearchDocument{ID: ids[i], Key: key, From: from, Timestamp: timestamp})
+	}
+	return docs, nil
+}
+
+// Clear drops the whole index, for it to be rebuilt.
+func (r *searchRepository) Clear() error {
+	iter := r.redisService.GetClient().Scan(context.Background(), 0, "search:*", 100).Iterator()
+	var batch []string
+	for iter.Next(context.Background()) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 100 {
+			if err := r.redisService.GetClient().Del(context.Background(), batch...).Err(); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return r.redisService.GetClient().Del(context.Background(), batch...).Err()
+	}
+	return nil
+}
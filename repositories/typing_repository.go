@@ -0,0 +1,38 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+)
+
+// Typing indicators are never stored; only how recently each user relayed one
+// is, so that refreshes are limited across every node and API.
+//
+//	typing:<user>:<conversation>   set while the last start is within the interval
+type TypingRepository interface {
+	ThrottleTyping(user string, conversation string, interval time.Duration) (bool, error)
+	ClearTypingThrottle(user string, conversation string) error
+}
+
+type typingRepository struct {
+	redisService infrastructure.RedisService
+}
+
+func NewTypingRepository(redisService infrastructure.RedisService) TypingRepository {
+	return &typingRepository{
+		redisService: redisService,
+	}
+}
+
+// ThrottleTyping reports whether the user may relay a start in the
+// conversation now, and if so holds off the next one for interval.
+func (r *typingRepository) ThrottleTyping(user string, conversation string, interval time.Duration) (bool, error) {
+	return r.redisService.GetClient().SetNX(context.Background(), "typing:"+user+":"+conversation, 1, interval).Result()
+}
+
+// ClearTypingThrottle lets the user's next start through, e.g. after a stop.
+func (r *typingRepository) ClearTypingThrottle(user string, conversation string) error {
+	return r.redisService.GetClient().Del(context.Background(), "typing:"+user+":"+conversation).Err()
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/haileamlak/chat-system/infrastructure"
 )
 
@@ -43,9 +44,14 @@ func (r *userRepository) CreateUser(ctx context.Context, username string, passwo
 	return nil
 }
 
+// GetUserPassword returns an empty hash for users that do not exist.
 func (r *userRepository) GetUserPassword(ctx context.Context, username string) (string, error) {
 	key := "user:" + username
-	return r.redisService.GetClient().HGet(ctx, key, "password").Result()
+	password, err := r.redisService.GetClient().HGet(ctx, key, "password").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return password, err
 }
 
 func (r *userRepository) SaveSession(ctx context.Context, token string, username string) error {
@@ -0,0 +1,480 @@
+package routers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"github.com/haileamlak/chat-system/controllers"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/protocol"
+	"github.com/haileamlak/chat-system/repositories"
+	"github.com/haileamlak/chat-system/usecases"
+)
+
+const documentURL = "file:///openapi.json"
+
+// document is protocol/openapi.json, with its response schemas compiled on
+// demand.
+var (
+	documentOnce sync.Once
+	documentErr  error
+	document     struct {
+		Paths      map[string]map[string]operation `json:"paths"`
+		Components struct {
+			Responses map[string]response `json:"responses"`
+		} `json:"components"`
+	}
+	compiler = jsonschema.NewCompiler()
+)
+
+type operation struct {
+	Responses map[string]response `json:"responses"`
+}
+
+type response struct {
+	Ref     string                     `json:"$ref"`
+	Content map[string]json.RawMessage `json:"content"`
+}
+
+func loadDocument() error {
+	if err := json.Unmarshal(protocol.OpenAPI, &document); err != nil {
+		return err
+	}
+	resource, err := jsonschema.UnmarshalJSON(bytes.NewReader(protocol.OpenAPI))
+	if err != nil {
+		return err
+	}
+	return compiler.AddResource(documentURL, resource)
+}
+
+// responseSchema returns the schema of an operation's JSON response with a
+// status and media type, or nil if the document gives the response no JSON
+// body.
+func responseSchema(method, path string, status int, mediaType string) (*jsonschema.Schema, error) {
+	op, ok := document.Paths[path][strings.ToLower(method)]
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not in the document", method, path)
+	}
+	code := strconv.Itoa(status)
+	resp, ok := op.Responses[code]
+	if !ok {
+		return nil, fmt.Errorf("%s %s does not document status %d", method, path, status)
+	}
+	pointer := "#/paths/" + escape(path) + "/" + strings.ToLower(method) + "/responses/" + code
+	if resp.Ref != "" {
+		name := strings.TrimPrefix(resp.Ref, "#/components/responses/")
+		resp, pointer = document.Components.Responses[name], "#/components/responses/"+name
+	}
+	var documented []string
+	for documentedType := range resp.Content {
+		if isJSON(documentedType) {
+			documented = append(documented, documentedType)
+		}
+	}
+	if len(documented) == 0 {
+		return nil, nil
+	}
+	if _, ok := resp.Content[mediaType]; !ok || !isJSON(mediaType) {
+		return nil, fmt.Errorf("%s %s serves status %d as %q, documented as %s", method, path, status, mediaType, strings.Join(documented, ", "))
+	}
+	return compiler.Compile(documentURL + pointer + "/content/" + escape(mediaType) + "/schema")
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func escape(key string) string {
+	return url.PathEscape(strings.NewReplacer("~", "~0", "/", "~1").Replace(key))
+}
+
+// apiTest is a server wired as in main.go over an in-memory Redis, with two
+// users signed up, alice and bob.
+type apiTest struct {
+	t          *testing.T
+	server     *httptest.Server
+	alice, bob string // tokens
+}
+
+func newAPITest(t *testing.T) *apiTest {
+	t.Helper()
+	documentOnce.Do(func() { documentErr = loadDocument() })
+	if documentErr != nil {
+		t.Fatalf("loading the OpenAPI document: %v", documentErr)
+	}
+	gin.SetMode(gin.TestMode)
+
+	redisService := infrastructure.NewRedisService(miniredis.RunT(t).Addr())
+	tokenService := infrastructure.NewTokenService(redisService)
+	presenceConfig := usecases.PresenceConfig{SessionTTL: time.Minute}
+	registry := infrastructure.NewConnectionRegistry(redisService, "node-a", presenceConfig.SessionTTL)
+	pubSubService := infrastructure.NewPubSubService(redisService, registry)
+	subscriberService := infrastructure.NewSubscriberService(redisService, "channel:broadcast", infrastructure.NodeChannel("node-a"))
+	authMiddleware := infrastructure.NewAuthMiddleware(tokenService)
+
+	messageRepo := repositories.NewMessageRepository(redisService)
+	searchRepo := repositories.NewSearchRepository(redisService)
+	attachmentRepo := repositories.NewAttachmentRepository(redisService)
+	conversationRepo := repositories.NewConversationRepository(redisService)
+	eventRepo := repositories.NewEventRepository(redisService)
+	typingRepo := repositories.NewTypingRepository(redisService)
+	blobStore, err := infrastructure.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userUseCase := usecases.NewUserUseCase(repositories.NewUserRepository(redisService), infrastructure.NewPasswordService(), tokenService)
+	messageUseCase := usecases.NewMessageUseCase(messageRepo, searchRepo, attachmentRepo, blobStore, conversationRepo, eventRepo, pubSubService, usecases.MessageConfig{
+		EditWindow:              15 * time.Minute,
+		MaxReactions:            20,
+		ReadReceiptMaxGroupSize: 20,
+		DedupeWindow:            24 * time.Hour,
+		EventLogSize:            1000,
+	})
+	searchUseCase := usecases.NewSearchUseCase(messageRepo, searchRepo, conversationRepo)
+	presenceUseCase := usecases.NewPresenceUseCase(repositories.NewPresenceRepository(redisService), conversationRepo, messageRepo, pubSubService, presenceConfig)
+	eventUseCase := usecases.NewEventUseCase(eventRepo, usecases.EventConfig{ReplayLimit: 500})
+	typingConfig := usecases.TypingConfig{TTL: 6 * time.Second, Interval: 2 * time.Second}
+	typingUseCase := usecases.NewTypingUseCase(messageRepo, typingRepo, pubSubService, typingConfig)
+	attachmentConfig := usecases.AttachmentConfig{MaxSize: 10 << 20}
+	attachmentUseCase := usecases.NewAttachmentUseCase(attachmentRepo, messageRepo, blobStore, infrastructure.NewThumbnailService(256), attachmentConfig)
+
+	webSocketController := controllers.NewWebSocketController(messageUseCase, presenceUseCase, typingUseCase, eventUseCase, subscriberService, registry, authMiddleware, controllers.WebSocketConfig{
+		HeartbeatInterval: presenceConfig.SessionTTL / 3,
+		TypingTTL:         typingConfig.TTL,
+		PingInterval:      30 * time.Second,
+		PongTimeout:       time.Minute,
+		WriteTimeout:      10 * time.Second,
+		MaxFrameSize:      64 << 10,
+	})
+	requestValidator, err := infrastructure.NewRequestValidator(protocol.OpenAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := SetupRouter(
+		controllers.NewUserController(userUseCase),
+		controllers.NewMessageController(messageUseCase),
+		controllers.NewSearchController(searchUseCase),
+		controllers.NewAttachmentController(attachmentUseCase, attachmentConfig.MaxSize),
+		controllers.NewConversationController(messageUseCase, typingUseCase),
+		controllers.NewPresenceController(presenceUseCase),
+		webSocketController,
+		controllers.NewGraphQLController(userUseCase, messageUseCase, presenceUseCase, webSocketController, authMiddleware),
+		authMiddleware.Authenticate(),
+		requestValidator.Validate(),
+	)
+
+	a := &apiTest{t: t, server: httptest.NewServer(router)}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		webSocketController.Shutdown(ctx)
+		a.server.Close()
+		redisService.Close()
+	})
+	a.alice, a.bob = a.signUp("alice"), a.signUp("bob")
+	return a
+}
+
+func (a *apiTest) signUp(name string) string {
+	a.t.Helper()
+	credentials := map[string]string{"username": name, "password": "password"}
+	a.expect("", http.StatusOK, "POST", "/signup", "/signup", credentials)
+	var session struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(a.expect("", http.StatusOK, "POST", "/login", "/login", credentials), &session)
+	return session.Token
+}
+
+// formBody is a multipart form to pass to call.
+type formBody struct {
+	data        *bytes.Buffer
+	contentType string
+}
+
+// call sends a request as the token's user to a route, documented by path,
+// and validates the response against the document. It returns the status
+// and body. Every request has an ID of its own, which the response must echo.
+func (a *apiTest) call(token, method, path, target string, body interface{}) (int, []byte) {
+	a.t.Helper()
+	var payload io.Reader
+	contentType := "application/json"
+	switch body := body.(type) {
+	case nil:
+	case *formBody:
+		payload, contentType = body.data, body.contentType
+	case *bytes.Buffer:
+		payload = body
+	default:
+		data, _ := json.Marshal(body)
+		payload = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequest(method, a.server.URL+target, payload)
+	if payload != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	requestID := "openapi-test-" + uuid.New().String()
+	req.Header.Set(infrastructure.RequestIDHeader, requestID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+
+	if got := resp.Header.Get(infrastructure.RequestIDHeader); got != requestID {
+		a.t.Errorf("%s %s: expected the request ID %s to be echoed, got %q", method, target, requestID, got)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode >= 400 {
+		if err := checkProblem(data, mediaType, resp.StatusCode, requestID); err != nil {
+			a.t.Errorf("%s %s: %v", method, target, err)
+		}
+	}
+	schema, err := responseSchema(method, path, resp.StatusCode, mediaType)
+	if err != nil {
+		a.t.Fatalf("%s %s: %v: %s", method, target, err, data)
+	}
+	if schema != nil {
+		instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			a.t.Fatalf("%s %s: response is not JSON: %s", method, target, data)
+		}
+		if err := schema.Validate(instance); err != nil {
+			a.t.Errorf("%s %s: response does not match the document: %v", method, target, err)
+		}
+	}
+	return resp.StatusCode, data
+}
+
+// expect calls a route and fails unless the response has the status.
+func (a *apiTest) expect(token string, status int, method, path, target string, body interface{}) []byte {
+	a.t.Helper()
+	got, data := a.call(token, method, path, target, body)
+	if got != status {
+		a.t.Fatalf("%s %s: expected %d, got %d: %s", method, target, status, got, data)
+	}
+	return data
+}
+
+// checkProblem checks that an error response is a problem with the code of
+// its status and the ID of its request.
+func checkProblem(data []byte, mediaType string, status int, requestID string) error {
+	if mediaType != infrastructure.ProblemContentType {
+		return fmt.Errorf("error served as %q, not as a problem: %s", mediaType, data)
+	}
+	var problem models.Problem
+	if err := json.Unmarshal(data, &problem); err != nil {
+		return fmt.Errorf("problem is not JSON: %s", data)
+	}
+	if problem.Status != status || problem.Code != models.ErrorCode(status) || problem.RequestID != requestID {
+		return fmt.Errorf("expected a problem with status %d, code %s and request ID %s, got %s", status, models.ErrorCode(status), requestID, data)
+	}
+	return nil
+}
+
+// timestamp is required on sends, but replaced by the server's time.
+const timestamp = "2000-01-01T00:00:00Z"
+
+// sendDM sends a DM from alice to bob and returns its ID.
+func (a *apiTest) sendDM(content string) string {
+	a.t.Helper()
+	data := a.expect(a.alice, http.StatusOK, "POST", "/dm/send", "/dm/send", map[string]string{"from": "alice", "to": "bob", "content": content, "timestamp": timestamp})
+	var sent struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(data, &sent)
+	return sent.ID
+}
+
+// step is a call and the status it must be answered with.
+type step struct {
+	token                string
+	status               int
+	method, path, target string
+	body                 interface{}
+}
+
+func (a *apiTest) run(steps []step) {
+	a.t.Helper()
+	for _, s := range steps {
+		a.expect(s.token, s.status, s.method, s.path, s.target, s.body)
+	}
+}
+
+func TestDocsAreServed(t *testing.T) {
+	a := newAPITest(t)
+	resp, err := http.Get(a.server.URL + "/docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "/openapi.json") {
+		t.Errorf("expected the UI to load /openapi.json, got %d: %.200s", resp.StatusCode, page)
+	}
+}
+
+func TestInvalidRequestsAreRejected(t *testing.T) {
+	a := newAPITest(t)
+	a.run([]step{
+		{"", http.StatusBadRequest, "POST", "/signup", "/signup", map[string]string{"username": "", "password": "x"}},
+		{a.alice, http.StatusBadRequest, "POST", "/dm/send", "/dm/send", map[string]string{"from": "alice", "to": "bob", "content": "no timestamp"}},
+		{a.alice, http.StatusBadRequest, "POST", "/dm/send", "/dm/send", bytes.NewBufferString("not json")},
+		{a.alice, http.StatusBadRequest, "GET", "/conversations", "/conversations?limit=0", nil},
+		{a.alice, http.StatusBadRequest, "GET", "/conversations", "/conversations?offset=first", nil},
+		{a.alice, http.StatusBadRequest, "GET", "/dm/{user}", "/dm/bob", nil},
+		{a.alice, http.StatusBadRequest, "DELETE", "/messages/{id}", "/messages/x?scope=all", nil},
+		{a.alice, http.StatusBadRequest, "PUT", "/presence", "/presence", map[string]string{"state": "busy"}},
+		{a.alice, http.StatusBadRequest, "POST", "/conversations/{id}/typing", "/conversations/x/typing", map[string]string{"typing": "yes"}},
+		{a.alice, http.StatusBadRequest, "GET", "/sync", "/sync?since=-1", nil},
+		// Authentication comes before validation
+		{"", http.StatusUnauthorized, "POST", "/dm/send", "/dm/send", map[string]string{}},
+	})
+}
+
+func TestUserResponses(t *testing.T) {
+	a := newAPITest(t)
+	a.run([]step{
+		{"", http.StatusUnauthorized, "POST", "/login", "/login", map[string]string{"username": "alice", "password": "wrong"}},
+		{"", http.StatusUnauthorized, "POST", "/login", "/login", map[string]string{"username": "nobody", "password": "password"}},
+		{"", http.StatusConflict, "POST", "/signup", "/signup", map[string]string{"username": "alice", "password": "password"}},
+	})
+}
+
+func TestMessageResponses(t *testing.T) {
+	a := newAPITest(t)
+	id := a.sendDM("hello, document")
+	a.run([]step{
+		{a.alice, http.StatusOK, "GET", "/dm/{user}", "/dm/bob?from=alice", nil},
+		{a.alice, http.StatusOK, "PATCH", "/messages/{id}", "/messages/" + id, map[string]string{"content": "hello again"}},
+		{a.alice, http.StatusOK, "GET", "/messages/{id}/revisions", "/messages/" + id + "/revisions", nil},
+		{a.alice, http.StatusOK, "POST", "/messages/{id}/reactions", "/messages/" + id + "/reactions", map[string]string{"emoji": "👍"}},
+		{a.alice, http.StatusOK, "GET", "/messages/{id}/thread", "/messages/" + id + "/thread", nil},
+		{a.alice, http.StatusOK, "DELETE", "/messages/{id}/reactions/{emoji}", "/messages/" + id + "/reactions/" + url.PathEscape("👍"), nil},
+		{a.bob, http.StatusForbidden, "PATCH", "/messages/{id}", "/messages/" + id, map[string]string{"content": "not mine"}},
+		{a.alice, http.StatusOK, "DELETE", "/messages/{id}", "/messages/" + id + "?scope=everyone", nil},
+		{a.alice, http.StatusNotFound, "GET", "/messages/{id}/revisions", "/messages/missing/revisions", nil},
+		{a.alice, http.StatusOK, "POST", "/broadcast/send", "/broadcast/send", map[string]string{"from": "alice", "content": "hello, everyone", "timestamp": timestamp}},
+		{a.alice, http.StatusOK, "GET", "/broadcast/history", "/broadcast/history", nil},
+	})
+}
+
+func TestGroupResponses(t *testing.T) {
+	a := newAPITest(t)
+	a.run([]step{
+		{a.alice, http.StatusOK, "POST", "/group/create", "/group/create", map[string]string{"group": "team"}},
+		// Nobody takes over a group by creating it again
+		{a.bob, http.StatusConflict, "POST", "/group/create", "/group/create", map[string]string{"group": "team"}},
+		{a.bob, http.StatusOK, "POST", "/group/join", "/group/join", map[string]string{"group": "team", "user": "bob"}},
+		{a.bob, http.StatusOK, "POST", "/group/send", "/group/send", map[string]string{"from": "bob", "group": "team", "content": "hi group", "timestamp": timestamp}},
+		{a.alice, http.StatusOK, "POST", "/group/role", "/group/role", map[string]string{"group": "team", "user": "bob", "role": "moderator"}},
+		{a.bob, http.StatusForbidden, "POST", "/group/role", "/group/role", map[string]string{"group": "team", "user": "alice", "role": "member"}},
+		{a.alice, http.StatusOK, "GET", "/group/{name}/history", "/group/team/history", nil},
+		{a.alice, http.StatusNotFound, "GET", "/group/{name}/history", "/group/missing/history", nil},
+		{a.alice, http.StatusNotFound, "POST", "/group/join", "/group/join", map[string]string{"group": "missing", "user": "alice"}},
+	})
+}
+
+func TestConversationResponses(t *testing.T) {
+	a := newAPITest(t)
+	a.sendDM("unread")
+	dm := "/conversations/" + url.PathEscape("dm:alice:bob")
+	a.run([]step{
+		{a.bob, http.StatusOK, "GET", "/conversations", "/conversations?limit=5", nil},
+		{a.bob, http.StatusOK, "GET", "/conversations/unread", "/conversations/unread", nil},
+		{a.bob, http.StatusOK, "POST", "/conversations/{id}/typing", dm + "/typing", map[string]bool{"typing": true}},
+		{a.bob, http.StatusOK, "POST", "/conversations/{id}/read", dm + "/read", nil},
+		{a.bob, http.StatusBadRequest, "POST", "/conversations/{id}/read", "/conversations/nowhere/read", nil},
+	})
+}
+
+func TestPresenceSearchAndSyncResponses(t *testing.T) {
+	a := newAPITest(t)
+	a.sendDM("hello")
+	a.run([]step{
+		// Presence is only set while connected
+		{a.alice, http.StatusConflict, "PUT", "/presence", "/presence", map[string]string{"state": "away"}},
+		{a.alice, http.StatusOK, "GET", "/presence", "/presence?users=alice,bob", nil},
+		{a.alice, http.StatusOK, "GET", "/search", "/search?q=hello", nil},
+		{a.alice, http.StatusOK, "GET", "/search", "/search?q=hello&conversation=dm:alice:bob", nil},
+		// A conversation the caller is not in is refused, as its history is
+		{a.alice, http.StatusOK, "POST", "/group/create", "/group/create", map[string]string{"group": "team"}},
+		{a.bob, http.StatusForbidden, "GET", "/search", "/search?q=hello&conversation=group:team", nil},
+		{a.bob, http.StatusForbidden, "GET", "/search", "/search?q=hello&conversation=dm:alice:carol", nil},
+		{a.bob, http.StatusNotFound, "GET", "/search", "/search?q=hello&conversation=group:missing", nil},
+		{a.alice, http.StatusOK, "GET", "/sync", "/sync", nil},
+		{a.alice, http.StatusOK, "GET", "/sync", "/sync?since=0&timeout=0s", nil},
+		{a.alice, http.StatusOK, "POST", "/graphql", "/graphql", map[string]string{"query": "{ me { username } }"}},
+	})
+}
+
+func TestAttachmentResponses(t *testing.T) {
+	a := newAPITest(t)
+	body := &formBody{data: &bytes.Buffer{}}
+	form := multipart.NewWriter(body.data)
+	form.WriteField("conversation", "dm:alice:bob")
+	file, _ := form.CreateFormFile("file", "notes.txt")
+	file.Write([]byte("attached"))
+	form.Close()
+	body.contentType = form.FormDataContentType()
+
+	var attachment struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(a.expect(a.alice, http.StatusCreated, "POST", "/attachments", "/attachments", body), &attachment)
+	a.run([]step{
+		{a.bob, http.StatusOK, "GET", "/attachments/{id}", "/attachments/" + attachment.ID, nil},
+		{a.alice, http.StatusNotFound, "GET", "/attachments/{id}", "/attachments/missing", nil},
+	})
+}
+
+// What the document does not describe is still answered with problems, with
+// an ID made up by the server. Metrics are not served with the API.
+func TestUndocumentedErrorsAreProblems(t *testing.T) {
+	a := newAPITest(t)
+	for _, target := range []string{"/nowhere", "/protocol/v1/nothing.json", "/debug/vars"} {
+		resp, err := http.Get(a.server.URL + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404, got %d: %s", target, resp.StatusCode, data)
+			continue
+		}
+		requestID := resp.Header.Get(infrastructure.RequestIDHeader)
+		if requestID == "" {
+			t.Errorf("GET %s: no request ID", target)
+		}
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err := checkProblem(data, mediaType, resp.StatusCode, requestID); err != nil {
+			t.Errorf("GET %s: %v", target, err)
+		}
+	}
+}
@@ -1,19 +1,33 @@
 package routers
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/haileamlak/chat-system/controllers"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/protocol"
+	"github.com/swaggest/swgui/v5emb"
 )
 
-func SetupRouter(userController controllers.UserController, messageController controllers.MessageController, webSocketController controllers.WebSocketController, authMiddleware gin.HandlerFunc) *gin.Engine {
-	router := gin.Default()
+func SetupRouter(userController controllers.UserController, messageController controllers.MessageController, searchController controllers.SearchController, attachmentController controllers.AttachmentController, conversationController controllers.ConversationController, presenceController controllers.PresenceController, webSocketController controllers.WebSocketController, graphqlController controllers.GraphQLController, authMiddleware gin.HandlerFunc, validateRequest gin.HandlerFunc) *gin.Engine {
+	router := gin.New()
+	// Every request gets an ID, and every error answering it is a problem
+	// carrying the ID, including those of panics and unknown routes
+	router.Use(gin.Logger(), infrastructure.RequestID(), gin.CustomRecovery(func(c *gin.Context, _ interface{}) {
+		infrastructure.AbortWithProblem(c, http.StatusInternalServerError, "Internal server error")
+	}))
+	router.NoRoute(func(c *gin.Context) {
+		infrastructure.AbortWithProblem(c, http.StatusNotFound, "No route for "+c.Request.Method+" "+c.Request.URL.Path)
+	})
 
-	router.POST("/signup", userController.SignUp)
-	router.POST("/login", userController.Login)
+	router.POST("/signup", validateRequest, userController.SignUp)
+	router.POST("/login", validateRequest, userController.Login)
 
-	// Protected routes
+	// Protected routes, validated against the OpenAPI document once
+	// authenticated
 	auth := router.Group("/")
-	auth.Use(authMiddleware)
+	auth.Use(authMiddleware, validateRequest)
 
 	dm := auth.Group("/dm")
 	{
@@ -26,6 +40,7 @@ func SetupRouter(userController controllers.UserController, messageController co
 		group.POST("/create", messageController.CreateGroup)
 		group.POST("/join", messageController.JoinGroup)
 		group.POST("/send", messageController.SendGroupMessage)
+		group.POST("/role", messageController.SetGroupRole)
 		group.GET("/:name/history", messageController.GetGroupHistory)
 	}
 	broadcast := auth.Group("/broadcast")
@@ -36,7 +51,54 @@ func SetupRouter(userController controllers.UserController, messageController co
 
 	}
 
-	router.GET("/ws", webSocketController.WebSocketHandler)
+	messages := auth.Group("/messages")
+	{
+		messages.PATCH("/:id", messageController.EditMessage)
+		messages.DELETE("/:id", messageController.DeleteMessage)
+		messages.GET("/:id/revisions", messageController.GetMessageRevisions)
+		messages.GET("/:id/thread", messageController.GetThread)
+		messages.POST("/:id/reactions", messageController.AddReaction)
+		messages.DELETE("/:id/reactions/:emoji", messageController.RemoveReaction)
+	}
+
+	conversations := auth.Group("/conversations")
+	{
+		conversations.GET("", conversationController.ListConversations)
+		conversations.GET("/unread", conversationController.GetUnreadCounts)
+		conversations.POST("/:id/read", conversationController.MarkRead)
+		conversations.POST("/:id/typing", conversationController.SetTyping)
+	}
+
+	auth.GET("/search", searchController.Search)
+	auth.GET("/presence", presenceController.GetPresence)
+	auth.PUT("/presence", presenceController.SetPresence)
+
+	// Event delivery for clients that cannot use the WebSocket
+	auth.GET("/events", webSocketController.EventStreamHandler)
+	auth.GET("/sync", webSocketController.SyncHandler)
+
+	attachments := auth.Group("/attachments")
+	{
+		attachments.POST("", attachmentController.Upload)
+		attachments.GET("/:id", attachmentController.Download)
+		attachments.GET("/:id/thumbnail", attachmentController.DownloadThumbnail)
+	}
+
+	router.GET("/ws", validateRequest, webSocketController.WebSocketHandler)
+
+	// GraphQL queries, and subscriptions over a WebSocket that authenticates
+	// in its connection_init message
+	auth.POST("/graphql", graphqlController.Query)
+	router.GET("/graphql", graphqlController.Subscribe)
+	// JSON schemas of the v1 WebSocket frames, the protobuf definitions and
+	// the GraphQL schema
+	router.StaticFS("/protocol", http.FS(protocol.Schemas))
+
+	// The OpenAPI document of every route here, and a UI to browse it
+	router.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", protocol.OpenAPI)
+	})
+	router.GET("/docs/*path", gin.WrapH(v5emb.New("Chat API", "/openapi.json", "/docs/")))
 
 	return router
 }
@@ -0,0 +1,70 @@
+package routers
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haileamlak/chat-system/controllers"
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/protocol"
+)
+
+// stubController stands in for every HTTP controller; its handlers do
+// nothing.
+type stubController struct{}
+
+func (stubController) SignUp(*gin.Context)              {}
+func (stubController) Login(*gin.Context)               {}
+func (stubController) SendDM(*gin.Context)              {}
+func (stubController) GetDMHistory(*gin.Context)        {}
+func (stubController) CreateGroup(*gin.Context)         {}
+func (stubController) JoinGroup(*gin.Context)           {}
+func (stubController) SendGroupMessage(*gin.Context)    {}
+func (stubController) GetGroupHistory(*gin.Context)     {}
+func (stubController) SendBroadcast(*gin.Context)       {}
+func (stubController) GetBroadcastHistory(*gin.Context) {}
+func (stubController) EditMessage(*gin.Context)         {}
+func (stubController) GetMessageRevisions(*gin.Context) {}
+func (stubController) DeleteMessage(*gin.Context)       {}
+func (stubController) SetGroupRole(*gin.Context)        {}
+func (stubController) GetThread(*gin.Context)           {}
+func (stubController) AddReaction(*gin.Context)         {}
+func (stubController) RemoveReaction(*gin.Context)      {}
+func (stubController) Search(*gin.Context)              {}
+func (stubController) Upload(*gin.Context)              {}
+func (stubController) Download(*gin.Context)            {}
+func (stubController) DownloadThumbnail(*gin.Context)   {}
+func (stubController) MarkRead(*gin.Context)            {}
+func (stubController) GetUnreadCounts(*gin.Context)     {}
+func (stubController) ListConversations(*gin.Context)   {}
+func (stubController) SetTyping(*gin.Context)           {}
+func (stubController) GetPresence(*gin.Context)         {}
+func (stubController) SetPresence(*gin.Context)         {}
+func (stubController) Query(*gin.Context)               {}
+func (stubController) Subscribe(*gin.Context)           {}
+
+// stubWebSocketController serves the event routes; the hub itself is never
+// used.
+type stubWebSocketController struct {
+	controllers.WebSocketController
+}
+
+func (stubWebSocketController) WebSocketHandler(*gin.Context)   {}
+func (stubWebSocketController) EventStreamHandler(*gin.Context) {}
+func (stubWebSocketController) SyncHandler(*gin.Context)        {}
+
+// Every route is in the OpenAPI document, and every operation of the document
+// is routed.
+func TestRoutesMatchDocument(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	validator, err := infrastructure.NewRequestValidator(protocol.OpenAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := stubController{}
+	router := SetupRouter(stub, stub, stub, stub, stub, stub, stubWebSocketController{}, stub, func(*gin.Context) {}, validator.Validate())
+	if err := validator.CheckRoutes(router.Routes()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,166 @@
+package usecases
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+
+	uuid "github.com/google/uuid"
+)
+
+type AttachmentUseCase interface {
+	Upload(ctx context.Context, user, conversationID, name string, r io.Reader) (*models.Attachment, error)
+	Open(ctx context.Context, user, id string, thumbnail bool) (*models.Attachment, io.ReadCloser, error)
+}
+
+// AttachmentConfig holds the tunable limits of the attachment use case.
+type AttachmentConfig struct {
+	MaxSize int64
+}
+
+type attachmentUseCase struct {
+	attachmentRepo   repositories.AttachmentRepository
+	messageRepo      repositories.MessageRepository
+	blobStore        infrastructure.BlobStore
+	thumbnailService infrastructure.ThumbnailService
+	config           AttachmentConfig
+}
+
+func NewAttachmentUseCase(attachmentRepo repositories.AttachmentRepository, messageRepo repositories.MessageRepository, blobStore infrastructure.BlobStore, thumbnailService infrastructure.ThumbnailService, config AttachmentConfig) AttachmentUseCase {
+	return &attachmentUseCase{
+		attachmentRepo:   attachmentRepo,
+		messageRepo:      messageRepo,
+		blobStore:        blobStore,
+		thumbnailService: thumbnailService,
+		config:           config,
+	}
+}
+
+// Upload stores a file for later use in a message of the given conversation.
+// Images also get a thumbnail.
+func (a *attachmentUseCase) Upload(ctx context.Context, user, conversationID, name string, r io.Reader) (*models.Attachment, error) {
+	conv, ok := parseConversationID(conversationID)
+	if !ok {
+		return nil, ErrInvalidConversation
+	}
+	allowed, err := canAccessConversation(a.messageRepo, conv, user)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrNotParticipant
+	}
+
+	// Read one byte past the limit to detect oversized uploads
+	data, err := io.ReadAll(io.LimitReader(r, a.config.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > a.config.MaxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	checksum := sha256.Sum256(data)
+	attachment := &models.Attachment{
+		ID:           uuid.New().String(),
+		Name:         name,
+		MIMEType:     http.DetectContentType(data),
+		Size:         int64(len(data)),
+		Checksum:     hex.EncodeToString(checksum[:]),
+		Conversation: conv.id(),
+		Uploader:     user,
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	attachment.URL = "/attachments/" + attachment.ID
+
+	if err := a.blobStore.Put(ctx, attachment.ID, bytes.NewReader(data), attachment.Size, attachment.MIMEType); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(attachment.MIMEType, "image/") {
+		thumbnail, err := a.thumbnailService.Generate(data)
+		if err != nil {
+			log.Println("Failed to generate thumbnail for", attachment.ID, ":", err)
+		} else if err := a.blobStore.Put(ctx, thumbnailKey(attachment.ID), bytes.NewReader(thumbnail), int64(len(thumbnail)), "image/jpeg"); err != nil {
+			log.Println("Failed to store thumbnail for", attachment.ID, ":", err)
+		} else {
+			attachment.ThumbnailURL = attachment.URL + "/thumbnail"
+		}
+	}
+
+	if err := a.attachmentRepo.SaveAttachment(attachment); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// Open returns the attachment and its content, or its thumbnail, if the user
+// belongs to the conversation it was uploaded to.
+func (a *attachmentUseCase) Open(ctx context.Context, user, id string, thumbnail bool) (*models.Attachment, io.ReadCloser, error) {
+	attachment, err := a.attachmentRepo.GetAttachment(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if attachment == nil || (thumbnail && attachment.ThumbnailURL == "") {
+		return nil, nil, ErrAttachmentNotFound
+	}
+
+	conv, _ := parseConversationID(attachment.Conversation)
+	allowed, err := canAccessConversation(a.messageRepo, conv, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowed {
+		return nil, nil, ErrNotParticipant
+	}
+
+	key := attachment.ID
+	if thumbnail {
+		key = thumbnailKey(attachment.ID)
+	}
+	blob, err := a.blobStore.Get(ctx, key)
+	if err == infrastructure.ErrBlobNotFound {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return attachment, blob, nil
+}
+
+func thumbnailKey(id string) string {
+	return id + "_thumb"
+}
+
+// resolveAttachments replaces the attachment references of a new message with
+// the stored metadata, checking each was uploaded by the sender to the same
+// conversation.
+func resolveAttachments(attachmentRepo repositories.AttachmentRepository, key, from string, refs []models.Attachment) ([]models.Attachment, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	convID := parseConversationKey(key).id()
+	resolved := make([]models.Attachment, 0, len(refs))
+	for _, ref := range refs {
+		attachment, err := attachmentRepo.GetAttachment(ref.ID)
+		if err != nil {
+			return nil, err
+		}
+		if attachment == nil || attachment.Uploader != from || attachment.Conversation != convID {
+			return nil, ErrInvalidAttachment
+		}
+		resolved = append(resolved, *attachment)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,221 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+)
+
+const (
+	conversationDM        = "dm"
+	conversationGroup     = "group"
+	conversationBroadcast = "broadcast"
+)
+
+// conversation identifies the DM, group or broadcast stream a message list
+// belongs to.
+type conversation struct {
+	kind  string
+	name  string   // group name for groups
+	users []string // both participants for DMs
+}
+
+// parseConversationKey derives the conversation from the Redis key of its
+// message list (dm:<a>:<b>, group:<name>:messages or broadcast:messages).
+func parseConversationKey(key string) conversation {
+	switch {
+	case strings.HasPrefix(key, "dm:"):
+		return conversation{kind: conversationDM, users: strings.SplitN(strings.TrimPrefix(key, "dm:"), ":", 2)}
+	case strings.HasPrefix(key, "group:"):
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "group:"), ":messages")
+		return conversation{kind: conversationGroup, name: name}
+	default:
+		return conversation{kind: conversationBroadcast}
+	}
+}
+
+// parseConversationID is the inverse of conversation.id. It reports false for
+// malformed IDs.
+func parseConversationID(id string) (conversation, bool) {
+	switch {
+	case strings.HasPrefix(id, "dm:"):
+		conv := parseConversationKey(id)
+		return conv, len(conv.users) == 2
+	case strings.HasPrefix(id, "group:") && len(id) > len("group:"):
+		return conversation{kind: conversationGroup, name: strings.TrimPrefix(id, "group:")}, true
+	case id == conversationBroadcast:
+		return conversation{kind: conversationBroadcast}, true
+	default:
+		return conversation{}, false
+	}
+}
+
+// id is the public identifier of the conversation: dm:<a>:<b>, group:<name>
+// or broadcast.
+func (c conversation) id() string {
+	switch c.kind {
+	case conversationDM:
+		return "dm:" + strings.Join(c.users, ":")
+	case conversationGroup:
+		return "group:" + c.name
+	default:
+		return conversationBroadcast
+	}
+}
+
+// DMConversationID returns the conversation ID of the DM between two users.
+func DMConversationID(user1, user2 string) string {
+	return getDMKey(user1, user2)
+}
+
+// GroupConversationID returns the conversation ID of a group.
+func GroupConversationID(group string) string {
+	return "group:" + group
+}
+
+// BroadcastConversationID is the conversation ID of the broadcast channel.
+const BroadcastConversationID = conversationBroadcast
+
+// key is the Redis key of the conversation's message list.
+func (c conversation) key() string {
+	switch c.kind {
+	case conversationDM:
+		return getDMKey(c.users[0], c.users[1])
+	case conversationGroup:
+		return fmt.Sprintf("group:%s:messages", c.name)
+	default:
+		return "broadcast:messages"
+	}
+}
+
+func (m *messageUseCase) canAccess(ctx context.Context, conv conversation, user string) (bool, error) {
+	return canAccessConversation(m.messageRepo, conv, user)
+}
+
+// canAccessConversation reports whether the user may read the conversation:
+// DM participants, group members, and everyone for broadcasts.
+func canAccessConversation(messageRepo repositories.MessageRepository, conv conversation, user string) (bool, error) {
+	switch conv.kind {
+	case conversationDM:
+		for _, u := range conv.users {
+			if u == user {
+				return true, nil
+			}
+		}
+		return false, nil
+	case conversationGroup:
+		return messageRepo.IsMemberOfGroup(fmt.Sprintf("group:%s:members", conv.name), user)
+	default:
+		return true, nil
+	}
+}
+
+// requireAccess returns nil if the user may read the conversation, and
+// otherwise ErrGroupNotFound for a group that does not exist or
+// ErrNotParticipant.
+func requireAccess(messageRepo repositories.MessageRepository, conv conversation, user string) error {
+	ok, err := canAccessConversation(messageRepo, conv, user)
+	if err != nil || ok {
+		return err
+	}
+	if conv.kind == conversationGroup {
+		if err := requireGroup(messageRepo, conv.name); err != nil {
+			return err
+		}
+	}
+	return ErrNotParticipant
+}
+
+// requireGroup returns ErrGroupNotFound unless the group exists.
+func requireGroup(messageRepo repositories.MessageRepository, groupName string) error {
+	exists, err := messageRepo.GroupExists(fmt.Sprintf("group:%s:members", groupName))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+func (m *messageUseCase) participants(ctx context.Context, conv conversation) ([]string, error) {
+	return conversationParticipants(m.messageRepo, conv)
+}
+
+// participants returns the users of a DM or group. Broadcasts have no fixed
+// participant list and return nil.
+func conversationParticipants(messageRepo repositories.MessageRepository, conv conversation) ([]string, error) {
+	switch conv.kind {
+	case conversationDM:
+		return conv.users, nil
+	case conversationGroup:
+		return messageRepo.GetGroupMembers(fmt.Sprintf("group:%s:members", conv.name))
+	default:
+		return nil, nil
+	}
+}
+
+func (m *messageUseCase) notify(ctx context.Context, conv conversation, actor string, event models.WSMessage) {
+	notifyConversation(ctx, m.messageRepo, m.publish, conv, actor, event)
+}
+
+// publishFunc delivers an event to one user, or to everyone when the
+// recipient is empty. Failures are logged, never returned.
+type publishFunc func(ctx context.Context, recipient string, event models.WSMessage)
+
+// notifyConversation pushes a real-time event to every participant of the
+// conversation except the user who caused it. Failures are logged, never
+// returned: the change that triggered the event has already been stored.
+func notifyConversation(ctx context.Context, messageRepo repositories.MessageRepository, publish publishFunc, conv conversation, actor string, event models.WSMessage) {
+	if conv.kind == conversationBroadcast {
+		publish(ctx, "", event)
+		return
+	}
+
+	recipients, err := conversationParticipants(messageRepo, conv)
+	if err != nil {
+		log.Println("Failed to resolve recipients for", event.Type, "event:", err)
+		return
+	}
+
+	for _, recipient := range recipients {
+		if recipient == actor {
+			continue
+		}
+		publish(ctx, recipient, event)
+	}
+}
+
+// publishLive returns a publishFunc that only reaches connected clients. It
+// suits events that mean nothing once missed, such as typing indicators.
+func publishLive(pubSubService infrastructure.PubSubService) publishFunc {
+	return func(ctx context.Context, recipient string, event models.WSMessage) {
+		event.To = recipient
+		var err error
+		if recipient == "" {
+			err = pubSubService.Publish(ctx, "channel:broadcast", event)
+		} else {
+			err = pubSubService.PublishToUser(ctx, recipient, event)
+		}
+		if err != nil {
+			log.Println("Failed to publish", event.Type, "event to", recipient, ":", err)
+		}
+	}
+}
+
+// publish records the event in the recipient's event stream, so that a
+// client that was offline can replay it, and pushes it to live connections.
+func (m *messageUseCase) publish(ctx context.Context, recipient string, event models.WSMessage) {
+	event.To = recipient
+	seq, err := m.eventRepo.AppendEvent(recipient, &event, m.config.EventLogSize)
+	if err != nil {
+		log.Println("Failed to record", event.Type, "event for replay:", err)
+	}
+	event.Seq = seq
+	publishLive(m.pubSubService)(ctx, recipient, event)
+}
@@ -0,0 +1,140 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+const (
+	previewLength       = 100
+	maxListParticipants = 20
+)
+
+// ListConversations returns a page of the user's DMs and groups, most
+// recently active first, with a preview of the last message and the number
+// of unread messages.
+func (m *messageUseCase) ListConversations(ctx context.Context, user string, offset, limit int64) (*models.ConversationList, error) {
+	activity, total, err := m.conversationRepo.GetConversationActivity(user, offset, offset+limit-1)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(activity))
+	for i, entry := range activity {
+		keys[i] = entry.Key
+	}
+	lastMessages, err := m.conversationRepo.GetLastMessages(keys)
+	if err != nil {
+		return nil, err
+	}
+	lengths, err := m.conversationRepo.GetConversationLengths(keys)
+	if err != nil {
+		return nil, err
+	}
+	cursors, err := m.conversationRepo.GetReadCursors(user, keys)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := m.messageRepo.GetHiddenMessages(user)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &models.ConversationList{Conversations: []*models.ConversationSummary{}, Total: total}
+	for _, entry := range activity {
+		conv := parseConversationKey(entry.Key)
+		participants, err := m.participants(ctx, conv)
+		if err != nil {
+			return nil, err
+		}
+
+		summary := &models.ConversationSummary{
+			ID:             conv.id(),
+			Kind:           conv.kind,
+			Name:           conv.name,
+			Participants:   participants,
+			MemberCount:    len(participants),
+			LastActivityAt: time.UnixMilli(entry.LastActivity).UTC().Format(time.RFC3339),
+			UnreadCount:    max(0, lengths[entry.Key]-cursors[entry.Key]),
+		}
+		if conv.kind == conversationDM {
+			for _, u := range conv.users {
+				if u != user {
+					summary.Name = u
+				}
+			}
+		}
+		if len(summary.Participants) > maxListParticipants {
+			summary.Participants = summary.Participants[:maxListParticipants]
+		}
+
+		if msg, ok := lastMessages[entry.Key]; ok {
+			hideForViewer(hidden, &msg.MessageMeta, &msg.Content)
+			if runes := []rune(msg.Content); len(runes) > previewLength {
+				msg.Content = string(runes[:previewLength]) + "…"
+			}
+			summary.LastMessage = msg
+		}
+
+		list.Conversations = append(list.Conversations, summary)
+	}
+	return list, nil
+}
+
+// BackfillConversations adds every existing DM and group to its participants'
+// conversation lists, for data stored before the lists were kept. Entries
+// already present are left alone. It returns how many conversations were seen.
+func (m *messageUseCase) BackfillConversations(ctx context.Context) (int, error) {
+	keys, err := m.messageRepo.GetConversationKeys()
+	if err != nil {
+		return 0, err
+	}
+	groups, err := m.messageRepo.GetGroupNames()
+	if err != nil {
+		return 0, err
+	}
+
+	// Groups nobody has written to yet have no message list to find
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for _, group := range groups {
+		if key := fmt.Sprintf("group:%s:messages", group); !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	lastMessages, err := m.conversationRepo.GetLastMessages(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UnixMilli()
+	count := 0
+	for _, key := range keys {
+		conv := parseConversationKey(key)
+		if conv.kind == conversationBroadcast {
+			continue
+		}
+		users, err := m.participants(ctx, conv)
+		if err != nil {
+			return count, err
+		}
+
+		at := now
+		if msg, ok := lastMessages[key]; ok {
+			if sentAt, err := time.Parse(time.RFC3339, msg.Timestamp); err == nil {
+				at = sentAt.UnixMilli()
+			}
+		}
+		if err := m.conversationRepo.AddConversation(users, key, at); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
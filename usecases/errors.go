@@ -0,0 +1,75 @@
+package usecases
+
+import "errors"
+
+// ErrorKind says what went wrong in a use case, so that every API reports it
+// with the same status and code.
+type ErrorKind int
+
+const (
+	// KindInternal is an unexpected failure, e.g. of storage. It is the kind
+	// of every error that is not an *Error.
+	KindInternal ErrorKind = iota
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindTooLarge
+	KindRateLimited
+)
+
+// Error is an error of the use cases that clients are told about. Its
+// message is meant for them; the sentinels below are compared with
+// errors.Is.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(kind ErrorKind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+// KindOf returns the kind of err, KindInternal if it is not an *Error.
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+var (
+	ErrMessageNotFound     = newError(KindNotFound, "message not found")
+	ErrNotParticipant      = newError(KindForbidden, "you are not a participant of this conversation")
+	ErrNotMessageAuthor    = newError(KindForbidden, "only the author can modify this message")
+	ErrEditWindowExpired   = newError(KindForbidden, "the edit window for this message has expired")
+	ErrMessageDeleted      = newError(KindConflict, "message has been deleted")
+	ErrMessageChanged      = newError(KindConflict, "message kept changing while it was being updated, try again")
+	ErrGroupNotFound       = newError(KindNotFound, "group not found")
+	ErrGroupExists         = newError(KindConflict, "group already exists")
+	ErrNotGroupAdmin       = newError(KindForbidden, "only a group admin can do this")
+	ErrLastAdmin           = newError(KindConflict, "a group must keep at least one admin")
+	ErrUserNotInGroup      = newError(KindValidation, "user is not a member of this group")
+	ErrInvalidRole         = newError(KindValidation, "role must be member, moderator or admin")
+	ErrInvalidParent       = newError(KindValidation, "parent must be a top-level message in the same conversation")
+	ErrInvalidReaction     = newError(KindValidation, "reaction must be a short emoji without spaces")
+	ErrReactionLimit       = newError(KindConflict, "this message has reached its reaction limit")
+	ErrEmptySearch         = newError(KindValidation, "search query must contain at least one word")
+	ErrInvalidConversation = newError(KindValidation, "invalid conversation ID")
+	ErrAttachmentNotFound  = newError(KindNotFound, "attachment not found")
+	ErrAttachmentTooLarge  = newError(KindTooLarge, "attachment exceeds the maximum size")
+	ErrInvalidAttachment   = newError(KindValidation, "attachments must be uploaded by the sender to the same conversation")
+	ErrAttachmentInUse     = newError(KindValidation, "an attachment can be sent with one message only")
+	ErrInvalidPresence     = newError(KindValidation, "presence state must be online or away")
+	ErrNotConnected        = newError(KindConflict, "presence can only be set while connected")
+	ErrInvalidClientID     = newError(KindValidation, "client message ID must be at most 64 characters")
+	ErrCursorTooOld        = newError(KindConflict, "too far behind, refetch history")
+	ErrUsernameTaken       = newError(KindConflict, "username is already taken")
+	ErrInvalidCredentials  = newError(KindUnauthorized, "invalid username or password")
+)
@@ -0,0 +1,83 @@
+package usecases
+
+import (
+	"context"
+	"sort"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+)
+
+type EventUseCase interface {
+	Replay(ctx context.Context, user string, after int64) ([]*models.WSMessage, error)
+	LatestSeq(ctx context.Context) (int64, error)
+}
+
+// EventConfig holds the tunable limits of the event use case.
+type EventConfig struct {
+	// ReplayLimit is the most events a reconnecting client is sent. Clients
+	// further behind are told to refetch their history instead.
+	ReplayLimit int64
+}
+
+type eventUseCase struct {
+	eventRepo repositories.EventRepository
+	config    EventConfig
+}
+
+func NewEventUseCase(eventRepo repositories.EventRepository, config EventConfig) EventUseCase {
+	return &eventUseCase{
+		eventRepo: eventRepo,
+		config:    config,
+	}
+}
+
+// Replay returns the events the user missed since the given sequence number,
+// across all their conversations and broadcasts, oldest first. It fails with
+// ErrCursorTooOld when some of them are no longer kept or there are more
+// than the replay limit.
+func (e *eventUseCase) Replay(ctx context.Context, user string, after int64) ([]*models.WSMessage, error) {
+	latest, err := e.eventRepo.GetLatestSeq()
+	if err != nil {
+		return nil, err
+	}
+	if after > latest {
+		// The cursor comes from before the event log was reset
+		return nil, ErrCursorTooOld
+	}
+
+	events := []*models.WSMessage{}
+	for _, recipient := range []string{user, ""} {
+		trimmed, err := e.eventRepo.GetTrimmedSeq(recipient)
+		if err != nil {
+			return nil, err
+		}
+		if trimmed > after {
+			return nil, ErrCursorTooOld
+		}
+
+		stream, err := e.eventRepo.GetEventsAfter(recipient, after, e.config.ReplayLimit+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range stream {
+			// Broadcasts are not echoed to their sender
+			if recipient == "" && event.From == user {
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+
+	if int64(len(events)) > e.config.ReplayLimit {
+		return nil, ErrCursorTooOld
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events, nil
+}
+
+// LatestSeq returns the sequence number of the newest event, which a client
+// that refetched its history resumes from.
+func (e *eventUseCase) LatestSeq(ctx context.Context) (int64, error) {
+	return e.eventRepo.GetLatestSeq()
+}
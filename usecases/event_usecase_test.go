@@ -0,0 +1,104 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// sendDMs sends n numbered DMs from alice to bob.
+func (uc *testUseCases) sendDMs(t *testing.T, n int, prefix string) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		if err := uc.sendDM(t, &models.DirectMessage{Content: fmt.Sprintf("%s %d", prefix, i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (uc *testUseCases) latestSeq(t *testing.T) int64 {
+	t.Helper()
+	seq, err := uc.events.LatestSeq(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+func TestReplayFromACurrentCursor(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{EventLogSize: 100})
+	uc.sendDMs(t, 2, "seen")
+	cursor := uc.latestSeq(t)
+	uc.sendDMs(t, 3, "missed")
+
+	events, err := uc.events.Replay(context.Background(), "bob", cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("replayed %d events, want 3", len(events))
+	}
+	for i, event := range events {
+		if want := fmt.Sprintf("missed %d", i+1); event.Content != want || event.Seq <= cursor {
+			t.Errorf("event %d is %q with seq %d, want %q after %d", i, event.Content, event.Seq, want, cursor)
+		}
+		cursor = event.Seq
+	}
+	if events, err := uc.events.Replay(context.Background(), "bob", cursor); err != nil || len(events) != 0 {
+		t.Errorf("replay from the newest event: %d events, %v", len(events), err)
+	}
+}
+
+// A client whose cursor points at events no longer kept is told to resync
+// rather than replayed a stream with a hole in it.
+func TestReplayFromATrimmedCursorIsTooOld(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{EventLogSize: 3})
+	ctx := context.Background()
+	uc.sendDMs(t, 1, "seen")
+	cursor := uc.latestSeq(t)
+
+	// Still within the log
+	uc.sendDMs(t, 3, "missed")
+	if events, err := uc.events.Replay(ctx, "bob", cursor); err != nil || len(events) != 3 {
+		t.Fatalf("replay within the log: %d events, %v", len(events), err)
+	}
+
+	// One more pushes the first missed event out
+	uc.sendDMs(t, 1, "overflow")
+	if _, err := uc.events.Replay(ctx, "bob", cursor); err != ErrCursorTooOld {
+		t.Errorf("replay from a trimmed cursor: got %v, want ErrCursorTooOld", err)
+	}
+	if _, err := uc.events.Replay(ctx, "bob", 0); err != ErrCursorTooOld {
+		t.Errorf("replay from the start: got %v, want ErrCursorTooOld", err)
+	}
+
+	// The latest seq is where a client resumes after refetching its history
+	latest := uc.latestSeq(t)
+	if events, err := uc.events.Replay(ctx, "bob", latest); err != nil || len(events) != 0 {
+		t.Errorf("replay from the latest seq: %d events, %v", len(events), err)
+	}
+}
+
+func TestReplayBeyondTheLimitIsTooOld(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{EventLogSize: 100})
+	ctx := context.Background()
+	uc.sendDMs(t, testReplayLimit, "missed")
+	if events, err := uc.events.Replay(ctx, "bob", 0); err != nil || len(events) != testReplayLimit {
+		t.Fatalf("replay of the limit: %d events, %v", len(events), err)
+	}
+	uc.sendDMs(t, 1, "overflow")
+	if _, err := uc.events.Replay(ctx, "bob", 0); err != ErrCursorTooOld {
+		t.Errorf("replay over the limit: got %v, want ErrCursorTooOld", err)
+	}
+}
+
+// A cursor ahead of the log comes from before the log was reset.
+func TestReplayFromAFutureCursorIsTooOld(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{EventLogSize: 100})
+	uc.sendDMs(t, 1, "seen")
+	if _, err := uc.events.Replay(context.Background(), "bob", uc.latestSeq(t)+1); err != ErrCursorTooOld {
+		t.Errorf("got %v, want ErrCursorTooOld", err)
+	}
+}
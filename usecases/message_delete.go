@@ -0,0 +1,146 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// DeleteMessage removes a message either from the user's own view or, for the
+// author and group moderators, for every participant. Deleting for everyone
+// replaces the message with a tombstone in place so history indexes never shift.
+func (m *messageUseCase) DeleteMessage(ctx context.Context, id, user string, forEveryone bool) error {
+	var attachments []models.Attachment
+	ref, msg, err := m.updateMessage(id, func(ref *models.MessageRef, msg *models.Message) (*models.MessageRevision, error) {
+		conv := parseConversationKey(ref.Key)
+		ok, err := m.canAccess(ctx, conv, user)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrNotParticipant
+		}
+
+		if !forEveryone {
+			if err := m.messageRepo.HideMessage(user, id); err != nil {
+				return nil, err
+			}
+			return nil, errUnchanged
+		}
+
+		if msg.Deleted {
+			return nil, errUnchanged
+		}
+
+		if msg.From != user {
+			allowed := false
+			if conv.kind == conversationGroup {
+				if allowed, err = m.canModerate(ctx, conv.name, user); err != nil {
+					return nil, err
+				}
+			}
+			if !allowed {
+				return nil, ErrNotMessageAuthor
+			}
+		}
+
+		attachments = msg.Attachments
+		msg.Content = ""
+		msg.Attachments = nil
+		msg.Deleted = true
+		msg.DeletedAt = time.Now().UTC().Format(time.RFC3339)
+		msg.DeletedBy = user
+		return nil, nil
+	})
+	if err == errUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	conv := parseConversationKey(ref.Key)
+
+	// Drop the attachment metadata before the blobs so the files stop being
+	// served even if removing the blobs below fails
+	for _, attachment := range attachments {
+		if err := m.attachmentRepo.DeleteAttachment(attachment.ID); err != nil {
+			return err
+		}
+	}
+	if err := m.searchRepo.RemoveMessage(id); err != nil {
+		log.Println("Failed to remove message", id, "from search index:", err)
+	}
+	for _, attachment := range attachments {
+		m.deleteBlobs(ctx, attachment)
+	}
+
+	data, _ := json.Marshal(msg)
+	m.notify(ctx, conv, user, models.WSMessage{
+		Type: "message.deleted",
+		From: user,
+		ID:   id,
+		Data: data,
+	})
+
+	return nil
+}
+
+// SetGroupRole lets a group admin change a member's role. The last admin
+// cannot give the role up, so a group is never left without one.
+func (m *messageUseCase) SetGroupRole(ctx context.Context, groupName, actor, member, role string) error {
+	if role != models.GroupRoleMember && role != models.GroupRoleModerator && role != models.GroupRoleAdmin {
+		return ErrInvalidRole
+	}
+
+	rolesKey := fmt.Sprintf("group:%s:roles", groupName)
+	actorRole, err := m.messageRepo.GetGroupRole(rolesKey, actor)
+	if err != nil {
+		return err
+	}
+	if actorRole != models.GroupRoleAdmin {
+		return ErrNotGroupAdmin
+	}
+
+	isMember, err := m.IsMemberOfGroup(ctx, groupName, member)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrUserNotInGroup
+	}
+
+	set, err := m.messageRepo.SetGroupRole(rolesKey, member, role, models.GroupRoleAdmin)
+	if err != nil {
+		return err
+	}
+	if !set {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// deleteBlobs removes the stored file of an attachment and its thumbnail.
+func (m *messageUseCase) deleteBlobs(ctx context.Context, attachment models.Attachment) {
+	keys := []string{attachment.ID}
+	if attachment.ThumbnailURL != "" {
+		keys = append(keys, thumbnailKey(attachment.ID))
+	}
+	for _, key := range keys {
+		if err := m.blobStore.Delete(ctx, key); err != nil {
+			log.Println("Failed to delete blob", key, ":", err)
+		}
+	}
+}
+
+// canModerate reports whether the user may remove other members' messages.
+func (m *messageUseCase) canModerate(ctx context.Context, groupName, user string) (bool, error) {
+	role, err := m.messageRepo.GetGroupRole(fmt.Sprintf("group:%s:roles", groupName), user)
+	if err != nil {
+		return false, err
+	}
+	return role == models.GroupRoleModerator || role == models.GroupRoleAdmin, nil
+}
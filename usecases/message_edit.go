@@ -0,0 +1,126 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// loadMessage resolves a message ID to its location and current content.
+func (m *messageUseCase) loadMessage(id string) (*models.MessageRef, *models.Message, error) {
+	ref, err := m.messageRepo.GetMessageRef(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ref == nil {
+		return nil, nil, ErrMessageNotFound
+	}
+
+	msg, err := m.messageRepo.GetMessage(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref, msg, nil
+}
+
+// maxUpdateAttempts bounds how often an edit or delete starts over because
+// the message changed while it was being updated.
+const maxUpdateAttempts = 5
+
+// errUnchanged tells updateMessage that there is nothing to write.
+var errUnchanged = errors.New("message unchanged")
+
+// updateMessage loads a message and writes back what change makes of it,
+// along with the revision change returns. The write is refused if the message
+// changed in the meantime, e.g. was deleted by someone else; it is then
+// loaded, checked and changed afresh.
+func (m *messageUseCase) updateMessage(id string, change func(ref *models.MessageRef, msg *models.Message) (*models.MessageRevision, error)) (*models.MessageRef, *models.Message, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		ref, msg, err := m.loadMessage(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous := *msg
+		revision, err := change(ref, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		updated, err := m.messageRepo.UpdateMessage(ref, &previous, msg, revision)
+		if err != nil {
+			return nil, nil, err
+		}
+		if updated {
+			return ref, msg, nil
+		}
+	}
+	return nil, nil, ErrMessageChanged
+}
+
+func (m *messageUseCase) EditMessage(ctx context.Context, id, user, content string) (*models.Message, error) {
+	ref, msg, err := m.updateMessage(id, func(ref *models.MessageRef, msg *models.Message) (*models.MessageRevision, error) {
+		if msg.From != user {
+			return nil, ErrNotMessageAuthor
+		}
+		if msg.Deleted {
+			return nil, ErrMessageDeleted
+		}
+
+		// A message without a readable timestamp cannot be shown to be inside
+		// the window, so it is treated as outside it
+		if m.config.EditWindow > 0 {
+			sentAt, err := time.Parse(time.RFC3339, msg.Timestamp)
+			if err != nil || time.Since(sentAt) > m.config.EditWindow {
+				return nil, ErrEditWindowExpired
+			}
+		}
+
+		// Keep the content being replaced, stamped with when it was written
+		revisionTime := msg.Timestamp
+		if msg.EditedAt != "" {
+			revisionTime = msg.EditedAt
+		}
+		revision := &models.MessageRevision{Content: msg.Content, Timestamp: revisionTime}
+
+		msg.Content = content
+		msg.EditedAt = time.Now().UTC().Format(time.RFC3339)
+		return revision, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := indexMessage(m.searchRepo, ref.Key, msg); err != nil {
+		log.Println("Failed to reindex message", id, ":", err)
+	}
+
+	data, _ := json.Marshal(msg)
+	m.notify(ctx, parseConversationKey(ref.Key), user, models.WSMessage{
+		Type:    "message.edited",
+		From:    user,
+		Content: content,
+		ID:      id,
+		Data:    data,
+	})
+
+	return msg, nil
+}
+
+func (m *messageUseCase) GetMessageRevisions(ctx context.Context, id, user string) ([]*models.MessageRevision, error) {
+	ref, _, err := m.loadMessage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := m.canAccess(ctx, parseConversationKey(ref.Key), user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotParticipant
+	}
+
+	return m.messageRepo.GetMessageRevisions(id)
+}
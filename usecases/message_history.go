@@ -0,0 +1,287 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+
+	uuid "github.com/google/uuid"
+)
+
+// historyEntry points at the parts of a stored message that are rendered per viewer.
+type historyEntry struct {
+	meta    *models.MessageMeta
+	content *string
+}
+
+// prepareHistory applies the viewer's own deletions and fills in thread
+// summaries and reactions before a history is returned.
+func (m *messageUseCase) prepareHistory(viewer string, entries []historyEntry) error {
+	hidden, err := m.messageRepo.GetHiddenMessages(viewer)
+	if err != nil {
+		return err
+	}
+
+	metas := make([]*models.MessageMeta, 0, len(entries))
+	for _, entry := range entries {
+		hideForViewer(hidden, entry.meta, entry.content)
+		if entry.meta.ID != "" {
+			metas = append(metas, entry.meta)
+		}
+	}
+
+	if err := m.messageRepo.FillThreadStats(metas); err != nil {
+		return err
+	}
+
+	ids := make([]string, len(metas))
+	for i, meta := range metas {
+		ids[i] = meta.ID
+	}
+	reactions, err := m.messageRepo.GetReactions(ids, viewer)
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		meta.Reactions = reactions[meta.ID]
+	}
+	return nil
+}
+
+// hideForViewer renders a message the viewer deleted for themselves as a
+// tombstone, keeping its position in the history.
+func hideForViewer(hidden map[string]bool, meta *models.MessageMeta, content *string) {
+	if !hidden[meta.ID] {
+		return
+	}
+	meta.Deleted = true
+	meta.Attachments = nil
+	*content = ""
+}
+
+// maxClientIDLength bounds the client message IDs remembered for dedupe.
+const maxClientIDLength = 64
+
+// beforeSave assigns a fresh ID and, if the caller did not set one, the
+// current timestamp to a message about to be stored, resolves its attachments
+// and checks that a reply points at a top-level message of the same conversation.
+// It reports true for a retry of a send that was already stored; the message
+// then carries the original ID and timestamp and must not be stored again.
+// Otherwise the attachments are bound to the message, so that no other message
+// can carry them and deleting it may delete their files; abortSave undoes
+// this for a message that then fails to be stored.
+func (m *messageUseCase) beforeSave(key, from string, meta *models.MessageMeta, timestamp *string) (bool, error) {
+	if len(meta.ClientID) > maxClientIDLength {
+		return false, ErrInvalidClientID
+	}
+
+	meta.ID = uuid.New().String()
+	meta.EditedAt, meta.Deleted, meta.DeletedAt, meta.DeletedBy = "", false, "", ""
+	meta.ReplyCount, meta.LastReplyAt, meta.Reactions = 0, "", nil
+	if *timestamp == "" {
+		*timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	attachments, err := resolveAttachments(m.attachmentRepo, key, from, meta.Attachments)
+	if err != nil {
+		return false, err
+	}
+	meta.Attachments = attachments
+
+	if err := m.checkParent(key, meta); err != nil {
+		return false, err
+	}
+	duplicate, err := m.reserveClientID(from, meta, timestamp)
+	if err != nil || duplicate || len(meta.Attachments) == 0 {
+		return duplicate, err
+	}
+
+	bound, err := m.attachmentRepo.BindAttachments(attachmentIDs(meta.Attachments), meta.ID)
+	if err == nil && !bound {
+		err = ErrAttachmentInUse
+	}
+	if err != nil {
+		m.releaseClientID(from, meta)
+		return false, err
+	}
+	return false, nil
+}
+
+func attachmentIDs(attachments []models.Attachment) []string {
+	ids := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		ids[i] = attachment.ID
+	}
+	return ids
+}
+
+// checkParent verifies that a reply points at a top-level message of the same
+// conversation.
+func (m *messageUseCase) checkParent(key string, meta *models.MessageMeta) error {
+	if meta.ParentID == "" {
+		return nil
+	}
+
+	ref, err := m.messageRepo.GetMessageRef(meta.ParentID)
+	if err != nil {
+		return err
+	}
+	if ref == nil || ref.Key != key {
+		return ErrInvalidParent
+	}
+
+	parent, err := m.messageRepo.GetMessage(ref)
+	if err != nil {
+		return err
+	}
+	if parent.ParentID != "" {
+		return ErrInvalidParent
+	}
+	return nil
+}
+
+// clientMessage is what a claimed client message ID remembers of the send.
+type clientMessage struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+}
+
+// reserveClientID claims the client message ID of a send. A retry of a send
+// that was already claimed gets the original ID and timestamp back and
+// reports true.
+func (m *messageUseCase) reserveClientID(from string, meta *models.MessageMeta, timestamp *string) (bool, error) {
+	if meta.ClientID == "" {
+		return false, nil
+	}
+
+	value, _ := json.Marshal(clientMessage{ID: meta.ID, Timestamp: *timestamp})
+	stored, reserved, err := m.messageRepo.ReserveClientMessage(from, meta.ClientID, string(value), m.config.DedupeWindow)
+	if err != nil || reserved {
+		return false, err
+	}
+
+	var original clientMessage
+	if err := json.Unmarshal([]byte(stored), &original); err != nil {
+		return false, err
+	}
+	meta.ID, *timestamp = original.ID, original.Timestamp
+	return true, nil
+}
+
+// abortSave frees the client message ID and attachments of a send that
+// failed to be stored, so that it can be retried.
+func (m *messageUseCase) abortSave(from string, meta *models.MessageMeta) {
+	m.releaseClientID(from, meta)
+	if len(meta.Attachments) == 0 {
+		return
+	}
+	if err := m.attachmentRepo.UnbindAttachments(attachmentIDs(meta.Attachments)); err != nil {
+		log.Println("Failed to free the attachments of message", meta.ID, ":", err)
+	}
+}
+
+// releaseClientID forgets the client message ID of a send that failed to be
+// stored, so that the client can retry it.
+func (m *messageUseCase) releaseClientID(from string, meta *models.MessageMeta) {
+	if meta.ClientID == "" {
+		return
+	}
+	if err := m.messageRepo.ReleaseClientMessage(from, meta.ClientID); err != nil {
+		log.Println("Failed to release client message ID", meta.ClientID, "of", from, ":", err)
+	}
+}
+
+// afterSave indexes a stored message for search, records the conversation's
+// activity, delivers it to the other participants and, for replies, records it
+// on its parent's thread and notifies the other thread participants. The
+// message is already stored, so failures are logged rather than returned: the
+// sender must not retry a message that was sent.
+func (m *messageUseCase) afterSave(ctx context.Context, key string, meta *models.MessageMeta, from, content, timestamp string, msg interface{}) {
+	m.trackActivity(ctx, key, meta, from)
+
+	indexed := &models.Message{MessageMeta: *meta, From: from, Content: content, Timestamp: timestamp}
+	if err := indexMessage(m.searchRepo, key, indexed); err != nil {
+		log.Println("Failed to index message", meta.ID, ":", err)
+	}
+
+	conv := parseConversationKey(key)
+	m.notify(ctx, conv, from, models.WSMessage{
+		Type:        conv.kind,
+		From:        from,
+		Group:       conv.name,
+		Content:     content,
+		ID:          meta.ID,
+		ClientID:    meta.ClientID,
+		ParentID:    meta.ParentID,
+		Attachments: meta.Attachments,
+		Timestamp:   timestamp,
+	})
+
+	if meta.ParentID == "" {
+		return
+	}
+
+	_, parent, err := m.loadMessage(meta.ParentID)
+	if err != nil {
+		log.Println("Failed to load parent", meta.ParentID, "of reply", meta.ID, ":", err)
+		return
+	}
+
+	// The parent's author follows the thread from its first reply
+	if err := m.messageRepo.AddReply(meta.ParentID, meta.ID, timestamp, parent.From, from); err != nil {
+		log.Println("Failed to add reply", meta.ID, "to thread", meta.ParentID, ":", err)
+		return
+	}
+
+	participants, err := m.messageRepo.GetThreadParticipants(meta.ParentID)
+	if err != nil {
+		log.Println("Failed to resolve thread participants for", meta.ParentID, ":", err)
+		return
+	}
+
+	data, _ := json.Marshal(msg)
+	for _, participant := range participants {
+		if participant == from {
+			continue
+		}
+		m.publish(ctx, participant, models.WSMessage{Type: "thread.reply", From: from, ID: meta.ParentID, Data: data})
+	}
+}
+
+// GetThread returns a page of the replies to a message, oldest first.
+func (m *messageUseCase) GetThread(ctx context.Context, id, user string, offset, limit int64) (*models.Thread, error) {
+	ref, parent, err := m.loadMessage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := m.canAccess(ctx, parseConversationKey(ref.Key), user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotParticipant
+	}
+
+	ids, total, err := m.messageRepo.GetReplyIDs(id, offset, offset+limit-1)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := m.messageRepo.GetMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []historyEntry{{meta: &parent.MessageMeta, content: &parent.Content}}
+	for _, reply := range replies {
+		entries = append(entries, historyEntry{meta: &reply.MessageMeta, content: &reply.Content})
+	}
+	if err := m.prepareHistory(user, entries); err != nil {
+		return nil, err
+	}
+
+	return &models.Thread{Parent: parent, Replies: replies, Total: total}, nil
+}
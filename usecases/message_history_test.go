@@ -0,0 +1,87 @@
+package usecases
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// historyLength returns how many messages the DM of alice and bob holds.
+func (uc *testUseCases) historyLength(t *testing.T) int {
+	t.Helper()
+	history, err := uc.messages.GetDMHistory(context.Background(), "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(history)
+}
+
+func TestRetriedSendsAreDedupedWithinTheWindow(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{DedupeWindow: time.Hour})
+	ctx := context.Background()
+
+	first := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c1"}, Content: "hello"}
+	if err := uc.sendDM(t, first); err != nil {
+		t.Fatal(err)
+	}
+	uc.server.FastForward(59 * time.Minute)
+	retry := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c1"}, Content: "hello"}
+	if err := uc.sendDM(t, retry); err != nil {
+		t.Fatal(err)
+	}
+	if retry.ID != first.ID || retry.Timestamp != first.Timestamp {
+		t.Errorf("retry got %s at %s, want the original %s at %s", retry.ID, retry.Timestamp, first.ID, first.Timestamp)
+	}
+	if n := uc.historyLength(t); n != 1 {
+		t.Errorf("history has %d messages after a retry, want 1", n)
+	}
+
+	// Client IDs are the sender's own
+	other := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c1"}, From: "bob", To: "alice", Content: "hi"}
+	if err := uc.messages.SaveDirectMessage(ctx, "bob", "alice", other); err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == first.ID {
+		t.Error("another sender's client ID was deduped against alice's")
+	}
+
+	// Past the window the ID is forgotten and a send is stored again
+	uc.server.FastForward(2 * time.Minute)
+	late := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c1"}, Content: "hello"}
+	if err := uc.sendDM(t, late); err != nil {
+		t.Fatal(err)
+	}
+	if late.ID == first.ID {
+		t.Error("a send after the window was deduped")
+	}
+	if n := uc.historyLength(t); n != 3 {
+		t.Errorf("history has %d messages, want 3", n)
+	}
+}
+
+func TestZeroDedupeWindowRemembersForever(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{})
+	first := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c1"}, Content: "hello"}
+	if err := uc.sendDM(t, first); err != nil {
+		t.Fatal(err)
+	}
+	uc.server.FastForward(365 * 24 * time.Hour)
+	retry := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c1"}, Content: "hello"}
+	if err := uc.sendDM(t, retry); err != nil || retry.ID != first.ID {
+		t.Errorf("retry a year later: %v, ID %s, want %s", err, retry.ID, first.ID)
+	}
+}
+
+func TestLongClientIDsAreRefused(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{DedupeWindow: time.Hour})
+	msg := &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: strings.Repeat("x", maxClientIDLength+1)}, Content: "hello"}
+	if err := uc.sendDM(t, msg); err != ErrInvalidClientID {
+		t.Errorf("got %v, want ErrInvalidClientID", err)
+	}
+	if n := uc.historyLength(t); n != 0 {
+		t.Errorf("history has %d messages, want none", n)
+	}
+}
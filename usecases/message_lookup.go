@@ -0,0 +1,104 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// GetMessagesByID loads several messages at once, keyed by ID, as the viewer
+// sees them. Messages that do not exist or belong to a conversation the
+// viewer is not part of are left out.
+func (m *messageUseCase) GetMessagesByID(ctx context.Context, user string, ids []string) (map[string]*models.Message, error) {
+	msgs, err := m.messageRepo.GetMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*models.Message, len(msgs))
+	entries := make([]historyEntry, 0, len(msgs))
+	access := map[string]bool{} // by conversation ID, looked up once per batch
+	for _, msg := range msgs {
+		conv := messageConversation(msg)
+		ok, seen := access[conv.id()]
+		if !seen {
+			if ok, err = m.canAccess(ctx, conv, user); err != nil {
+				return nil, err
+			}
+			access[conv.id()] = ok
+		}
+		if !ok {
+			continue
+		}
+		found[msg.ID] = msg
+		entries = append(entries, historyEntry{meta: &msg.MessageMeta, content: &msg.Content})
+	}
+	if err := m.prepareHistory(user, entries); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// messageConversation derives the conversation of a stored message from its
+// addressing: a group, a recipient for DMs, or neither for broadcasts.
+func messageConversation(msg *models.Message) conversation {
+	switch {
+	case msg.Group != "":
+		return conversation{kind: conversationGroup, name: msg.Group}
+	case msg.To != "":
+		return parseConversationKey(getDMKey(msg.From, msg.To))
+	default:
+		return conversation{kind: conversationBroadcast}
+	}
+}
+
+// GetConversationHistory returns a page of the messages of a conversation,
+// oldest first, and the number of messages in it.
+func (m *messageUseCase) GetConversationHistory(ctx context.Context, user, conversationID string, offset, limit int64) ([]*models.Message, int64, error) {
+	conv, ok := parseConversationID(conversationID)
+	if !ok {
+		return nil, 0, ErrInvalidConversation
+	}
+	if err := requireAccess(m.messageRepo, conv, user); err != nil {
+		return nil, 0, err
+	}
+
+	msgs, total, err := m.messageRepo.GetConversationRange(conv.key(), offset, offset+limit-1)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]historyEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = historyEntry{meta: &msg.MessageMeta, content: &msg.Content}
+	}
+	if err := m.prepareHistory(user, entries); err != nil {
+		return nil, 0, err
+	}
+	return msgs, total, nil
+}
+
+// GetGroupsMembers returns the members of several groups at once, keyed by
+// group name. Groups that do not exist or that the user is not a member of
+// are left out.
+func (m *messageUseCase) GetGroupsMembers(ctx context.Context, user string, groups []string) (map[string][]string, error) {
+	keys := make([]string, len(groups))
+	for i, group := range groups {
+		keys[i] = fmt.Sprintf("group:%s:members", group)
+	}
+	members, err := m.messageRepo.GetGroupsMembers(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string][]string, len(groups))
+	for i, group := range groups {
+		for _, member := range members[keys[i]] {
+			if member == user {
+				visible[group] = members[keys[i]]
+				break
+			}
+		}
+	}
+	return visible, nil
+}
@@ -0,0 +1,82 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+const maxReactionLength = 32
+
+func (m *messageUseCase) AddReaction(ctx context.Context, id, user, emoji string) error {
+	ref, err := m.reactionTarget(ctx, id, user, emoji)
+	if err != nil {
+		return err
+	}
+
+	// Only a new kind of reaction counts towards the cap
+	count, added, err := m.messageRepo.AddReaction(id, emoji, user, m.config.MaxReactions)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrReactionLimit
+	}
+
+	m.notifyReaction(ctx, ref, "reaction.added", user, emoji, count)
+	return nil
+}
+
+func (m *messageUseCase) RemoveReaction(ctx context.Context, id, user, emoji string) error {
+	ref, err := m.reactionTarget(ctx, id, user, emoji)
+	if err != nil {
+		return err
+	}
+
+	count, err := m.messageRepo.RemoveReaction(id, emoji, user)
+	if err != nil {
+		return err
+	}
+
+	m.notifyReaction(ctx, ref, "reaction.removed", user, emoji, count)
+	return nil
+}
+
+// reactionTarget validates the emoji and checks that the user can see the
+// message being reacted to.
+func (m *messageUseCase) reactionTarget(ctx context.Context, id, user, emoji string) (*models.MessageRef, error) {
+	if emoji == "" || len(emoji) > maxReactionLength || strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		return nil, ErrInvalidReaction
+	}
+
+	ref, msg, err := m.loadMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Deleted {
+		return nil, ErrMessageDeleted
+	}
+
+	ok, err := m.canAccess(ctx, parseConversationKey(ref.Key), user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotParticipant
+	}
+	return ref, nil
+}
+
+func (m *messageUseCase) notifyReaction(ctx context.Context, ref *models.MessageRef, eventType, user, emoji string, count int64) {
+	data, _ := json.Marshal(models.Reaction{Emoji: emoji, Count: count})
+	m.notify(ctx, parseConversationKey(ref.Key), user, models.WSMessage{
+		Type:    eventType,
+		From:    user,
+		Content: emoji,
+		ID:      ref.ID,
+		Data:    data,
+	})
+}
@@ -0,0 +1,102 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// reactions returns the reactions on a message as bob sees them.
+func (uc *testUseCases) reactions(t *testing.T, id string) string {
+	t.Helper()
+	msgs, err := uc.messages.GetMessagesByID(context.Background(), "bob", []string{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(msgs[id].Reactions)
+}
+
+func TestReactionKindsAreCapped(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{MaxReactions: 2})
+	ctx := context.Background()
+	msg := &models.DirectMessage{Content: "react to me"}
+	if err := uc.sendDM(t, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		user, emoji string
+		remove      bool
+		want        error
+	}{
+		{"alice", "👍", false, nil},
+		{"bob", "👍", false, nil},
+		{"alice", "❤️", false, nil},
+		// A third kind is one too many, but more of an existing kind is not
+		{"bob", "😂", false, ErrReactionLimit},
+		{"bob", "❤️", false, nil},
+		// The kind stays while anyone still uses it
+		{"bob", "👍", true, nil},
+		{"bob", "😂", false, ErrReactionLimit},
+		{"alice", "👍", true, nil},
+		{"bob", "😂", false, nil},
+	}
+	for _, s := range steps {
+		var err error
+		if s.remove {
+			err = uc.messages.RemoveReaction(ctx, msg.ID, s.user, s.emoji)
+		} else {
+			err = uc.messages.AddReaction(ctx, msg.ID, s.user, s.emoji)
+		}
+		if err != s.want {
+			t.Errorf("%s %s (remove %v): got %v, want %v", s.user, s.emoji, s.remove, err, s.want)
+		}
+	}
+
+	want := fmt.Sprint([]models.Reaction{
+		{Emoji: "❤️", Count: 2, ReactedByMe: true},
+		{Emoji: "😂", Count: 1, ReactedByMe: true},
+	})
+	if got := uc.reactions(t, msg.ID); got != want {
+		t.Errorf("reactions = %s, want %s", got, want)
+	}
+}
+
+// Reacting twice counts once, and removing a reaction that is not there
+// changes nothing.
+func TestReactionsAreIdempotent(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{MaxReactions: 1})
+	ctx := context.Background()
+	msg := &models.DirectMessage{Content: "react to me"}
+	if err := uc.sendDM(t, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := uc.messages.AddReaction(ctx, msg.ID, "bob", "👍"); err != nil {
+			t.Fatalf("adding a reaction, time %d: %v", i+1, err)
+		}
+	}
+	want := fmt.Sprint([]models.Reaction{{Emoji: "👍", Count: 1, ReactedByMe: true}})
+	if got := uc.reactions(t, msg.ID); got != want {
+		t.Errorf("reactions = %s, want %s", got, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := uc.messages.RemoveReaction(ctx, msg.ID, "bob", "👍"); err != nil {
+			t.Fatalf("removing a reaction, time %d: %v", i+1, err)
+		}
+	}
+	if err := uc.messages.RemoveReaction(ctx, msg.ID, "alice", "🎉"); err != nil {
+		t.Errorf("removing a reaction that was never added: %v", err)
+	}
+	if got := uc.reactions(t, msg.ID); got != "[]" {
+		t.Errorf("reactions after removing = %s, want none", got)
+	}
+	// With every reaction gone, the cap counts from zero again
+	if err := uc.messages.AddReaction(ctx, msg.ID, "alice", "🎉"); err != nil {
+		t.Errorf("a new kind after all were removed: %v", err)
+	}
+}
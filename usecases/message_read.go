@@ -0,0 +1,125 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// MarkRead moves the user's read cursor in a conversation up to and including
+// messageID, or to the latest message when messageID is empty, and sends a
+// read receipt to the other participants of DMs and small groups.
+func (m *messageUseCase) MarkRead(ctx context.Context, user, conversationID, messageID string) error {
+	conv, ok := parseConversationID(conversationID)
+	if !ok {
+		return ErrInvalidConversation
+	}
+	allowed, err := m.canAccess(ctx, conv, user)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrNotParticipant
+	}
+
+	key := conv.key()
+	var position int64
+	if messageID == "" {
+		lengths, err := m.conversationRepo.GetConversationLengths([]string{key})
+		if err != nil {
+			return err
+		}
+		position = lengths[key]
+	} else {
+		ref, err := m.messageRepo.GetMessageRef(messageID)
+		if err != nil {
+			return err
+		}
+		if ref == nil || ref.Key != key {
+			return ErrMessageNotFound
+		}
+		position = ref.Index + 1
+	}
+
+	if err := m.conversationRepo.SetReadCursor(user, key, position); err != nil {
+		return err
+	}
+
+	if conv.kind == conversationBroadcast {
+		return nil
+	}
+	if conv.kind == conversationGroup && m.config.ReadReceiptMaxGroupSize > 0 {
+		members, err := m.participants(ctx, conv)
+		if err != nil {
+			return err
+		}
+		if int64(len(members)) > m.config.ReadReceiptMaxGroupSize {
+			return nil
+		}
+	}
+
+	data, _ := json.Marshal(models.ReadReceipt{
+		Conversation: conv.id(),
+		User:         user,
+		MessageID:    messageID,
+		ReadAt:       time.Now().UTC().Format(time.RFC3339),
+	})
+	m.notify(ctx, conv, user, models.WSMessage{Type: "read.receipt", From: user, ID: messageID, Data: data})
+	return nil
+}
+
+// GetUnreadCounts returns, for each of the user's conversations with unread
+// messages, how many messages arrived after their read cursor.
+func (m *messageUseCase) GetUnreadCounts(ctx context.Context, user string) (*models.UnreadCounts, error) {
+	keys, err := m.conversationRepo.GetUserConversations(user)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, conversation{kind: conversationBroadcast}.key())
+
+	lengths, err := m.conversationRepo.GetConversationLengths(keys)
+	if err != nil {
+		return nil, err
+	}
+	cursors, err := m.conversationRepo.GetReadCursors(user, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := &models.UnreadCounts{Conversations: make(map[string]int64)}
+	for _, key := range keys {
+		unread := lengths[key] - cursors[key]
+		if unread <= 0 {
+			continue
+		}
+		counts.Conversations[parseConversationKey(key).id()] = unread
+		counts.Total += unread
+	}
+	return counts, nil
+}
+
+// trackActivity bumps the conversation in its participants' conversation
+// lists and marks everything up to the sender's own message as read by them.
+func (m *messageUseCase) trackActivity(ctx context.Context, key string, meta *models.MessageMeta, from string) {
+	conv := parseConversationKey(key)
+	if conv.kind != conversationBroadcast {
+		users, err := m.participants(ctx, conv)
+		if err == nil {
+			err = m.conversationRepo.TouchConversation(users, key, time.Now().UnixMilli())
+		}
+		if err != nil {
+			log.Println("Failed to record activity in", key, ":", err)
+		}
+	}
+
+	ref, err := m.messageRepo.GetMessageRef(meta.ID)
+	if err == nil && ref != nil {
+		err = m.conversationRepo.SetReadCursor(from, key, ref.Index+1)
+	}
+	if err != nil {
+		log.Println("Failed to advance read cursor of", from, "in", key, ":", err)
+	}
+}
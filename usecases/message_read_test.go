@@ -0,0 +1,103 @@
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/haileamlak/chat-system/models"
+)
+
+// unread returns a user's unread counts, e.g. "3 map[dm:alice:bob:3]".
+func (uc *testUseCases) unread(t *testing.T, user string) string {
+	t.Helper()
+	counts, err := uc.messages.GetUnreadCounts(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(counts.Total, " ", counts.Conversations)
+}
+
+func TestUnreadCountsFollowReadCursors(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{})
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		msg := &models.DirectMessage{Content: fmt.Sprint("message ", i)}
+		if err := uc.sendDM(t, msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if err := uc.messages.CreateGroup(ctx, "team", "alice", []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.messages.SendGroupMessage(ctx, "team", &models.GroupMessage{From: "alice", Group: "team", Content: "hi team"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.messages.SendBroadcastMessage(ctx, &models.BroadcastMessage{From: "alice", Content: "hi all"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Senders have read their own messages
+	if got, want := uc.unread(t, "alice"), "0 map[]"; got != want {
+		t.Errorf("alice's unread counts = %s, want %s", got, want)
+	}
+
+	steps := []struct {
+		conversation, messageID string
+		want                    string
+	}{
+		{"", "", "5 map[broadcast:1 dm:alice:bob:3 group:team:1]"},
+		{"dm:alice:bob", ids[1], "3 map[broadcast:1 dm:alice:bob:1 group:team:1]"},
+		// The cursor never moves back
+		{"dm:alice:bob", ids[0], "3 map[broadcast:1 dm:alice:bob:1 group:team:1]"},
+		{"group:team", "", "2 map[broadcast:1 dm:alice:bob:1]"},
+		{"broadcast", "", "1 map[dm:alice:bob:1]"},
+		{"dm:alice:bob", "", "0 map[]"},
+		{"dm:alice:bob", ids[0], "0 map[]"},
+	}
+	for _, s := range steps {
+		if s.conversation != "" {
+			if err := uc.messages.MarkRead(ctx, "bob", s.conversation, s.messageID); err != nil {
+				t.Fatalf("mark %s read up to %q: %v", s.conversation, s.messageID, err)
+			}
+		}
+		if got := uc.unread(t, "bob"); got != s.want {
+			t.Errorf("after reading %s up to %q: unread counts = %s, want %s", s.conversation, s.messageID, got, s.want)
+		}
+	}
+
+	// New messages count from the cursor
+	if err := uc.sendDM(t, &models.DirectMessage{Content: "one more"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uc.unread(t, "bob"), "1 map[dm:alice:bob:1]"; got != want {
+		t.Errorf("after a new message: unread counts = %s, want %s", got, want)
+	}
+}
+
+func TestMarkReadErrors(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{})
+	ctx := context.Background()
+	msg := &models.DirectMessage{Content: "hello"}
+	if err := uc.sendDM(t, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, conversation, messageID string
+		want                          error
+	}{
+		{"carol", "dm:alice:bob", "", ErrNotParticipant},
+		{"bob", "dm:bob:carol", msg.ID, ErrMessageNotFound},
+		{"bob", "dm:alice:bob", "missing", ErrMessageNotFound},
+		{"bob", "nowhere", "", ErrInvalidConversation},
+	}
+	for _, tt := range tests {
+		if err := uc.messages.MarkRead(ctx, tt.user, tt.conversation, tt.messageID); err != tt.want {
+			t.Errorf("%s marks %s read up to %q: got %v, want %v", tt.user, tt.conversation, tt.messageID, err, tt.want)
+		}
+	}
+}
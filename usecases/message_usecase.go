@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"sort"
 	"context"
+	"time"
 
+	"github.com/haileamlak/chat-system/infrastructure"
 	"github.com/haileamlak/chat-system/models"
 	"github.com/haileamlak/chat-system/repositories"
 )
@@ -13,29 +15,83 @@ type MessageUseCase interface {
 	SaveDirectMessage(ctx context.Context, user1, user2 string, msg *models.DirectMessage) error
 	GetDirectMessage(ctx context.Context, user1, user2 string, index int64) (*models.DirectMessage, error)
 	GetDMHistory(ctx context.Context, user1, user2 string) ([]*models.DirectMessage, error)
-	CreateGroup(ctx context.Context, groupName string, members []string) error
-	GetGroupHistory(ctx context.Context, groupName string) ([]*models.GroupMessage, error)
-	GroupExists(ctx context.Context, groupName string) (bool, error)
+	CreateGroup(ctx context.Context, groupName, creator string, members []string) error
+	GetGroupHistory(ctx context.Context, groupName, viewer string) ([]*models.GroupMessage, error)
 	AddMemberToGroup(ctx context.Context, groupName, member string) error
 	IsMemberOfGroup(ctx context.Context, groupName, member string) (bool, error)
 	SendGroupMessage(ctx context.Context, groupName string, msg *models.GroupMessage) error
 	SendBroadcastMessage(ctx context.Context, msg *models.BroadcastMessage) error
-	GetBroadcastHistory(ctx context.Context) ([]*models.BroadcastMessage, error)
+	GetBroadcastHistory(ctx context.Context, viewer string) ([]*models.BroadcastMessage, error)
+	EditMessage(ctx context.Context, id, user, content string) (*models.Message, error)
+	GetMessageRevisions(ctx context.Context, id, user string) ([]*models.MessageRevision, error)
+	DeleteMessage(ctx context.Context, id, user string, forEveryone bool) error
+	GetThread(ctx context.Context, id, user string, offset, limit int64) (*models.Thread, error)
+	AddReaction(ctx context.Context, id, user, emoji string) error
+	RemoveReaction(ctx context.Context, id, user, emoji string) error
+	MarkRead(ctx context.Context, user, conversationID, messageID string) error
+	GetUnreadCounts(ctx context.Context, user string) (*models.UnreadCounts, error)
+	ListConversations(ctx context.Context, user string, offset, limit int64) (*models.ConversationList, error)
+	SetGroupRole(ctx context.Context, groupName, actor, member, role string) error
+	GetMessagesByID(ctx context.Context, user string, ids []string) (map[string]*models.Message, error)
+	GetConversationHistory(ctx context.Context, user, conversationID string, offset, limit int64) ([]*models.Message, int64, error)
+	GetGroupsMembers(ctx context.Context, user string, groups []string) (map[string][]string, error)
+	BackfillConversations(ctx context.Context) (int, error)
+}
+
+// MessageConfig holds the tunable limits of the message use case.
+type MessageConfig struct {
+	// EditWindow is how long after sending the author may still edit a
+	// message. Zero disables the limit.
+	EditWindow time.Duration
+	// MaxReactions caps how many distinct reactions a single message can carry.
+	MaxReactions int64
+	// ReadReceiptMaxGroupSize is the largest group whose members receive read
+	// receipts. Zero sends them in every group.
+	ReadReceiptMaxGroupSize int64
+	// DedupeWindow is how long a client message ID is remembered, so that a
+	// retried send within it is not stored twice.
+	DedupeWindow time.Duration
+	// EventLogSize is how many recent events are kept per user, and for
+	// broadcasts, for clients to replay after a reconnect.
+	EventLogSize int64
 }
 
 type messageUseCase struct {
-	messageRepo repositories.MessageRepository
+	messageRepo      repositories.MessageRepository
+	searchRepo       repositories.SearchRepository
+	attachmentRepo   repositories.AttachmentRepository
+	blobStore        infrastructure.BlobStore
+	conversationRepo repositories.ConversationRepository
+	eventRepo        repositories.EventRepository
+	pubSubService    infrastructure.PubSubService
+	config           MessageConfig
 }
 
-func NewMessageUseCase(messageRepo repositories.MessageRepository) MessageUseCase {
+func NewMessageUseCase(messageRepo repositories.MessageRepository, searchRepo repositories.SearchRepository, attachmentRepo repositories.AttachmentRepository, blobStore infrastructure.BlobStore, conversationRepo repositories.ConversationRepository, eventRepo repositories.EventRepository, pubSubService infrastructure.PubSubService, config MessageConfig) MessageUseCase {
 	return &messageUseCase{
-		messageRepo: messageRepo,
+		messageRepo:      messageRepo,
+		searchRepo:       searchRepo,
+		attachmentRepo:   attachmentRepo,
+		blobStore:        blobStore,
+		conversationRepo: conversationRepo,
+		eventRepo:        eventRepo,
+		pubSubService:    pubSubService,
+		config:           config,
 	}
 }
 
 func (m *messageUseCase) SaveDirectMessage(ctx context.Context, user1, user2 string, msg *models.DirectMessage) error {
 	key := getDMKey(user1, user2)
-	return m.messageRepo.SaveDirectMessage(key, msg)
+	duplicate, err := m.beforeSave(key, msg.From, &msg.MessageMeta, &msg.Timestamp)
+	if err != nil || duplicate {
+		return err
+	}
+	if err := m.messageRepo.SaveDirectMessage(key, msg); err != nil {
+		m.abortSave(msg.From, &msg.MessageMeta)
+		return err
+	}
+	m.afterSave(ctx, key, &msg.MessageMeta, msg.From, msg.Content, msg.Timestamp, msg)
+	return nil
 }
 
 func (m *messageUseCase) GetDirectMessage(ctx context.Context, user1, user2 string, index int64) (*models.DirectMessage, error) {
@@ -43,26 +99,78 @@ func (m *messageUseCase) GetDirectMessage(ctx context.Context, user1, user2 stri
 	return m.messageRepo.GetDirectMessage(key, index)
 }
 
+// GetDMHistory returns the conversation as seen by user1.
 func (m *messageUseCase) GetDMHistory(ctx context.Context, user1, user2 string) ([]*models.DirectMessage, error) {
 	key := getDMKey(user1, user2)
-	return m.messageRepo.GetDMHistory(key)
+	msgs, err := m.messageRepo.GetDMHistory(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = historyEntry{meta: &msg.MessageMeta, content: &msg.Content}
+	}
+	if err := m.prepareHistory(user1, entries); err != nil {
+		return nil, err
+	}
+	return msgs, nil
 }
 
-func (m *messageUseCase) CreateGroup(ctx context.Context, groupName string, members []string) error {
-	groupKey := fmt.Sprintf("group:%s:members", groupName)
-	return m.messageRepo.CreateGroup(groupKey, members)
+// CreateGroup creates a group of the creator, who becomes its admin, and the
+// other members given. Taking over an existing group fails with
+// ErrGroupExists.
+func (m *messageUseCase) CreateGroup(ctx context.Context, groupName, creator string, members []string) error {
+	all := []string{creator}
+	for _, member := range members {
+		if member != "" && member != creator {
+			all = append(all, member)
+		}
+	}
+
+	created, err := m.messageRepo.CreateGroup(fmt.Sprintf("group:%s:members", groupName), fmt.Sprintf("group:%s:roles", groupName), all, models.GroupRoleAdmin)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrGroupExists
+	}
+	return m.conversationRepo.TouchConversation(all, fmt.Sprintf("group:%s:messages", groupName), time.Now().UnixMilli())
 }
-func (m *messageUseCase) GetGroupHistory(ctx context.Context, groupName string) ([]*models.GroupMessage, error) {
+// GetGroupHistory returns the messages of a group, or ErrGroupNotFound.
+func (m *messageUseCase) GetGroupHistory(ctx context.Context, groupName, viewer string) ([]*models.GroupMessage, error) {
+	if err := m.requireGroup(groupName); err != nil {
+		return nil, err
+	}
 	groupKey := fmt.Sprintf("group:%s:messages", groupName)
-	return m.messageRepo.GetGroupHistory(groupKey)
-}
-func (m *messageUseCase) GroupExists(ctx context.Context, groupName string) (bool, error) {
-	groupKey := fmt.Sprintf("group:%s:members", groupName)
-	return m.messageRepo.GroupExists(groupKey)
+	msgs, err := m.messageRepo.GetGroupHistory(groupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = historyEntry{meta: &msg.MessageMeta, content: &msg.Content}
+	}
+	if err := m.prepareHistory(viewer, entries); err != nil {
+		return nil, err
+	}
+	return msgs, nil
 }
+// AddMemberToGroup adds a member to an existing group, or fails with
+// ErrGroupNotFound.
 func (m *messageUseCase) AddMemberToGroup(ctx context.Context, groupName, member string) error {
+	if err := m.requireGroup(groupName); err != nil {
+		return err
+	}
 	groupKey := fmt.Sprintf("group:%s:members", groupName)
-	return m.messageRepo.AddMemberToGroup(groupKey, member)
+	if err := m.messageRepo.AddMemberToGroup(groupKey, member); err != nil {
+		return err
+	}
+	return m.conversationRepo.TouchConversation([]string{member}, fmt.Sprintf("group:%s:messages", groupName), time.Now().UnixMilli())
+}
+func (m *messageUseCase) requireGroup(groupName string) error {
+	return requireGroup(m.messageRepo, groupName)
 }
 func (m *messageUseCase) IsMemberOfGroup(ctx context.Context, groupName, member string) (bool, error) {
 	groupKey := fmt.Sprintf("group:%s:members", groupName)
@@ -70,15 +178,45 @@ func (m *messageUseCase) IsMemberOfGroup(ctx context.Context, groupName, member
 }
 func (m *messageUseCase) SendGroupMessage(ctx context.Context, groupName string, msg *models.GroupMessage) error {
 	groupKey := fmt.Sprintf("group:%s:messages", groupName)
-	return m.messageRepo.SendGroupMessage(groupKey, msg)
+	duplicate, err := m.beforeSave(groupKey, msg.From, &msg.MessageMeta, &msg.Timestamp)
+	if err != nil || duplicate {
+		return err
+	}
+	if err := m.messageRepo.SendGroupMessage(groupKey, msg); err != nil {
+		m.abortSave(msg.From, &msg.MessageMeta)
+		return err
+	}
+	m.afterSave(ctx, groupKey, &msg.MessageMeta, msg.From, msg.Content, msg.Timestamp, msg)
+	return nil
 }
 func (m *messageUseCase) SendBroadcastMessage(ctx context.Context, msg *models.BroadcastMessage) error {
 	broadcastKey := "broadcast:messages"
-	return m.messageRepo.SendBroadcastMessage(broadcastKey, msg)
+	duplicate, err := m.beforeSave(broadcastKey, msg.From, &msg.MessageMeta, &msg.Timestamp)
+	if err != nil || duplicate {
+		return err
+	}
+	if err := m.messageRepo.SendBroadcastMessage(broadcastKey, msg); err != nil {
+		m.abortSave(msg.From, &msg.MessageMeta)
+		return err
+	}
+	m.afterSave(ctx, broadcastKey, &msg.MessageMeta, msg.From, msg.Content, msg.Timestamp, msg)
+	return nil
 }
-func (m *messageUseCase) GetBroadcastHistory(ctx context.Context) ([]*models.BroadcastMessage, error) {	
+func (m *messageUseCase) GetBroadcastHistory(ctx context.Context, viewer string) ([]*models.BroadcastMessage, error) {
 	broadcastKey := "broadcast:messages"
-	return m.messageRepo.GetBroadcastHistory(broadcastKey)
+	msgs, err := m.messageRepo.GetBroadcastHistory(broadcastKey)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = historyEntry{meta: &msg.MessageMeta, content: &msg.Content}
+	}
+	if err := m.prepareHistory(viewer, entries); err != nil {
+		return nil, err
+	}
+	return msgs, nil
 }
 
 
@@ -86,4 +224,4 @@ func getDMKey(user1, user2 string) string {
 	users := []string{user1, user2}
 	sort.Strings(users)
 	return fmt.Sprintf("dm:%s:%s", users[0], users[1])
-}
\ No newline at end of file
+}
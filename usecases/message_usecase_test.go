@@ -0,0 +1,129 @@
+package usecases
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+)
+
+// testUseCases are the message and event use cases wired as in main.go over
+// an in-memory Redis.
+type testUseCases struct {
+	server   *miniredis.Miniredis
+	redis    infrastructure.RedisService
+	messages MessageUseCase
+	events   EventUseCase
+}
+
+// testReplayLimit is the replay limit of the event use case under test.
+const testReplayLimit = 10
+
+func newTestUseCases(t *testing.T, config MessageConfig) *testUseCases {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redisService := infrastructure.NewRedisService(server.Addr())
+	t.Cleanup(func() { redisService.Close() })
+	blobStore, err := infrastructure.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := infrastructure.NewConnectionRegistry(redisService, "node-a", time.Minute)
+	eventRepo := repositories.NewEventRepository(redisService)
+	return &testUseCases{
+		server: server,
+		redis:  redisService,
+		messages: NewMessageUseCase(
+			repositories.NewMessageRepository(redisService),
+			repositories.NewSearchRepository(redisService),
+			repositories.NewAttachmentRepository(redisService),
+			blobStore,
+			repositories.NewConversationRepository(redisService),
+			eventRepo,
+			infrastructure.NewPubSubService(redisService, registry),
+			config,
+		),
+		events: NewEventUseCase(eventRepo, EventConfig{ReplayLimit: testReplayLimit}),
+	}
+}
+
+func TestLastAdminKeepsTheRole(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{})
+	ctx := context.Background()
+	if err := uc.messages.CreateGroup(ctx, "team", "alice", []string{"bob", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		actor, member, role string
+		want                error
+	}{
+		{"alice", "alice", "member", ErrLastAdmin},
+		{"alice", "alice", "moderator", ErrLastAdmin},
+		{"alice", "alice", "admin", nil},
+		{"alice", "bob", "admin", nil},
+		{"bob", "alice", "member", nil},
+		{"bob", "bob", "moderator", ErrLastAdmin},
+		{"alice", "bob", "member", ErrNotGroupAdmin},
+		{"bob", "carol", "admin", nil},
+		{"carol", "bob", "member", nil},
+		{"carol", "carol", "member", ErrLastAdmin},
+	}
+	for _, s := range steps {
+		if err := uc.messages.SetGroupRole(ctx, "team", s.actor, s.member, s.role); err != s.want {
+			t.Errorf("%s makes %s %s: got %v, want %v", s.actor, s.member, s.role, err, s.want)
+		}
+	}
+}
+
+// sendDM stores a DM from alice to bob.
+func (uc *testUseCases) sendDM(t *testing.T, msg *models.DirectMessage) error {
+	t.Helper()
+	msg.From, msg.To, msg.Timestamp = "alice", "bob", ""
+	return uc.messages.SaveDirectMessage(context.Background(), "alice", "bob", msg)
+}
+
+// An attachment goes with one message only, so deleting that message cannot
+// take the file away from another.
+func TestAttachmentIsSentWithOneMessage(t *testing.T) {
+	uc := newTestUseCases(t, MessageConfig{DedupeWindow: time.Hour})
+	attachments := repositories.NewAttachmentRepository(uc.redis)
+	if err := attachments.SaveAttachment(&models.Attachment{ID: "a1", Uploader: "alice", Conversation: "dm:alice:bob"}); err != nil {
+		t.Fatal(err)
+	}
+	withA1 := func(clientID string) *models.DirectMessage {
+		return &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: clientID, Attachments: []models.Attachment{{ID: "a1"}}}, Content: "file"}
+	}
+
+	first := withA1("c1")
+	if err := uc.sendDM(t, first); err != nil {
+		t.Fatal(err)
+	}
+	retry := withA1("c1")
+	if err := uc.sendDM(t, retry); err != nil || retry.ID != first.ID {
+		t.Errorf("retry of the first send: %v, ID %s, want %s", err, retry.ID, first.ID)
+	}
+	if err := uc.sendDM(t, withA1("c2")); err != ErrAttachmentInUse {
+		t.Errorf("second message with the attachment: got %v, want ErrAttachmentInUse", err)
+	}
+	// The refused send left its client ID free for a corrected retry
+	if err := uc.sendDM(t, &models.DirectMessage{MessageMeta: models.MessageMeta{ClientID: "c2"}, Content: "no file"}); err != nil {
+		t.Errorf("retry without the attachment: %v", err)
+	}
+
+	if err := uc.messages.DeleteMessage(context.Background(), first.ID, "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if attachment, err := attachments.GetAttachment("a1"); attachment != nil || err != nil {
+		t.Errorf("attachment after its message was deleted: %v, %v", attachment, err)
+	}
+	if err := uc.sendDM(t, withA1("c3")); err != ErrInvalidAttachment {
+		t.Errorf("sending a deleted attachment: got %v, want ErrInvalidAttachment", err)
+	}
+}
@@ -0,0 +1,230 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+
+	uuid "github.com/google/uuid"
+)
+
+type PresenceUseCase interface {
+	Connect(ctx context.Context, user string) (string, error)
+	Disconnect(ctx context.Context, user, session string) error
+	Heartbeat(ctx context.Context, user, session string) error
+	SetState(ctx context.Context, user, state string) error
+	GetPresence(ctx context.Context, users []string) ([]*models.Presence, error)
+	ReapExpiredSessions(ctx context.Context) error
+}
+
+// PresenceConfig holds the tunable limits of the presence use case.
+type PresenceConfig struct {
+	// SessionTTL is how long a connection counts as alive without a heartbeat.
+	SessionTTL time.Duration
+}
+
+type presenceUseCase struct {
+	presenceRepo     repositories.PresenceRepository
+	conversationRepo repositories.ConversationRepository
+	messageRepo      repositories.MessageRepository
+	pubSubService    infrastructure.PubSubService
+	config           PresenceConfig
+}
+
+func NewPresenceUseCase(presenceRepo repositories.PresenceRepository, conversationRepo repositories.ConversationRepository, messageRepo repositories.MessageRepository, pubSubService infrastructure.PubSubService, config PresenceConfig) PresenceUseCase {
+	return &presenceUseCase{
+		presenceRepo:     presenceRepo,
+		conversationRepo: conversationRepo,
+		messageRepo:      messageRepo,
+		pubSubService:    pubSubService,
+		config:           config,
+	}
+}
+
+// Connect registers a new connection of the user and returns its session ID.
+// Contacts are told the user came online if this is their first session.
+func (p *presenceUseCase) Connect(ctx context.Context, user string) (string, error) {
+	now := time.Now()
+	live, err := p.presenceRepo.CountLiveSessions(user, now.UnixMilli())
+	if err != nil {
+		return "", err
+	}
+
+	session := uuid.New().String()
+	if err := p.presenceRepo.SaveSession(user, session, now.Add(p.config.SessionTTL).UnixMilli()); err != nil {
+		return "", err
+	}
+	if err := p.presenceRepo.SetLastSeen(user, now.UnixMilli()); err != nil {
+		return "", err
+	}
+
+	if live == 0 {
+		if err := p.presenceRepo.SetState(user, ""); err != nil {
+			return "", err
+		}
+		p.announce(ctx, &models.Presence{User: user, State: models.PresenceOnline})
+	}
+	return session, nil
+}
+
+// Disconnect ends a session. Contacts are told the user went offline once
+// their last session is gone.
+func (p *presenceUseCase) Disconnect(ctx context.Context, user, session string) error {
+	removed, err := p.presenceRepo.RemoveSession(user, session)
+	if err != nil || !removed {
+		return err
+	}
+	return p.sessionEnded(ctx, user, time.Now())
+}
+
+func (p *presenceUseCase) Heartbeat(ctx context.Context, user, session string) error {
+	now := time.Now()
+	if err := p.presenceRepo.SaveSession(user, session, now.Add(p.config.SessionTTL).UnixMilli()); err != nil {
+		return err
+	}
+	return p.presenceRepo.SetLastSeen(user, now.UnixMilli())
+}
+
+// SetState switches a connected user between online and away. A user with
+// no live session is offline and cannot announce either state.
+func (p *presenceUseCase) SetState(ctx context.Context, user, state string) error {
+	if state != models.PresenceOnline && state != models.PresenceAway {
+		return ErrInvalidPresence
+	}
+
+	live, err := p.presenceRepo.CountLiveSessions(user, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if live == 0 {
+		return ErrNotConnected
+	}
+
+	stored := state
+	if state == models.PresenceOnline {
+		stored = ""
+	}
+	if err := p.presenceRepo.SetState(user, stored); err != nil {
+		return err
+	}
+
+	p.announce(ctx, &models.Presence{User: user, State: state})
+	return nil
+}
+
+func (p *presenceUseCase) GetPresence(ctx context.Context, users []string) ([]*models.Presence, error) {
+	states, err := p.presenceRepo.GetStates(users, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	lastSeen, err := p.presenceRepo.GetLastSeen(users)
+	if err != nil {
+		return nil, err
+	}
+
+	presence := make([]*models.Presence, 0, len(users))
+	for _, user := range users {
+		entry := &models.Presence{User: user, State: models.PresenceOffline}
+		if state, ok := states[user]; ok {
+			entry.State = state
+		}
+		if at, ok := lastSeen[user]; ok {
+			entry.LastSeen = time.UnixMilli(at).UTC().Format(time.RFC3339)
+		}
+		presence = append(presence, entry)
+	}
+	return presence, nil
+}
+
+// ReapExpiredSessions removes sessions whose node stopped sending heartbeats,
+// e.g. because it crashed. Any node may run it; each session is reaped once.
+func (p *presenceUseCase) ReapExpiredSessions(ctx context.Context) error {
+	users, sessions, err := p.presenceRepo.GetExpiredSessions(time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	for i, user := range users {
+		removed, err := p.presenceRepo.RemoveSession(user, sessions[i])
+		if err != nil {
+			return err
+		}
+		if !removed {
+			continue
+		}
+		log.Println("Reaped expired session of", user)
+
+		lastSeen, err := p.presenceRepo.GetLastSeen([]string{user})
+		if err != nil {
+			return err
+		}
+		if err := p.sessionEnded(ctx, user, time.UnixMilli(lastSeen[user])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionEnded announces the user offline if no other session is alive.
+func (p *presenceUseCase) sessionEnded(ctx context.Context, user string, lastSeen time.Time) error {
+	live, err := p.presenceRepo.CountLiveSessions(user, time.Now().UnixMilli())
+	if err != nil || live > 0 {
+		return err
+	}
+
+	if err := p.presenceRepo.SetLastSeen(user, lastSeen.UnixMilli()); err != nil {
+		return err
+	}
+	p.announce(ctx, &models.Presence{User: user, State: models.PresenceOffline, LastSeen: lastSeen.UTC().Format(time.RFC3339)})
+	return nil
+}
+
+// announce pushes a presence change to every user sharing a DM or group
+// with the user.
+func (p *presenceUseCase) announce(ctx context.Context, presence *models.Presence) {
+	contacts, err := p.contacts(presence.User)
+	if err != nil {
+		log.Println("Failed to resolve contacts of", presence.User, ":", err)
+		return
+	}
+
+	data, _ := json.Marshal(presence)
+	for _, contact := range contacts {
+		event := models.WSMessage{Type: "presence", From: presence.User, To: contact, Content: presence.State, Data: data}
+		if err := p.pubSubService.PublishToUser(ctx, contact, event); err != nil {
+			log.Println("Failed to publish presence event to", contact, ":", err)
+		}
+	}
+}
+
+func (p *presenceUseCase) contacts(user string) ([]string, error) {
+	keys, err := p.conversationRepo.GetUserConversations(user)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{user: true}
+	contacts := []string{}
+	for _, key := range keys {
+		conv := parseConversationKey(key)
+		users := conv.users
+		if conv.kind == conversationGroup {
+			if users, err = p.messageRepo.GetGroupMembers(fmt.Sprintf("group:%s:members", conv.name)); err != nil {
+				return nil, err
+			}
+		}
+		for _, u := range users {
+			if !seen[u] {
+				seen[u] = true
+				contacts = append(contacts, u)
+			}
+		}
+	}
+	return contacts, nil
+}
@@ -0,0 +1,105 @@
+package usecases
+
+import (
+	"html"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+)
+
+const snippetRadius = 60
+
+func isTermRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// tokenize splits text into distinct lower-cased search terms.
+func tokenize(text string) []string {
+	seen := make(map[string]bool)
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isTermRune(r) }) {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// highlight returns an HTML-escaped excerpt of content around the first
+// matching term, with every matching term wrapped in <mark>.
+func highlight(content string, terms []string) string {
+	match := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		match[term] = true
+	}
+
+	runes := []rune(content)
+	type span struct{ start, end int }
+	var hits []span
+	for i := 0; i < len(runes); {
+		if !isTermRune(runes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isTermRune(runes[j]) {
+			j++
+		}
+		if match[strings.ToLower(string(runes[i:j]))] {
+			hits = append(hits, span{i, j})
+		}
+		i = j
+	}
+
+	start, end := 0, len(runes)
+	if len(hits) > 0 {
+		start = max(0, hits[0].start-snippetRadius)
+		end = min(len(runes), hits[0].end+snippetRadius)
+	} else if end > 2*snippetRadius {
+		end = 2 * snippetRadius
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, hit := range hits {
+		if hit.start < start || hit.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:hit.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[hit.start:hit.end])))
+		b.WriteString("</mark>")
+		pos = hit.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// indexMessage (re)builds the search index entry of a stored message.
+func indexMessage(searchRepo repositories.SearchRepository, key string, msg *models.Message) error {
+	if err := searchRepo.RemoveMessage(msg.ID); err != nil {
+		return err
+	}
+
+	terms := tokenize(msg.Content)
+	if len(terms) == 0 || msg.Deleted {
+		return nil
+	}
+
+	var timestamp int64
+	if sentAt, err := time.Parse(time.RFC3339, msg.Timestamp); err == nil {
+		timestamp = sentAt.Unix()
+	}
+
+	return searchRepo.IndexMessage(&models.SearchDocument{ID: msg.ID, Key: key, From: msg.From, Timestamp: timestamp}, terms)
+}
@@ -0,0 +1,143 @@
+package usecases
+
+import (
+	"context"
+	"log"
+	"math"
+
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+)
+
+type SearchUseCase interface {
+	Search(ctx context.Context, user string, query *models.SearchQuery) (*models.SearchResults, error)
+	Reindex(ctx context.Context) (int, error)
+}
+
+type searchUseCase struct {
+	messageRepo      repositories.MessageRepository
+	searchRepo       repositories.SearchRepository
+	conversationRepo repositories.ConversationRepository
+}
+
+func NewSearchUseCase(messageRepo repositories.MessageRepository, searchRepo repositories.SearchRepository, conversationRepo repositories.ConversationRepository) SearchUseCase {
+	return &searchUseCase{
+		messageRepo:      messageRepo,
+		searchRepo:       searchRepo,
+		conversationRepo: conversationRepo,
+	}
+}
+
+// Search finds messages containing every word of the query in conversations
+// the user can read, newest first. Only the index of those conversations is
+// searched, and only the requested page is loaded.
+func (s *searchUseCase) Search(ctx context.Context, user string, query *models.SearchQuery) (*models.SearchResults, error) {
+	terms := tokenize(query.Text)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	keys, err := s.searchableKeys(user, query.Conversation)
+	if err != nil {
+		return nil, err
+	}
+
+	minTime, maxTime := int64(math.MinInt64), int64(math.MaxInt64)
+	if !query.After.IsZero() {
+		minTime = query.After.Unix()
+	}
+	if !query.Before.IsZero() {
+		maxTime = query.Before.Unix()
+	}
+
+	// Messages the user deleted for themselves are not found
+	hidden, err := s.messageRepo.GetHiddenMessages(user)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make([]string, 0, len(hidden))
+	for id := range hidden {
+		exclude = append(exclude, id)
+	}
+
+	ids, total, err := s.searchRepo.FindMessages(keys, terms, query.From, exclude, minTime, maxTime, query.Offset, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := s.searchRepo.GetDocuments(ids)
+	if err != nil {
+		return nil, err
+	}
+	conversations := make(map[string]string, len(docs))
+	for _, doc := range docs {
+		conversations[doc.ID] = doc.Key
+	}
+	msgs, err := s.messageRepo.GetMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &models.SearchResults{Results: []*models.SearchResult{}, Total: total}
+	for _, msg := range msgs {
+		results.Results = append(results.Results, &models.SearchResult{
+			Conversation: parseConversationKey(conversations[msg.ID]).id(),
+			Message:      msg,
+			Snippet:      highlight(msg.Content, terms),
+		})
+	}
+	return results, nil
+}
+
+// searchableKeys returns the message lists a search covers: the one
+// conversation asked for, failing like its history if the user cannot read
+// it, or else every DM and group of the user and the broadcasts.
+func (s *searchUseCase) searchableKeys(user, conversationID string) ([]string, error) {
+	if conversationID != "" {
+		conv, ok := parseConversationID(conversationID)
+		if !ok {
+			return nil, ErrInvalidConversation
+		}
+		if err := requireAccess(s.messageRepo, conv, user); err != nil {
+			return nil, err
+		}
+		return []string{conv.key()}, nil
+	}
+
+	keys, err := s.conversationRepo.GetUserConversations(user)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, conversation{kind: conversationBroadcast}.key()), nil
+}
+
+// Reindex rebuilds the search index from every stored conversation and
+// returns how many messages were indexed.
+func (s *searchUseCase) Reindex(ctx context.Context) (int, error) {
+	keys, err := s.messageRepo.GetConversationKeys()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.searchRepo.Clear(); err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	for _, key := range keys {
+		msgs, err := s.messageRepo.GetConversationMessages(key)
+		if err != nil {
+			return indexed, err
+		}
+		for _, msg := range msgs {
+			// Messages stored before IDs existed cannot be addressed
+			if msg.ID == "" {
+				continue
+			}
+			if err := indexMessage(s.searchRepo, key, msg); err != nil {
+				return indexed, err
+			}
+			indexed++
+		}
+		log.Println("Reindexed", key)
+	}
+	return indexed, nil
+}
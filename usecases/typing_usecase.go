@@ -0,0 +1,99 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/haileamlak/chat-system/infrastructure"
+	"github.com/haileamlak/chat-system/models"
+	"github.com/haileamlak/chat-system/repositories"
+)
+
+type TypingUseCase interface {
+	StartTyping(ctx context.Context, user, conversationID string) error
+	StopTyping(ctx context.Context, user, conversationID string) error
+}
+
+// TypingConfig holds the tunable limits of the typing use case.
+type TypingConfig struct {
+	// TTL is how long clients show an indicator that is not refreshed.
+	TTL time.Duration
+	// Interval is the minimum time between relayed starts of a user in one
+	// conversation, over every connection and API.
+	Interval time.Duration
+}
+
+type typingUseCase struct {
+	messageRepo   repositories.MessageRepository
+	typingRepo    repositories.TypingRepository
+	pubSubService infrastructure.PubSubService
+	config        TypingConfig
+}
+
+func NewTypingUseCase(messageRepo repositories.MessageRepository, typingRepo repositories.TypingRepository, pubSubService infrastructure.PubSubService, config TypingConfig) TypingUseCase {
+	return &typingUseCase{
+		messageRepo:   messageRepo,
+		typingRepo:    typingRepo,
+		pubSubService: pubSubService,
+		config:        config,
+	}
+}
+
+// StartTyping tells the other participants of a DM or group that the user is
+// typing. The indicator expires on its own unless refreshed; refreshes coming
+// faster than the interval are dropped.
+func (t *typingUseCase) StartTyping(ctx context.Context, user, conversationID string) error {
+	conv, err := t.checkAccess(user, conversationID)
+	if err != nil {
+		return err
+	}
+
+	if t.config.Interval > 0 {
+		relay, err := t.typingRepo.ThrottleTyping(user, conv.id(), t.config.Interval)
+		if err != nil || !relay {
+			return err
+		}
+	}
+	t.relay(ctx, user, conv, &models.TypingIndicator{Typing: true, TTL: t.config.TTL.Milliseconds()})
+	return nil
+}
+
+// StopTyping clears the user's indicator in a DM or group. The next start is
+// relayed right away.
+func (t *typingUseCase) StopTyping(ctx context.Context, user, conversationID string) error {
+	conv, err := t.checkAccess(user, conversationID)
+	if err != nil {
+		return err
+	}
+
+	if err := t.typingRepo.ClearTypingThrottle(user, conv.id()); err != nil {
+		return err
+	}
+	t.relay(ctx, user, conv, &models.TypingIndicator{})
+	return nil
+}
+
+// checkAccess resolves a DM or group the user takes part in.
+func (t *typingUseCase) checkAccess(user, conversationID string) (conversation, error) {
+	conv, ok := parseConversationID(conversationID)
+	if !ok || conv.kind == conversationBroadcast {
+		return conversation{}, ErrInvalidConversation
+	}
+
+	allowed, err := canAccessConversation(t.messageRepo, conv, user)
+	if err != nil {
+		return conversation{}, err
+	}
+	if !allowed {
+		return conversation{}, ErrNotParticipant
+	}
+	return conv, nil
+}
+
+func (t *typingUseCase) relay(ctx context.Context, user string, conv conversation, indicator *models.TypingIndicator) {
+	indicator.Conversation = conv.id()
+	indicator.User = user
+	data, _ := json.Marshal(indicator)
+	notifyConversation(ctx, t.messageRepo, publishLive(t.pubSubService), conv, user, models.WSMessage{Type: "typing", From: user, Data: data})
+}
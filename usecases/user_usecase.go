@@ -2,7 +2,6 @@ package usecases
 
 import (
 	"context"
-	"errors"
 
 	"github.com/haileamlak/chat-system/infrastructure"
 	"github.com/haileamlak/chat-system/repositories"
@@ -11,6 +10,7 @@ import (
 type UserUseCase interface {
 	Register(ctx context.Context, username string, password string) error
 	Login(ctx context.Context, username string, password string) (string, error)
+	UserExists(ctx context.Context, username string) (bool, error)
 }
 
 type userUseCase struct {
@@ -34,7 +34,7 @@ func (u *userUseCase) Register(ctx context.Context, username string, password st
 		return err
 	}
 	if exists {
-		return errors.New("user already exists")
+		return ErrUsernameTaken
 	}
 
 	// Hash the password
@@ -53,10 +53,13 @@ func (u *userUseCase) Login(ctx context.Context, username string, password strin
 	if err != nil {
 		return "", err
 	}
+	if hashedPassword == "" {
+		return "", ErrInvalidCredentials
+	}
 
 	// Compare the passwords
 	if err := u.passwordService.ComparePasswords(hashedPassword, password); err != nil {
-		return "", err
+		return "", ErrInvalidCredentials
 	}
 
 	// Generate a new session token
@@ -71,4 +74,8 @@ func (u *userUseCase) Login(ctx context.Context, username string, password strin
 	}
 
 	return token, nil
-}	
\ No newline at end of file
+}
+
+func (u *userUseCase) UserExists(ctx context.Context, username string) (bool, error) {
+	return u.userRepo.UserExists(ctx, username)
+}